@@ -0,0 +1,326 @@
+// Package asg takes the instances in an autoscaling group in and out of
+// standby and waits for the group, and the load balancer in front of it, to
+// catch up.
+package asg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many times ExitStandby waits for the instances before giving up
+const ExitStandbyAttempts = 3
+
+type pollActivitiesFunc func(
+	*autoscaling.DescribeScalingActivitiesInput,
+	autoscalingiface.AutoScalingAPI,
+	string,
+) (bool, error)
+
+// Group describes the autoscaling group, an error if there isn't one by
+// that name
+func Group(
+	svc autoscalingiface.AutoScalingAPI,
+	name string) (*autoscaling.Group, error) {
+	resp, err := svc.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{
+			aws.String(name),
+		},
+		MaxRecords: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("the autoscaling group %s was not found", name)
+	}
+
+	return resp.AutoScalingGroups[0], nil
+}
+
+// InstanceIDs lists the IDs of the instances
+func InstanceIDs(
+	instances []*autoscaling.Instance) []*string {
+	instanceIDs := []*string{}
+
+	for _, instance := range instances {
+		instanceIDs = append(instanceIDs, instance.InstanceId)
+	}
+
+	log.WithFields(log.Fields{
+		"instanceIDs": aws.StringValueSlice(instanceIDs),
+	}).Debug("Instances in auto scaling group")
+
+	return instanceIDs
+}
+
+// AllInService is true when every instance is in service
+func AllInService(instances []*autoscaling.Instance) bool {
+	log.WithField("instances", instances).Debug("AllInService")
+	for _, i := range instances {
+		if *(i.LifecycleState) != "InService" {
+			log.WithField("instances", instances).Info("Some instances not in service")
+			return false
+		}
+	}
+
+	log.Info("All instances now in service")
+	return true
+}
+
+// EnterStandby puts the instances into standby, decrementing the desired
+// capacity so they aren't replaced, and waits for them to get there unless
+// abort is closed first. It returns how many steps failed.
+func EnterStandby(
+	c clock.Clock,
+	svc autoscalingiface.AutoScalingAPI,
+	name string,
+	instanceIDs []*string,
+	poll time.Duration,
+	timeout time.Duration,
+	abort <-chan struct{},
+) int {
+	log.Info("Attempting to enter standby")
+
+	ret := 0
+	enterStandbyOutput, err := svc.EnterStandby(enterStandbyInput(instanceIDs, &name))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":                err,
+			"enterStandbyOutput": enterStandbyOutput,
+		}).Error("Error entering instances into standby")
+		// We'll let the logic carry on, which may mean that the wait for
+		// standby will timeout but will continue to attempt to put everything
+		// back into service.
+		ret++
+	}
+
+	if enterStandbyOutput == nil || len(enterStandbyOutput.Activities) == 0 {
+		log.Error("There is no standby activity to wait for")
+		return ret + 1
+	}
+
+	activityIDs := []*string{enterStandbyOutput.Activities[0].ActivityId}
+	result := WaitForActivities(
+		c,
+		svc,
+		name,
+		activityIDs,
+		poll,
+		timeout,
+		abort)
+
+	if result == false {
+		log.
+			Error("Some (or all) of the instances in the autoscaling group did not enter standby")
+		ret++
+	} else {
+		log.
+			Info("Instances now in standby")
+	}
+
+	return ret
+}
+
+// ExitStandby takes the instances out of standby and waits for them to come
+// back into service, waiting again up to ExitStandbyAttempts times. It
+// returns how many of the waits failed, none if a later wait succeeded, or 1
+// if the instances couldn't be taken out of standby at all. It also returns
+// how many times it waited again after a failed wait.
+func ExitStandby(
+	c clock.Clock,
+	svc autoscalingiface.AutoScalingAPI,
+	name string,
+	instanceIDs []*string,
+	poll time.Duration,
+	timeout time.Duration,
+) (int, int) {
+	return exitStandby(c, svc, name, instanceIDs, poll, timeout, func(in bool) bool { return in })
+}
+
+func exitStandby(
+	c clock.Clock,
+	svc autoscalingiface.AutoScalingAPI,
+	name string,
+	instanceIDs []*string,
+	poll time.Duration,
+	timeout time.Duration,
+	isSuccess func(bool) bool,
+) (int, int) {
+	log.Info("Attempting to exit standby")
+	exitStandbyArgs := autoscaling.ExitStandbyInput{
+		AutoScalingGroupName: &name,
+		InstanceIds:          instanceIDs,
+	}
+
+	exitStandbyOutput, err := svc.ExitStandby(&exitStandbyArgs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"exitStandbyOutput": exitStandbyOutput,
+			"err":               err,
+		}).Error("Error calling ExitStandby")
+		return 1, 0
+	}
+
+	if exitStandbyOutput == nil || len(exitStandbyOutput.Activities) == 0 {
+		log.Error("There is no exit standby activity to wait for")
+		return 1, 0
+	}
+
+	activityIDs := []*string{exitStandbyOutput.Activities[0].ActivityId}
+
+	ret := 0
+	retries := 0
+	for i := 0; i < ExitStandbyAttempts; i++ {
+		if i > 0 {
+			retries++
+		}
+
+		// The instances always go back into service, even if the drill
+		// was aborted
+		result := WaitForActivities(
+			c,
+			svc,
+			name,
+			activityIDs,
+			poll,
+			timeout,
+			nil)
+
+		if isSuccess(result) {
+			log.Info("Instances exited standby")
+			ret = 0
+			break
+		}
+
+		log.Error("Instances failed to reach successful status")
+		ret++
+	}
+
+	return ret, retries
+}
+
+// WaitForActivities polls the scaling activities until they are all
+// successful, returning false if they aren't by the timeout or abort is
+// closed first. A nil abort never closes.
+func WaitForActivities(
+	c clock.Clock,
+	svc autoscalingiface.AutoScalingAPI,
+	name string,
+	activityIDs []*string,
+	poll time.Duration,
+	timeout time.Duration,
+	abort <-chan struct{},
+) bool {
+	return pollActivities(
+		c,
+		describeScalingActivitiesInput(activityIDs, &name),
+		checkActivitiesForStatus,
+		svc,
+		poll,
+		timeout,
+		"Successful",
+		abort)
+}
+
+func pollActivities(
+	c clock.Clock,
+	describeActivityConfig *autoscaling.DescribeScalingActivitiesInput,
+	pollFunc pollActivitiesFunc,
+	svc autoscalingiface.AutoScalingAPI,
+	poll time.Duration,
+	timeout time.Duration,
+	statusCode string,
+	abort <-chan struct{},
+) bool {
+
+	log.WithFields(log.Fields{
+		"describeActivityConfig": describeActivityConfig,
+	}).Debug("pollActivities: ASG describe input")
+
+	var pollIteration int64
+
+	for {
+		if pollIteration >= clock.Attempts(timeout, poll) {
+			break
+		}
+
+		success, err := pollFunc(describeActivityConfig, svc, statusCode)
+		if err != nil {
+			log.WithError(err).Error("Error waiting for ASG update")
+			break
+		}
+
+		if success {
+			return true
+		}
+
+		if !clock.SleepUnlessAborted(c, poll, abort) {
+			log.Warn("ASG status polling aborted")
+			break
+		}
+		pollIteration++
+		log.WithField("poll", pollIteration).Info("Polling ASG status")
+	}
+
+	return false
+}
+
+func checkActivitiesForStatus(
+	describeActivityConfig *autoscaling.DescribeScalingActivitiesInput,
+	svc autoscalingiface.AutoScalingAPI,
+	statusCode string,
+) (bool, error) {
+
+	resp, err := svc.DescribeScalingActivities(describeActivityConfig)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"response": resp,
+			"err":      err,
+		}).Error("DescribeScalingActivities failed")
+		return false, err
+	}
+
+	finished := true
+
+	for _, activity := range resp.Activities {
+		if *activity.StatusCode != statusCode {
+			finished = false
+		}
+	}
+
+	return finished, err
+}
+
+func describeScalingActivitiesInput(
+	activityIDs []*string,
+	resourceName *string) *autoscaling.DescribeScalingActivitiesInput {
+	return &autoscaling.DescribeScalingActivitiesInput{
+		ActivityIds:          activityIDs,
+		AutoScalingGroupName: resourceName,
+		MaxRecords:           aws.Int64(1),
+	}
+}
+
+func enterStandbyInput(
+	instanceIDs []*string,
+	resourceName *string) *autoscaling.EnterStandbyInput {
+	ret := &autoscaling.EnterStandbyInput{
+		AutoScalingGroupName:           resourceName,
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+		InstanceIds:                    instanceIDs,
+	}
+
+	log.WithFields(log.Fields{
+		"EnterStandbyInput": ret,
+	}).Debug("Query parameters for stand by")
+
+	return ret
+}
@@ -0,0 +1,459 @@
+package asg
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.PanicLevel)
+	os.Exit(m.Run())
+}
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+	Error   string
+	Success bool
+
+	// EnterStandby fails and ExitStandby returns no activities
+	NoActivities bool
+
+	// DescribeAutoScalingGroups doesn't find the group
+	NoGroup bool
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingGroups(
+	input *autoscaling.DescribeAutoScalingGroupsInput) (
+	*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if m.Error == "DescribeAutoScalingGroups" {
+		return nil, errors.New("Error")
+	}
+
+	if m.NoGroup {
+		return &autoscaling.DescribeAutoScalingGroupsOutput{}, nil
+	}
+
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: input.AutoScalingGroupNames[0],
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("instance1"), LifecycleState: aws.String("InService")},
+					{InstanceId: aws.String("instance2"), LifecycleState: aws.String("InService")},
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockAutoScalingClient) DescribeScalingActivities(
+	*autoscaling.DescribeScalingActivitiesInput) (
+	*autoscaling.DescribeScalingActivitiesOutput, error) {
+	statusCode := "Fail"
+	if m.Success {
+		statusCode = "Successful"
+	}
+
+	activity := autoscaling.Activity{StatusCode: aws.String(statusCode)}
+	activities := []*autoscaling.Activity{&activity}
+	resp := &autoscaling.DescribeScalingActivitiesOutput{Activities: activities}
+
+	var err error
+	if m.Error == "DescribeScalingActivities" {
+		err = errors.New("Error")
+	}
+
+	return resp, err
+}
+
+func (m *mockAutoScalingClient) EnterStandby(
+	input *autoscaling.EnterStandbyInput) (*autoscaling.EnterStandbyOutput, error) {
+	if m.NoActivities {
+		return nil, errors.New("Error")
+	}
+
+	ret := autoscaling.EnterStandbyOutput{
+		Activities: []*autoscaling.Activity{
+			&autoscaling.Activity{ActivityId: aws.String("activity1")},
+		},
+	}
+
+	var err error
+	if m.Error == "EnterStandby" {
+		err = errors.New("Error")
+	}
+
+	return &ret, err
+}
+
+func (m *mockAutoScalingClient) ExitStandby(
+	*autoscaling.ExitStandbyInput) (*autoscaling.ExitStandbyOutput, error) {
+	if m.NoActivities {
+		return &autoscaling.ExitStandbyOutput{}, nil
+	}
+
+	ret := autoscaling.ExitStandbyOutput{
+		Activities: []*autoscaling.Activity{
+			&autoscaling.Activity{ActivityId: aws.String("activity1")},
+		},
+	}
+
+	var err error
+	if m.Error == "ExitStandby" {
+		err = errors.New("Error")
+	}
+
+	return &ret, err
+}
+
+// testClock is a fake clock for the tests to poll by
+func testClock() *clock.Fake {
+	return clock.NewFake(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC))
+}
+
+func TestGroup(t *testing.T) {
+	group, err := Group(&mockAutoScalingClient{}, "test")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "test", aws.StringValue(group.AutoScalingGroupName))
+	assert.Equal(t, []string{"instance1", "instance2"}, aws.StringValueSlice(InstanceIDs(group.Instances)))
+}
+
+func TestGroupError(t *testing.T) {
+	_, err := Group(&mockAutoScalingClient{Error: "DescribeAutoScalingGroups"}, "test")
+	assert.EqualError(t, err, "Error")
+}
+
+func TestGroupNotFound(t *testing.T) {
+	group, err := Group(&mockAutoScalingClient{NoGroup: true}, "test")
+
+	assert.Nil(t, group)
+	assert.EqualError(t, err, "the autoscaling group test was not found")
+}
+
+func TestInstanceIDs(t *testing.T) {
+	instances := []*autoscaling.Instance{
+		{InstanceId: aws.String("instanceIdOne")},
+		{InstanceId: aws.String("instanceIdTwo")},
+		{InstanceId: aws.String("instanceIdThree")},
+	}
+
+	assert.Equal(t,
+		[]string{"instanceIdOne", "instanceIdTwo", "instanceIdThree"},
+		aws.StringValueSlice(InstanceIDs(instances)))
+}
+
+func TestEnterStandbyInput(t *testing.T) {
+	instanceIDs := aws.StringSlice([]string{"instanceIdOne", "instanceIdTwo"})
+
+	input := enterStandbyInput(instanceIDs, aws.String("ResourceName"))
+
+	assert.Equal(t, "ResourceName", *input.AutoScalingGroupName)
+	assert.True(t, *input.ShouldDecrementDesiredCapacity)
+	assert.Equal(t, instanceIDs, input.InstanceIds)
+}
+
+func TestDescribeScalingActivitiesInput(t *testing.T) {
+	activityIDs := aws.StringSlice([]string{"ActivityIdOne", "ActivityIdTwo"})
+
+	input := describeScalingActivitiesInput(activityIDs, aws.String("ResourceName"))
+
+	assert.Equal(t, "ResourceName", *input.AutoScalingGroupName)
+	assert.Equal(t, activityIDs, input.ActivityIds)
+}
+
+func TestPollActivities(t *testing.T) {
+	pollIteration := 0
+	pollFunc :=
+		func(
+			*autoscaling.DescribeScalingActivitiesInput,
+			autoscalingiface.AutoScalingAPI,
+			string) (bool, error) {
+			assert.Equal(t, pollIteration < 5, true)
+			pollIteration++
+			return (pollIteration == 4), nil
+		}
+
+	success := pollActivities(testClock(), &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{Success: true}, 1*time.Millisecond, 5*time.Millisecond, "Successful", nil)
+
+	assert.Equal(t, success, true)
+}
+
+func TestPollActivitiesWhenTimesOut(t *testing.T) {
+	c := testClock()
+
+	pollFunc := func(
+		*autoscaling.DescribeScalingActivitiesInput,
+		autoscalingiface.AutoScalingAPI,
+		string) (bool, error) {
+		return false, nil
+	}
+
+	success := pollActivities(c, &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{Success: true}, time.Minute, 5*time.Minute, "Successful", nil)
+
+	assert.Equal(t, success, false)
+	assert.Equal(t, 5*time.Minute, c.Elapsed())
+}
+
+func TestPollActivitiesErrorHandling(t *testing.T) {
+	pollIteration := 0
+	pollFunc := func(
+		*autoscaling.DescribeScalingActivitiesInput,
+		autoscalingiface.AutoScalingAPI,
+		string) (bool, error) {
+		pollIteration++
+
+		return false, errors.New("Test Error")
+	}
+
+	success := pollActivities(testClock(), &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{Success: true}, 1*time.Millisecond, 5*time.Millisecond, "Successful", nil)
+
+	assert.Equal(t, success, false)
+	assert.Equal(t, pollIteration, 1)
+}
+
+func TestPollActivitiesSuccessOnLastTick(t *testing.T) {
+	c := testClock()
+
+	calls := 0
+	pollFunc := func(
+		*autoscaling.DescribeScalingActivitiesInput,
+		autoscalingiface.AutoScalingAPI,
+		string) (bool, error) {
+		calls++
+		return calls == 4, nil
+	}
+
+	// The last check is 9s in, inside the 10s timeout
+	success := pollActivities(c, &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{}, 3*time.Second, 10*time.Second, "Successful", nil)
+
+	assert.True(t, success)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, 9*time.Second, c.Elapsed())
+}
+
+func TestPollActivitiesZeroPoll(t *testing.T) {
+	c := testClock()
+
+	calls := 0
+	pollFunc := func(
+		*autoscaling.DescribeScalingActivitiesInput,
+		autoscalingiface.AutoScalingAPI,
+		string) (bool, error) {
+		calls++
+		return false, nil
+	}
+
+	success := pollActivities(c, &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{}, 0, time.Minute, "Successful", nil)
+
+	assert.False(t, success)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, time.Duration(0), c.Elapsed())
+}
+
+func TestCheckActivitiesForStatusError(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
+	success, err := checkActivitiesForStatus(&autoscaling.DescribeScalingActivitiesInput{}, mockSvc, "Successful")
+
+	assert.Equal(t, success, false)
+	assert.EqualError(t, err, "Error")
+}
+
+func TestCheckActivitiesForStatusNotFinished(t *testing.T) {
+	success, err := checkActivitiesForStatus(&autoscaling.DescribeScalingActivitiesInput{}, &mockAutoScalingClient{}, "Successful")
+
+	assert.Equal(t, false, success)
+	assert.Equal(t, nil, err)
+}
+
+func TestCheckActivitiesForStatus(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Success: true}
+	success, err := checkActivitiesForStatus(&autoscaling.DescribeScalingActivitiesInput{}, mockSvc, "Successful")
+
+	assert.Equal(t, success, true)
+	assert.Equal(t, err, nil)
+}
+
+func TestPollActivitiesAborted(t *testing.T) {
+	c := testClock()
+	abort := make(chan struct{})
+	close(abort)
+
+	calls := 0
+	pollFunc := func(
+		*autoscaling.DescribeScalingActivitiesInput,
+		autoscalingiface.AutoScalingAPI,
+		string) (bool, error) {
+		calls++
+		return false, nil
+	}
+
+	success := pollActivities(c, &autoscaling.DescribeScalingActivitiesInput{}, pollFunc,
+		&mockAutoScalingClient{}, time.Minute, time.Hour, "Successful", abort)
+
+	assert.False(t, success)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, time.Duration(0), c.Elapsed())
+}
+
+func TestWaitForActivities(t *testing.T) {
+	success := WaitForActivities(
+		testClock(),
+		&mockAutoScalingClient{Success: true},
+		"test",
+		[]*string{aws.String("test")},
+		1*time.Millisecond,
+		10*time.Millisecond,
+		nil)
+
+	assert.Equal(t, success, true)
+}
+
+func TestEnterStandby(t *testing.T) {
+	instances := []*string{aws.String("instance1")}
+	assert.Equal(t, 0, EnterStandby(testClock(), &mockAutoScalingClient{Success: true}, "test", instances, time.Millisecond, 3*time.Millisecond, nil))
+}
+
+func TestEnterStandbyError(t *testing.T) {
+	instances := []*string{aws.String("instance1")}
+	assert.Equal(t, 1, EnterStandby(testClock(), &mockAutoScalingClient{Error: "EnterStandby", Success: true}, "test", instances, time.Millisecond, 3*time.Millisecond, nil))
+}
+
+func TestEnterStandbyNoActivities(t *testing.T) {
+	instances := []*string{aws.String("instance1")}
+	assert.Equal(t, 2, EnterStandby(testClock(), &mockAutoScalingClient{NoActivities: true}, "test", instances, time.Millisecond, 3*time.Millisecond, nil))
+}
+
+func TestExitStandbySuccess(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Success: true}
+	instances := []*string{aws.String("instance1")}
+	failures, retries := ExitStandby(
+		testClock(),
+		mockSvc,
+		"test",
+		instances,
+		1*time.Millisecond,
+		9*time.Millisecond)
+	assert.Equal(t, 0, failures)
+	assert.Equal(t, 0, retries)
+}
+
+func TestExitStandbyExitCallFail(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Error: "ExitStandby"}
+	instances := []*string{aws.String("instance1")}
+	failures, retries := ExitStandby(
+		testClock(),
+		mockSvc,
+		"test",
+		instances,
+		1*time.Millisecond,
+		9*time.Millisecond)
+	assert.Equal(t, 1, failures)
+	assert.Equal(t, 0, retries)
+}
+
+func TestExitStandbyNoActivities(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{NoActivities: true}
+	instances := []*string{aws.String("instance1")}
+	failures, retries := ExitStandby(
+		testClock(),
+		mockSvc,
+		"test",
+		instances,
+		1*time.Millisecond,
+		9*time.Millisecond)
+	assert.Equal(t, 1, failures)
+	assert.Equal(t, 0, retries)
+}
+
+func TestExitStandbyWaitFail(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
+	instances := []*string{aws.String("instance1")}
+	failures, retries := ExitStandby(
+		testClock(),
+		mockSvc,
+		"test",
+		instances,
+		1*time.Millisecond,
+		9*time.Millisecond)
+	assert.Equal(t, 3, failures)
+	assert.Equal(t, 2, retries)
+}
+
+func TestExitStandbySecondAttempt(t *testing.T) {
+	loop := 0
+	isSuccess := func(in bool) bool {
+		loop++
+		if loop == 2 {
+			return true
+		}
+		return false
+	}
+
+	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
+	instances := []*string{aws.String("instance1")}
+	failures, retries := exitStandby(
+		testClock(),
+		mockSvc,
+		"test",
+		instances,
+		1*time.Millisecond,
+		9*time.Millisecond,
+		isSuccess)
+	assert.Equal(t, 0, failures)
+	// The first wait failing still counts once it succeeds
+	assert.Equal(t, 1, retries)
+}
+
+func TestAllInServiceAllInService(t *testing.T) {
+	instances := []*autoscaling.Instance{
+		&autoscaling.Instance{
+			LifecycleState: aws.String("InService")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("InService")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("InService")},
+	}
+
+	assert.True(t, AllInService(instances))
+}
+
+func TestAllInServiceNoneInService(t *testing.T) {
+	instances := []*autoscaling.Instance{
+		&autoscaling.Instance{
+			LifecycleState: aws.String("Pending")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("Pending")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("Pending")},
+	}
+
+	assert.False(t, AllInService(instances))
+}
+
+func TestAllInServiceSomeInService(t *testing.T) {
+	instances := []*autoscaling.Instance{
+		&autoscaling.Instance{
+			LifecycleState: aws.String("InService")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("Pending")},
+		&autoscaling.Instance{
+			LifecycleState: aws.String("Pending")},
+	}
+
+	assert.False(t, AllInService(instances))
+}
@@ -0,0 +1,204 @@
+package asg
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// TargetStatesOutOfService mean the load balancer has stopped sending
+// traffic to the instances, i.e. they are on their way out or already
+// deregistered.
+var TargetStatesOutOfService = []string{
+	elbv2.TargetHealthStateEnumDraining,
+	elbv2.TargetHealthStateEnumUnused,
+}
+
+// TargetStatesInService mean the load balancer is sending traffic to the
+// instances again.
+var TargetStatesInService = []string{
+	elbv2.TargetHealthStateEnumHealthy,
+}
+
+type pollTargetHealth func(
+	elbv2iface.ELBV2API,
+	*string,
+	[]*string,
+	[]string,
+) (bool, error)
+
+// WaitForTargetHealth waits for the instances to reach one of the states in
+// every target group, returning how many target groups they didn't. The
+// target groups are polled together so they share the one timeout. Closing
+// abort stops the wait.
+func WaitForTargetHealth(
+	c clock.Clock,
+	elbSvc elbv2iface.ELBV2API,
+	targetGroupARNs []*string,
+	instanceIDs []*string,
+	states []string,
+	poll time.Duration,
+	timeout time.Duration,
+	abort <-chan struct{},
+) int {
+	log.WithField("states", states).Info("Waiting for load balancer targets")
+
+	if len(targetGroupARNs) == 0 {
+		log.Info("No target groups attached to the autoscaling group, skipping target health check")
+		return 0
+	}
+
+	failed := handleTargetHealthPolling(
+		c,
+		elbSvc,
+		targetGroupARNs,
+		instanceIDs,
+		checkTargetHealthForStates,
+		poll,
+		timeout,
+		states,
+		abort)
+
+	for _, targetGroupARN := range targetGroupARNs {
+		if failed[targetGroupARN] {
+			log.WithFields(log.Fields{
+				"targetGroupARN": *targetGroupARN,
+				"states":         states,
+			}).Error("Load balancer targets did not reach the expected state")
+		} else {
+			log.WithFields(log.Fields{
+				"targetGroupARN": *targetGroupARN,
+				"states":         states,
+			}).Info("Load balancer targets reached the expected state")
+		}
+	}
+
+	return len(failed)
+}
+
+// handleTargetHealthPolling polls the target groups until the instances are
+// in the states in all of them, returning those where they weren't. A target
+// group whose health can't be read is given up on.
+func handleTargetHealthPolling(
+	c clock.Clock,
+	elbSvc elbv2iface.ELBV2API,
+	targetGroupARNs []*string,
+	instanceIDs []*string,
+	pollFunc pollTargetHealth,
+	poll time.Duration,
+	timeout time.Duration,
+	states []string,
+	abort <-chan struct{},
+) map[*string]bool {
+
+	failed := map[*string]bool{}
+	pending := targetGroupARNs
+
+	var pollIteration int64
+
+	for {
+		if pollIteration >= clock.Attempts(timeout, poll) {
+			break
+		}
+
+		waiting := []*string{}
+		for _, targetGroupARN := range pending {
+			log.WithFields(log.Fields{
+				"targetGroupARN": *targetGroupARN,
+			}).Debug("handleTargetHealthPolling: target group")
+
+			success, err := pollFunc(elbSvc, targetGroupARN, instanceIDs, states)
+			if err != nil {
+				log.WithError(err).Error("Error waiting for target health")
+				failed[targetGroupARN] = true
+			} else if !success {
+				waiting = append(waiting, targetGroupARN)
+			}
+		}
+		pending = waiting
+
+		if len(pending) == 0 {
+			return failed
+		}
+
+		if !clock.SleepUnlessAborted(c, poll, abort) {
+			log.Warn("Target health polling aborted")
+			break
+		}
+		pollIteration++
+		log.WithField("poll", pollIteration).Info("Polling target health")
+	}
+
+	for _, targetGroupARN := range pending {
+		failed[targetGroupARN] = true
+	}
+
+	return failed
+}
+
+func checkTargetHealthForStates(
+	elbSvc elbv2iface.ELBV2API,
+	targetGroupARN *string,
+	instanceIDs []*string,
+	states []string,
+) (bool, error) {
+
+	resp, err := elbSvc.DescribeTargetHealth(
+		getDescribeTargetHealthInput(targetGroupARN, instanceIDs))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"response": resp,
+			"err":      err,
+		}).Error("DescribeTargetHealth failed")
+		return false, err
+	}
+
+	finished := true
+
+	for _, description := range resp.TargetHealthDescriptions {
+		if !isTargetInStates(description, states) {
+			finished = false
+		}
+	}
+
+	return finished, err
+}
+
+func isTargetInStates(
+	description *elbv2.TargetHealthDescription,
+	states []string) bool {
+	if description.TargetHealth == nil || description.TargetHealth.State == nil {
+		return false
+	}
+
+	for _, state := range states {
+		if *description.TargetHealth.State == state {
+			return true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"target": aws.StringValue(description.Target.Id),
+		"state":  *description.TargetHealth.State,
+	}).Debug("Target not in expected state")
+	return false
+}
+
+func getDescribeTargetHealthInput(
+	targetGroupARN *string,
+	instanceIDs []*string) *elbv2.DescribeTargetHealthInput {
+	targets := []*elbv2.TargetDescription{}
+
+	for _, instanceID := range instanceIDs {
+		targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
+	}
+
+	return &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: targetGroupARN,
+		Targets:        targets,
+	}
+}
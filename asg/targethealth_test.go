@@ -0,0 +1,237 @@
+package asg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockELBV2Client struct {
+	elbv2iface.ELBV2API
+	Error         string
+	TargetStates  []string
+	describeCount int
+}
+
+func (m *mockELBV2Client) DescribeTargetHealth(
+	input *elbv2.DescribeTargetHealthInput) (
+	*elbv2.DescribeTargetHealthOutput, error) {
+
+	state := elbv2.TargetHealthStateEnumHealthy
+	if len(m.TargetStates) > m.describeCount {
+		state = m.TargetStates[m.describeCount]
+	}
+	m.describeCount++
+
+	descriptions := []*elbv2.TargetHealthDescription{}
+	for _, target := range input.Targets {
+		descriptions = append(descriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: target.Id},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
+
+	var err error
+	if m.Error == "DescribeTargetHealth" {
+		err = errors.New("Error")
+	}
+
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: descriptions,
+	}, err
+}
+
+func TestGetDescribeTargetHealthInput(t *testing.T) {
+	instanceIDs := []*string{
+		aws.String("instanceIdOne"),
+		aws.String("instanceIdTwo"),
+	}
+
+	input := getDescribeTargetHealthInput(aws.String("arn"), instanceIDs)
+
+	assert.Equal(t, "arn", *input.TargetGroupArn)
+	assert.Equal(t, 2, len(input.Targets))
+	for index := range instanceIDs {
+		assert.Equal(t, *instanceIDs[index], *input.Targets[index].Id)
+	}
+}
+
+func TestCheckTargetHealthForStatesAllMatch(t *testing.T) {
+	mockELBSvc := &mockELBV2Client{
+		TargetStates: []string{elbv2.TargetHealthStateEnumDraining},
+	}
+
+	success, err := checkTargetHealthForStates(
+		mockELBSvc,
+		aws.String("arn"),
+		[]*string{aws.String("instance1")},
+		TargetStatesOutOfService)
+
+	assert.True(t, success)
+	assert.Nil(t, err)
+}
+
+func TestCheckTargetHealthForStatesNotMatching(t *testing.T) {
+	mockELBSvc := &mockELBV2Client{}
+
+	success, err := checkTargetHealthForStates(
+		mockELBSvc,
+		aws.String("arn"),
+		[]*string{aws.String("instance1")},
+		TargetStatesOutOfService)
+
+	assert.False(t, success)
+	assert.Nil(t, err)
+}
+
+func TestCheckTargetHealthForStatesError(t *testing.T) {
+	mockELBSvc := &mockELBV2Client{Error: "DescribeTargetHealth"}
+
+	success, err := checkTargetHealthForStates(
+		mockELBSvc,
+		aws.String("arn"),
+		[]*string{aws.String("instance1")},
+		TargetStatesInService)
+
+	assert.False(t, success)
+	assert.EqualError(t, err, "Error")
+}
+
+func TestIsTargetInStatesMissingHealth(t *testing.T) {
+	description := &elbv2.TargetHealthDescription{
+		Target: &elbv2.TargetDescription{Id: aws.String("instance1")},
+	}
+
+	assert.False(t, isTargetInStates(description, TargetStatesInService))
+}
+
+func TestWaitForTargetHealthNoTargetGroups(t *testing.T) {
+	mockELBSvc := &mockELBV2Client{Error: "DescribeTargetHealth"}
+
+	assert.Equal(t, 0, WaitForTargetHealth(
+		testClock(),
+		mockELBSvc,
+		[]*string{},
+		[]*string{aws.String("instance1")},
+		TargetStatesInService,
+		1*time.Millisecond,
+		5*time.Millisecond,
+		nil))
+}
+
+func TestWaitForTargetHealthEventuallyDraining(t *testing.T) {
+	mockELBSvc := &mockELBV2Client{
+		TargetStates: []string{
+			elbv2.TargetHealthStateEnumHealthy,
+			elbv2.TargetHealthStateEnumDraining,
+		},
+	}
+
+	assert.Equal(t, 0, WaitForTargetHealth(
+		testClock(),
+		mockELBSvc,
+		[]*string{aws.String("arn1")},
+		[]*string{aws.String("instance1")},
+		TargetStatesOutOfService,
+		1*time.Millisecond,
+		5*time.Millisecond,
+		nil))
+}
+
+func TestWaitForTargetHealthTimesOut(t *testing.T) {
+	states := []string{}
+	for i := 0; i < 20; i++ {
+		states = append(states, elbv2.TargetHealthStateEnumUnhealthy)
+	}
+	mockELBSvc := &mockELBV2Client{TargetStates: states}
+
+	assert.Equal(t, 2, WaitForTargetHealth(
+		testClock(),
+		mockELBSvc,
+		[]*string{aws.String("arn1"), aws.String("arn2")},
+		[]*string{aws.String("instance1")},
+		TargetStatesInService,
+		1*time.Millisecond,
+		5*time.Millisecond,
+		nil))
+}
+
+func TestHandleTargetHealthPollingErrorHandling(t *testing.T) {
+	pollIteration := 0
+	pollFunc := func(
+		elbv2iface.ELBV2API,
+		*string,
+		[]*string,
+		[]string) (bool, error) {
+		pollIteration++
+
+		return false, errors.New("Test Error")
+	}
+
+	arn := aws.String("arn")
+	failed := handleTargetHealthPolling(
+		testClock(),
+		&mockELBV2Client{},
+		[]*string{arn},
+		[]*string{aws.String("instance1")},
+		pollFunc,
+		1*time.Millisecond,
+		5*time.Millisecond,
+		TargetStatesInService,
+		nil)
+
+	assert.Equal(t, map[*string]bool{arn: true}, failed)
+	assert.Equal(t, 1, pollIteration)
+}
+
+func TestWaitForTargetHealthSharesTheTimeout(t *testing.T) {
+	states := []string{}
+	for i := 0; i < 20; i++ {
+		states = append(states, elbv2.TargetHealthStateEnumUnhealthy)
+	}
+	mockELBSvc := &mockELBV2Client{TargetStates: states}
+	c := testClock()
+
+	assert.Equal(t, 3, WaitForTargetHealth(
+		c,
+		mockELBSvc,
+		[]*string{aws.String("arn1"), aws.String("arn2"), aws.String("arn3")},
+		[]*string{aws.String("instance1")},
+		TargetStatesInService,
+		1*time.Minute,
+		5*time.Minute,
+		nil))
+	assert.Equal(t, 5*time.Minute, c.Elapsed())
+}
+
+func TestWaitForTargetHealthStopsPollingReadyGroups(t *testing.T) {
+	pollCounts := map[string]int{}
+	pollFunc := func(
+		_ elbv2iface.ELBV2API,
+		targetGroupARN *string,
+		_ []*string,
+		_ []string) (bool, error) {
+		pollCounts[*targetGroupARN]++
+
+		return *targetGroupARN == "ready" || pollCounts[*targetGroupARN] > 2, nil
+	}
+
+	failed := handleTargetHealthPolling(
+		testClock(),
+		&mockELBV2Client{},
+		[]*string{aws.String("ready"), aws.String("slow")},
+		[]*string{aws.String("instance1")},
+		pollFunc,
+		1*time.Minute,
+		5*time.Minute,
+		TargetStatesInService,
+		nil)
+
+	assert.Empty(t, failed)
+	assert.Equal(t, map[string]int{"ready": 1, "slow": 3}, pollCounts)
+}
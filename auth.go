@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// resolveSecret returns a secret such as the basic authentication password,
+// preferring a file, then an environment variable, over the plain text value
+// so it doesn't have to live in config.yaml.
+func resolveSecret(
+	value string,
+	file string,
+	env string) (string, error) {
+
+	if file != "" {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+
+	if env != "" {
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+
+		return val, nil
+	}
+
+	return value, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecretPlainText(t *testing.T) {
+	password, err := resolveSecret("PASSWORD", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "PASSWORD", password)
+}
+
+func TestResolveSecretFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "password")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("FROMFILE\n")
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	password, err := resolveSecret("PASSWORD", file.Name(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "FROMFILE", password)
+}
+
+func TestResolveSecretMissingFile(t *testing.T) {
+	_, err := resolveSecret("PASSWORD", "/does/not/exist", "")
+	assert.NotNil(t, err)
+}
+
+func TestResolveSecretEnv(t *testing.T) {
+	err := os.Setenv("AK_TEST_PASSWORD", "FROMENV")
+	assert.Nil(t, err)
+
+	password, err := resolveSecret("PASSWORD", "", "AK_TEST_PASSWORD")
+	assert.Nil(t, err)
+	assert.Equal(t, "FROMENV", password)
+
+	err = os.Unsetenv("AK_TEST_PASSWORD")
+	assert.Nil(t, err)
+}
+
+func TestResolveSecretMissingEnv(t *testing.T) {
+	_, err := resolveSecret("PASSWORD", "", "AK_TEST_PASSWORD_UNSET")
+	assert.EqualError(
+		t,
+		err,
+		"environment variable AK_TEST_PASSWORD_UNSET is not set")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+type awsOptions struct {
+	profile     string
+	region      string
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+// newAWSSession builds a session from the SDK's default credential chain
+// (environment, shared config and credentials files, container and instance
+// roles), optionally for a named profile, and assumes the configured role on
+// top of it.
+func newAWSSession(opts awsOptions) (*session.Session, error) {
+	config := aws.Config{}
+	if opts.region != "" {
+		config.Region = aws.String(opts.region)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           opts.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.roleARN == "" {
+		return sess, nil
+	}
+
+	log.WithFields(log.Fields{
+		"roleARN":     opts.roleARN,
+		"sessionName": opts.sessionName,
+	}).Info("Assuming role")
+
+	creds := stscreds.NewCredentials(
+		sess,
+		opts.roleARN,
+		func(p *stscreds.AssumeRoleProvider) {
+			if opts.externalID != "" {
+				p.ExternalID = aws.String(opts.externalID)
+			}
+			if opts.sessionName != "" {
+				p.RoleSessionName = opts.sessionName
+			}
+		})
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+func checkCallerIdentity(stsSvc stsiface.STSAPI) error {
+	log.Info("Checking AWS identity...")
+
+	resp, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.WithError(err).Error("GetCallerIdentity failed")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"account": aws.StringValue(resp.Account),
+		"arn":     aws.StringValue(resp.Arn),
+		"userID":  aws.StringValue(resp.UserId),
+	}).Info("The drill will be run as this AWS identity")
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSTSClient struct {
+	stsiface.STSAPI
+	Error string
+}
+
+func (m *mockSTSClient) GetCallerIdentity(
+	*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	if m.Error == "GetCallerIdentity" {
+		return nil, errors.New("Error")
+	}
+
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:iam::123456789012:user/drill"),
+		UserId:  aws.String("AIDAEXAMPLE"),
+	}, nil
+}
+
+func TestCheckCallerIdentity(t *testing.T) {
+	assert.Nil(t, checkCallerIdentity(&mockSTSClient{}))
+}
+
+func TestCheckCallerIdentityError(t *testing.T) {
+	err := checkCallerIdentity(&mockSTSClient{Error: "GetCallerIdentity"})
+	assert.EqualError(t, err, "Error")
+}
+
+func TestNewAWSSessionRegion(t *testing.T) {
+	sess, err := newAWSSession(awsOptions{region: "eu-west-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-west-1", *sess.Config.Region)
+}
+
+func TestNewAWSSessionAssumeRole(t *testing.T) {
+	base, err := newAWSSession(awsOptions{region: "eu-west-1"})
+	assert.Nil(t, err)
+
+	sess, err := newAWSSession(awsOptions{
+		region:      "eu-west-1",
+		roleARN:     "arn:aws:iam::123456789012:role/drill",
+		externalID:  "external",
+		sessionName: "session",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-west-1", *sess.Config.Region)
+	assert.NotNil(t, sess.Config.Credentials)
+	assert.True(t, base.Config.Credentials != sess.Config.Credentials)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const defaultCommand = "drill"
+
+type command struct {
+	name        string
+	description string
+	flags       func(*pflag.FlagSet)
+	run         func() int
+}
+
+var commands = []command{
+	{
+		name:        "drill",
+		description: "Run a failover drill against the autoscaling group",
+		flags: withFlags(contentFlags, pollFlags, authFlags, httpFlags, awsFlags, lockFlags, metricsFlags, tracingFlags, guardrailFlags, func(fs *pflag.FlagSet) {
+			fs.Bool(flagName("ignoreDrillTags"), false, "Start the drill even when the group is still tagged by an earlier one")
+		}),
+		run: runDrill,
+	},
+	{
+		name:        "plan",
+		description: "Show what a drill would do without changing anything",
+		flags:       withFlags(contentFlags, pollFlags, authFlags, httpFlags, awsFlags),
+		run:         runPlan,
+	},
+	{
+		name:        "check-content",
+		description: "Check the url once for the primary or secondary content",
+		flags: withFlags(contentFlags, authFlags, httpFlags, func(fs *pflag.FlagSet) {
+			fs.String(flagName("expect"), "primary", "The content to expect, either primary or secondary")
+		}),
+		run: runCheckContent,
+	},
+	{
+		name:        "status",
+		description: "Print the lifecycle state of the instances in the autoscaling group",
+		flags:       withFlags(awsFlags),
+		run:         runStatus,
+	},
+	{
+		name:        "recover",
+		description: "Take instances left in standby by a drill back into service",
+		flags:       withFlags(pollFlags, awsFlags, lockFlags),
+		run:         runRecover,
+	},
+	{
+		name:        "validate-config",
+		description: "Check the configuration without running anything",
+		flags:       withFlags(contentFlags, pollFlags, authFlags, httpFlags, awsFlags),
+		run:         runValidateConfig,
+	},
+	{
+		name:        "daemon",
+		description: "Keep running drills on a schedule",
+		flags: withFlags(contentFlags, pollFlags, authFlags, httpFlags, awsFlags, tracingFlags, guardrailFlags, func(fs *pflag.FlagSet) {
+			fs.String(flagName("daemon.schedule"), "", "A cron schedule for the drills, e.g. \"0 11 * * 2\"")
+			fs.String(flagName("daemon.timezone"), "Local", "The time zone for the schedule, windows and blackout dates")
+			fs.String(flagName("daemon.metrics"), "", "An address to serve the Prometheus metrics on at /metrics, e.g. :9102")
+		}),
+		run: runDaemon,
+	},
+	{
+		name:        "scenario",
+		description: "Run the steps of a drill scenario file",
+		flags: withFlags(pollFlags, authFlags, httpFlags, awsFlags, lockFlags, func(fs *pflag.FlagSet) {
+			fs.String(flagName("scenario"), "", "The scenario file to run")
+		}),
+		run: runScenario,
+	},
+}
+
+func runCLI(args []string) int {
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage(os.Stderr)
+		return 2
+	}
+
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	cmd.flags(fs)
+	logFlags(fs)
+	configFile := fs.String("config", "", "The config file to read, in YAML, JSON or TOML")
+	err := fs.Parse(args)
+	if err == pflag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	err = bindFlags(fs)
+	if err != nil {
+		log.WithError(err).Error("Could not bind the command line flags")
+		return 2
+	}
+
+	err = readConfig(*configFile)
+	if err != nil {
+		log.WithError(err).Error("Could not read the config file")
+		return 1
+	}
+
+	err = configureLogging(
+		viper.GetString("log.level"),
+		viper.GetString("log.format"))
+	if err != nil {
+		log.WithError(err).Error("Invalid logging configuration")
+		return 1
+	}
+
+	return cmd.run()
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(w, "\nThe default command is %s. Use \"[command] --help\" for its flags.\n", defaultCommand)
+}
+
+func withFlags(sets ...func(*pflag.FlagSet)) func(*pflag.FlagSet) {
+	return func(fs *pflag.FlagSet) {
+		for _, set := range sets {
+			set(fs)
+		}
+	}
+}
+
+// Flags are named after the config key they override, with the dots and
+// camel case replaced by dashes, e.g. --auth-password-file for
+// auth.passwordFile.
+var flagKeys = map[string]string{}
+
+func flagName(key string) string {
+	name := ""
+	for _, r := range key {
+		switch {
+		case r == '.':
+			name += "-"
+		case r >= 'A' && r <= 'Z':
+			name += "-" + strings.ToLower(string(r))
+		default:
+			name += string(r)
+		}
+	}
+
+	flagKeys[name] = key
+	return name
+}
+
+// bindFlags makes the flags override the matching config keys, but only when
+// they are given on the command line.
+func bindFlags(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		key, ok := flagKeys[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		err = viper.BindPFlag(key, f)
+	})
+
+	return err
+}
+
+func contentFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("url"), "", "The URL to content check")
+	fs.String(flagName("primary"), "", "The content to search for in the original, working website")
+	fs.String(flagName("secondary"), "", "The content to search for in the failover site")
+}
+
+func pollFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("poll"), "10s", "The time between polling for content and ASG status checks, in seconds or as a duration like 10s")
+	fs.String(flagName("timeout"), "10m", "The timeout for the content and ASG status checks, in seconds or as a duration like 10m")
+}
+
+// There are deliberately no flags for the password or token so they don't
+// end up in the process list or shell history.
+func authFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("auth.mode"), "", "One of none, basic or bearer, picked from the credentials given if not set")
+	fs.String(flagName("auth.user"), "", "The user name for any basic authentication")
+	fs.String(flagName("auth.passwordFile"), "", "Read the basic authentication password from this file")
+	fs.String(flagName("auth.passwordEnv"), "", "Read the basic authentication password from this environment variable")
+	fs.String(flagName("auth.tokenFile"), "", "Read the bearer token from this file")
+	fs.String(flagName("auth.tokenEnv"), "", "Read the bearer token from this environment variable")
+	fs.Bool(flagName("auth.insecure"), false, "Ignore certificate errors")
+}
+
+func httpFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("http.timeout"), "", "The timeout for each content check request, defaults to poll")
+	fs.String(flagName("http.host"), "", "Override the Host header")
+	fs.String(flagName("http.cacheBust"), "", "Add this query parameter with a random value to every request")
+	fs.String(flagName("http.proxy"), "", "An HTTP proxy to send the content checks through")
+	fs.Bool(flagName("http.fresh"), false, "Use a new connection and send no-cache headers for every request")
+}
+
+func awsFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("asg"), "", "The name of the autoscaling group")
+	fs.String(flagName("aws.profile"), "", "The shared config profile to use")
+	fs.String(flagName("aws.region"), "", "The AWS region")
+	fs.String(flagName("aws.role.arn"), "", "A role to assume for the drill")
+}
+
+func metricsFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("metrics.pushgateway"), "", "A Prometheus Pushgateway to push the metrics to after the drill")
+}
+
+func guardrailFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("guardrails.killSwitch.file"), "", "Abort the drill when this file reads stop")
+	fs.String(flagName("guardrails.killSwitch.url"), "", "Abort the drill when this URL reads stop")
+}
+
+func tracingFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("tracing.exporter"), tracingExporterNone, "Where to send the drill's traces, one of none, otlp or file")
+	fs.String(flagName("tracing.endpoint"), "", "The OTLP/HTTP endpoint of an OpenTelemetry collector, e.g. http://localhost:4318")
+	fs.String(flagName("tracing.file"), "", "The file to append the traces to as OTLP JSON")
+}
+
+func lockFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("lock.backend"), lockBackendASGTag, "Where to lock the autoscaling group, one of asg-tag, file or none")
+	fs.Bool(flagName("forceUnlock"), false, "Remove any existing lock first, e.g. one left by a crashed run")
+}
+
+func logFlags(fs *pflag.FlagSet) {
+	fs.String(flagName("log.level"), "info", "One of debug, info, warning, error, fatal or panic")
+	fs.String(flagName("log.format"), "text", "Either text or json")
+}
+
+func runDrill() int {
+	cfg, err := loadConfig(requireASG | requireContent)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	exitCode := drillGroup(cfg)
+
+	if cfg.pushgateway != "" {
+		err = drillMetrics.push(cfg.pushgateway, "anarchy-kitten", cfg.asg)
+		if err != nil {
+			log.WithError(err).Warn("Could not push the metrics")
+		}
+	}
+
+	return exitCode
+}
+
+func drillGroup(cfg config) int {
+	sess, err := newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Error("Could not create the AWS session")
+		return 1
+	}
+
+	svc := autoscaling.New(sess)
+	countASGCalls(svc.Client)
+
+	drillTracer = newTracer(cfg.tracing, clock.Real{})
+	spans := newDrillSpans()
+	traceASGCalls(svc.Client, spans.parent)
+	defer flushTraces()
+
+	lock, err := newDrillLock(cfg.lock.backend, svc, cfg.asg, cfg.lock.dir)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	cwSvc := cloudwatch.New(sess)
+	run := newDrillRun()
+	return withLock(lock, run, cfg.lock.ttl, viper.GetBool("forceUnlock"), func(renew func()) int {
+		return do(
+			awsClients{
+				asg:        svc,
+				elb:        elbv2.New(sess),
+				ec2:        ec2.New(sess),
+				cloudWatch: cwSvc,
+				sts:        sts.New(sess),
+			},
+			drillOptions{
+				run:            run,
+				asg:            cfg.asg,
+				url:            cfg.url,
+				primary:        cfg.primary,
+				secondary:      cfg.secondary,
+				scripts:        cfg.scripts,
+				auth:           cfg.auth,
+				phases:         cfg.phases,
+				holdCloudWatch: cfg.holdCloudWatch,
+				drift:          cfg.drift,
+				notify:         cfg.notify,
+				hooks:          cfg.hooks,
+				guards:         newGuardrails(cwSvc, cfg.guardrails, cfg.auth),
+				spans:          spans,
+				renewLock:      renew,
+
+				ignoreDrillTags: viper.GetBool("ignoreDrillTags"),
+			})
+	})
+}
+
+func runPlan() int {
+	cfg, err := loadConfig(requireASG | requireContent)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	sess, err := newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Fatal("Could not create the AWS session")
+	}
+
+	return plan(
+		os.Stdout,
+		autoscaling.New(sess),
+		sts.New(sess),
+		cfg.asg,
+		cfg.primary,
+		cfg.secondary,
+		cfg.scripts,
+		cfg.url,
+		cfg.auth,
+		cfg.phases,
+		cfg.holdCloudWatch)
+}
+
+func runCheckContent() int {
+	expect := viper.GetString("expect")
+	if expect != "primary" && expect != "secondary" {
+		log.WithField("expect", expect).Error("--expect must be primary or secondary")
+		return 2
+	}
+
+	cfg, err := loadConfig(requireContent)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	content, script := cfg.primary, cfg.scripts.primary
+	if expect == "secondary" {
+		content, script = cfg.secondary, cfg.scripts.secondary
+	}
+
+	return checkExpectation(content, script, cfg.url, cfg.auth)
+}
+
+func runStatus() int {
+	cfg, err := loadConfig(requireASG)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	sess, err := newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Fatal("Could not create the AWS session")
+	}
+
+	return status(os.Stdout, autoscaling.New(sess), cfg.asg)
+}
+
+// runRecover recovers the group given, or without one every group still
+// tagged by a drill
+func runRecover() int {
+	cfg, err := loadConfig(0)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	sess, err := newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Fatal("Could not create the AWS session")
+	}
+
+	svc := autoscaling.New(sess)
+	groups := []string{cfg.asg}
+	if cfg.asg == "" {
+		groups, err = findDrilledGroups(svc)
+		if err != nil {
+			log.WithError(err).Error("Could not find the groups left by a drill")
+			return 1
+		}
+		if len(groups) == 0 {
+			log.Info("No groups are tagged by a drill")
+			return 0
+		}
+		log.WithField("groups", groups).Info("Found groups left by a drill")
+	}
+
+	run := newDrillRun()
+	exitCode := 0
+
+	for _, group := range groups {
+		lock, err := newDrillLock(cfg.lock.backend, svc, group, cfg.lock.dir)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+
+		exitCode += withLock(lock, run, cfg.lock.ttl, viper.GetBool("forceUnlock"), func(func()) int {
+			return recoverGroup(clock.Real{}, svc, elbv2.New(sess), ec2.New(sess), group, cfg.phases)
+		})
+	}
+
+	return exitCode
+}
+
+func runValidateConfig() int {
+	cfg, err := loadConfig(requireASG | requireContent)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	_, err = newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Error("Could not create the AWS session")
+		return 1
+	}
+
+	log.Info("Config OK")
+	return 0
+}
+
+func runScenario() int {
+	cfg, err := loadConfig(0)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	s, err := readScenario(viper.GetString("scenario"))
+	if err != nil {
+		log.WithError(err).Error("Could not read the scenario")
+		return 1
+	}
+
+	sess, err := newAWSSession(cfg.aws)
+	if err != nil {
+		log.WithError(err).Fatal("Could not create the AWS session")
+	}
+
+	err = checkCallerIdentity(sts.New(sess))
+	if err != nil {
+		return 1
+	}
+
+	// The lock backend has already been validated with the config
+	svc := autoscaling.New(sess)
+	runner := &scenarioRunner{
+		svc:        svc,
+		elbSvc:     elbv2.New(sess),
+		ec2Svc:     ec2.New(sess),
+		route53Svc: route53.New(sess),
+		drillRun:   newDrillRun(),
+		auth:       cfg.auth,
+		defaults:   drill.Phase{Poll: cfg.poll, Timeout: cfg.timeout},
+		clock:      clock.Real{},
+		lock: func(group string) drillLock {
+			lock, _ := newDrillLock(cfg.lock.backend, svc, group, cfg.lock.dir)
+			return lock
+		},
+		lockTTL:     cfg.lock.ttl,
+		forceUnlock: viper.GetBool("forceUnlock"),
+	}
+
+	return runner.run(s)
+}
+
+func runDaemon() int {
+	cfg, err := loadConfig(requireASG | requireContent)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	d, err := loadDaemon()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	d.drill = func() int { return drillGroup(cfg) }
+	d.lockTTL = cfg.lock.ttl
+	if d.lockTTL == 0 {
+		d.lockTTL = 2 * cfg.phases.Budget()
+	}
+
+	return d.serve()
+}
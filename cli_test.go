@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagName(t *testing.T) {
+	assert.Equal(t, "url", flagName("url"))
+	assert.Equal(t, "auth-password-file", flagName("auth.passwordFile"))
+	assert.Equal(t, "aws-role-arn", flagName("aws.role.arn"))
+	assert.Equal(t, "auth.passwordFile", flagKeys["auth-password-file"])
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, name := range []string{
+		"drill",
+		"plan",
+		"check-content",
+		"status",
+		"recover",
+		"validate-config",
+	} {
+		cmd, ok := findCommand(name)
+		assert.True(t, ok)
+		assert.Equal(t, name, cmd.name)
+	}
+
+	_, ok := findCommand("destroy")
+	assert.False(t, ok)
+}
+
+func TestRunCLIUnknownCommand(t *testing.T) {
+	assert.Equal(t, 2, runCLI([]string{"destroy"}))
+}
+
+func TestRunCLIBadFlag(t *testing.T) {
+	assert.Equal(t, 2, runCLI([]string{"status", "--url", "https://www.mywebsite.com"}))
+}
+
+func TestRunCLIHelp(t *testing.T) {
+	assert.Equal(t, 0, runCLI([]string{"help"}))
+}
+
+func TestUsage(t *testing.T) {
+	var buf bytes.Buffer
+	usage(&buf)
+
+	for _, cmd := range commands {
+		assert.Contains(t, buf.String(), cmd.name)
+	}
+}
+
+func TestBindFlags(t *testing.T) {
+	defer viper.Reset()
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	withFlags(contentFlags, pollFlags, authFlags)(fs)
+	err := fs.Parse([]string{
+		"--url", "https://www.mywebsite.com",
+		"--poll", "5",
+		"--auth-password-file", "/run/secrets/password",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, bindFlags(fs))
+
+	viper.SetDefault("timeout", 600)
+	viper.Set("primary", "My Working Site")
+
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, 5, viper.GetInt("poll"))
+	assert.Equal(t, "/run/secrets/password", viper.GetString("auth.passwordFile"))
+	assert.Equal(t, 600, viper.GetInt("timeout"))
+	assert.Equal(t, "My Working Site", viper.GetString("primary"))
+}
@@ -0,0 +1,97 @@
+// Package clock is the time as the drill's pollers see it. The drill is
+// given a Clock, tests give it a fake one so timeouts can be checked without
+// waiting for them.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock
+type Real struct{}
+
+func (Real) Now() time.Time                         { return time.Now() }
+func (Real) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SleepUnlessAborted waits on the clock for the poll interval, returning
+// false straight away if abort is closed first. A nil abort never closes.
+func SleepUnlessAborted(c Clock, poll time.Duration, abort <-chan struct{}) bool {
+	// An abort wins over a clock that has already moved on
+	select {
+	case <-abort:
+		return false
+	default:
+	}
+
+	select {
+	case <-c.After(poll):
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// Attempts is how many checks fit in the timeout when they are poll apart
+// and the first is made straight away. A timeout that isn't a multiple of the
+// poll still gets a check in its last partial interval, and without a poll
+// there is only time for the one check.
+func Attempts(timeout time.Duration, poll time.Duration) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+
+	if poll <= 0 {
+		return 1
+	}
+
+	return int64((timeout + poll - 1) / poll)
+}
+
+// Fake only moves when something sleeps or waits on it, and then moves
+// straight to the end of the wait
+type Fake struct {
+	mu    sync.Mutex
+	start time.Time
+	now   time.Time
+}
+
+// NewFake starts a fake clock at start
+func NewFake(start time.Time) *Fake {
+	return &Fake{start: start, now: start}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Fake) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+// Elapsed is how far the clock has moved on since it started
+func (c *Fake) Elapsed() time.Duration {
+	return c.Now().Sub(c.start)
+}
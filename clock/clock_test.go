@@ -0,0 +1,46 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttempts(t *testing.T) {
+	for _, c := range []struct {
+		timeout  time.Duration
+		poll     time.Duration
+		attempts int64
+	}{
+		{5 * time.Second, time.Second, 5},
+		{10 * time.Second, 3 * time.Second, 4},
+		{time.Second, time.Minute, 1},
+		{time.Minute, 0, 1},
+		{0, time.Second, 0},
+		{-time.Second, time.Second, 0},
+	} {
+		assert.Equal(t, c.attempts, Attempts(c.timeout, c.poll), "%s every %s", c.timeout, c.poll)
+	}
+}
+
+func TestFake(t *testing.T) {
+	c := NewFake(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC))
+
+	start := c.Now()
+	c.Sleep(time.Minute)
+	assert.True(t, SleepUnlessAborted(c, time.Hour, nil))
+
+	assert.Equal(t, 61*time.Minute, c.Now().Sub(start))
+	assert.Equal(t, 61*time.Minute, c.Elapsed())
+}
+
+func TestSleepUnlessAborted(t *testing.T) {
+	c := NewFake(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC))
+
+	abort := make(chan struct{})
+	close(abort)
+
+	assert.False(t, SleepUnlessAborted(c, time.Hour, abort))
+	assert.Equal(t, time.Duration(0), c.Elapsed())
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	log "github.com/sirupsen/logrus"
+)
+
+// CloudWatch only keeps one minute datapoints for most metrics
+const minMetricPeriod = time.Minute
+
+// metricLookback is how many periods back a metric is read. Datapoints
+// usually land a period or two late, so the newest period is often empty.
+const metricLookback = 3
+
+// cloudWatchChecks are read during the hold to check the secondary stack is
+// healthy, not just serving the secondary content
+type cloudWatchChecks struct {
+	// The alarms to watch, by name and by name prefix
+	alarms      []string
+	alarmPrefix string
+
+	// Alarms that are allowed to fire during the drill, e.g. ones for the
+	// primary stack that are expected to go off
+	allowed []string
+
+	metrics []metricThreshold
+}
+
+// metricThreshold fails the drill when the latest value of a metric goes over
+// its maximum, e.g. the secondary load balancer's 5xx count or latency
+type metricThreshold struct {
+	namespace  string
+	name       string
+	dimensions map[string]string
+	// A statistic such as Sum or Average, or a percentile such as p99
+	statistic string
+	period    time.Duration
+	max       float64
+}
+
+func (c cloudWatchChecks) enabled() bool {
+	return len(c.alarms) > 0 || c.alarmPrefix != "" || len(c.metrics) > 0
+}
+
+// checkCloudWatch returns an error describing every watched alarm firing
+// that isn't allowed and every metric over its threshold at now. When the
+// only problems are CloudWatch calls failing, or a metric without recent
+// datapoints, the error is a contentcheck.Unknown, so a throttled call
+// counts against the hold's budget rather than failing the drill.
+func checkCloudWatch(cwSvc cloudwatchiface.CloudWatchAPI, checks cloudWatchChecks, now time.Time) error {
+	if !checks.enabled() {
+		return nil
+	}
+
+	problems := []string{}
+	unknown := []string{}
+
+	firing, err := getFiringAlarms(cwSvc, checks)
+	if err != nil {
+		unknown = append(unknown, fmt.Sprintf("could not describe the alarms: %s", err))
+	}
+	for _, alarm := range firing {
+		if !isAllowedAlarm(alarm, checks.allowed) {
+			problems = append(problems, fmt.Sprintf("alarm %s is firing", alarm))
+		}
+	}
+
+	for _, m := range checks.metrics {
+		value, found, err := getLatestMetricValue(cwSvc, m, now)
+		if err != nil {
+			unknown = append(unknown, fmt.Sprintf("could not get %s: %s", m, err))
+			continue
+		}
+		if !found {
+			unknown = append(unknown, fmt.Sprintf("no datapoints for %s", m))
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"metric": m.String(),
+			"value":  value,
+			"max":    m.max,
+		}).Debug("Checked the metric")
+
+		if value > m.max {
+			problems = append(problems, fmt.Sprintf("%s is %v, over the maximum of %v", m, value, m.max))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(append(problems, unknown...), ", "))
+	}
+	if len(unknown) > 0 {
+		return contentcheck.Unknown{Err: fmt.Errorf("%s", strings.Join(unknown, ", "))}
+	}
+
+	return nil
+}
+
+// checkAlarmsExist makes sure each of the named alarms is a metric alarm
+// CloudWatch knows about. Only metric alarms are described, so a composite
+// alarm, or a typo, would otherwise never be seen firing.
+func checkAlarmsExist(cwSvc cloudwatchiface.CloudWatchAPI, alarms []string) error {
+	found := map[string]bool{}
+
+	// DescribeAlarms takes up to 100 names at a time
+	for start := 0; start < len(alarms); start += 100 {
+		end := start + 100
+		if end > len(alarms) {
+			end = len(alarms)
+		}
+
+		input := &cloudwatch.DescribeAlarmsInput{AlarmNames: aws.StringSlice(alarms[start:end])}
+		for {
+			resp, err := cwSvc.DescribeAlarms(input)
+			if err != nil {
+				return err
+			}
+
+			for _, alarm := range resp.MetricAlarms {
+				found[aws.StringValue(alarm.AlarmName)] = true
+			}
+
+			if aws.StringValue(resp.NextToken) == "" {
+				break
+			}
+			input.NextToken = resp.NextToken
+		}
+	}
+
+	missing := []string{}
+	for _, alarm := range alarms {
+		if !found[alarm] {
+			missing = append(missing, alarm)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the alarms %s are not metric alarms, composite alarms can't be watched", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// getFiringAlarms lists the watched alarms that are in the ALARM state
+func getFiringAlarms(cwSvc cloudwatchiface.CloudWatchAPI, checks cloudWatchChecks) ([]string, error) {
+	inputs := []*cloudwatch.DescribeAlarmsInput{}
+
+	// DescribeAlarms takes up to 100 names at a time
+	for start := 0; start < len(checks.alarms); start += 100 {
+		end := start + 100
+		if end > len(checks.alarms) {
+			end = len(checks.alarms)
+		}
+		inputs = append(inputs, &cloudwatch.DescribeAlarmsInput{
+			AlarmNames: aws.StringSlice(checks.alarms[start:end]),
+			StateValue: aws.String(cloudwatch.StateValueAlarm),
+		})
+	}
+
+	if checks.alarmPrefix != "" {
+		inputs = append(inputs, &cloudwatch.DescribeAlarmsInput{
+			AlarmNamePrefix: aws.String(checks.alarmPrefix),
+			StateValue:      aws.String(cloudwatch.StateValueAlarm),
+		})
+	}
+
+	firing := map[string]bool{}
+	for _, input := range inputs {
+		for {
+			resp, err := cwSvc.DescribeAlarms(input)
+			if err != nil {
+				log.WithError(err).Error("DescribeAlarms failed")
+				return nil, err
+			}
+
+			for _, alarm := range resp.MetricAlarms {
+				firing[aws.StringValue(alarm.AlarmName)] = true
+			}
+
+			if aws.StringValue(resp.NextToken) == "" {
+				break
+			}
+			input.NextToken = resp.NextToken
+		}
+	}
+
+	names := []string{}
+	for name := range firing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func isAllowedAlarm(alarm string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == alarm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getLatestMetricValue gets the metric's statistic for the newest period
+// with a datapoint in the last metricLookback periods, reporting whether
+// there were any
+func getLatestMetricValue(
+	cwSvc cloudwatchiface.CloudWatchAPI,
+	m metricThreshold,
+	now time.Time) (float64, bool, error) {
+	resp, err := cwSvc.GetMetricStatistics(getMetricStatisticsInput(m, now))
+	if err != nil {
+		log.WithError(err).WithField("metric", m.String()).Error("GetMetricStatistics failed")
+		return 0, false, err
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, d := range resp.Datapoints {
+		if latest == nil || aws.TimeValue(d.Timestamp).After(aws.TimeValue(latest.Timestamp)) {
+			latest = d
+		}
+	}
+
+	if latest == nil {
+		return 0, false, nil
+	}
+
+	if isPercentile(m.statistic) {
+		return aws.Float64Value(latest.ExtendedStatistics[m.statistic]), true, nil
+	}
+
+	switch m.statistic {
+	case cloudwatch.StatisticAverage:
+		return aws.Float64Value(latest.Average), true, nil
+	case cloudwatch.StatisticMaximum:
+		return aws.Float64Value(latest.Maximum), true, nil
+	case cloudwatch.StatisticMinimum:
+		return aws.Float64Value(latest.Minimum), true, nil
+	case cloudwatch.StatisticSampleCount:
+		return aws.Float64Value(latest.SampleCount), true, nil
+	default:
+		return aws.Float64Value(latest.Sum), true, nil
+	}
+}
+
+func getMetricStatisticsInput(m metricThreshold, now time.Time) *cloudwatch.GetMetricStatisticsInput {
+	period := m.period
+	if period < minMetricPeriod {
+		period = minMetricPeriod
+	}
+
+	input := &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String(m.namespace),
+		MetricName: aws.String(m.name),
+		StartTime:  aws.Time(now.Add(-metricLookback * period)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(int64(period / time.Second)),
+	}
+
+	names := []string{}
+	for name := range m.dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		input.Dimensions = append(input.Dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(m.dimensions[name]),
+		})
+	}
+
+	if isPercentile(m.statistic) {
+		input.ExtendedStatistics = aws.StringSlice([]string{m.statistic})
+	} else {
+		input.Statistics = aws.StringSlice([]string{m.statistic})
+	}
+
+	return input
+}
+
+// percentile is an extended statistic such as p99 or p99.9
+var percentile = regexp.MustCompile(`^p\d+(\.\d+)?$`)
+
+func isPercentile(statistic string) bool {
+	return percentile.MatchString(statistic)
+}
+
+func (m metricThreshold) String() string {
+	return fmt.Sprintf("%s %s %s", m.namespace, m.name, m.statistic)
+}
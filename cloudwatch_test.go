@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockCloudWatchClient struct {
+	cloudwatchiface.CloudWatchAPI
+	Error string
+
+	// The alarms in the ALARM state, each page returned in turn
+	FiringAlarms [][]string
+	Datapoints   []*cloudwatch.Datapoint
+
+	// The metric alarms there are, whatever their state
+	Alarms []string
+
+	describeInputs []cloudwatch.DescribeAlarmsInput
+	metricInputs   []*cloudwatch.GetMetricStatisticsInput
+}
+
+func (m *mockCloudWatchClient) DescribeAlarms(
+	input *cloudwatch.DescribeAlarmsInput) (
+	*cloudwatch.DescribeAlarmsOutput, error) {
+	m.describeInputs = append(m.describeInputs, *input)
+	if m.Error == "DescribeAlarms" {
+		return nil, errors.New("Error")
+	}
+
+	page := 0
+	if input.NextToken != nil {
+		page = int(aws.StringValue(input.NextToken)[0] - '0')
+	}
+
+	output := &cloudwatch.DescribeAlarmsOutput{}
+	if input.StateValue == nil {
+		for _, name := range aws.StringValueSlice(input.AlarmNames) {
+			for _, alarm := range m.Alarms {
+				if alarm == name {
+					output.MetricAlarms = append(output.MetricAlarms, &cloudwatch.MetricAlarm{AlarmName: aws.String(name)})
+				}
+			}
+		}
+		return output, nil
+	}
+
+	if page < len(m.FiringAlarms) {
+		for _, name := range m.FiringAlarms[page] {
+			output.MetricAlarms = append(output.MetricAlarms, &cloudwatch.MetricAlarm{
+				AlarmName:  aws.String(name),
+				StateValue: aws.String(cloudwatch.StateValueAlarm),
+			})
+		}
+	}
+	if page+1 < len(m.FiringAlarms) {
+		output.NextToken = aws.String(string(rune('0' + page + 1)))
+	}
+
+	return output, nil
+}
+
+func (m *mockCloudWatchClient) GetMetricStatistics(
+	input *cloudwatch.GetMetricStatisticsInput) (
+	*cloudwatch.GetMetricStatisticsOutput, error) {
+	m.metricInputs = append(m.metricInputs, input)
+	if m.Error == "GetMetricStatistics" {
+		return nil, errors.New("Error")
+	}
+
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: m.Datapoints}, nil
+}
+
+var testThreshold = metricThreshold{
+	namespace:  "AWS/ApplicationELB",
+	name:       "HTTPCode_Target_5XX_Count",
+	dimensions: map[string]string{"LoadBalancer": "app/secondary/1"},
+	statistic:  cloudwatch.StatisticSum,
+	period:     time.Minute,
+	max:        10,
+}
+
+func TestCheckCloudWatchNothingToCheck(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{Error: "DescribeAlarms"}
+
+	assert.Nil(t, checkCloudWatch(mockSvc, cloudWatchChecks{}, testStart))
+	assert.Empty(t, mockSvc.describeInputs)
+}
+
+func TestCheckCloudWatchAlarms(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{FiringAlarms: [][]string{
+		{"primary-unhealthy-hosts"},
+		{"secondary-5xx"},
+	}}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{
+		alarms:      []string{"secondary-5xx"},
+		alarmPrefix: "secondary-",
+		allowed:     []string{"primary-unhealthy-hosts"},
+	}, testStart)
+	assert.EqualError(t, err, "alarm secondary-5xx is firing")
+
+	assert.Equal(t, []string{"secondary-5xx"}, aws.StringValueSlice(mockSvc.describeInputs[0].AlarmNames))
+	assert.Equal(t, "secondary-", aws.StringValue(mockSvc.describeInputs[2].AlarmNamePrefix))
+	for _, input := range mockSvc.describeInputs {
+		assert.Equal(t, cloudwatch.StateValueAlarm, aws.StringValue(input.StateValue))
+	}
+}
+
+func TestCheckCloudWatchAllowedAlarms(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{FiringAlarms: [][]string{{"primary-unhealthy-hosts"}}}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{
+		alarmPrefix: "primary-",
+		allowed:     []string{"primary-unhealthy-hosts"},
+	}, testStart)
+	assert.Nil(t, err)
+}
+
+func TestCheckCloudWatchAlarmsError(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{Error: "DescribeAlarms"}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{alarms: []string{"secondary-5xx"}}, testStart)
+	assert.EqualError(t, err, "could not describe the alarms: Error")
+
+	// Not being able to tell counts against the hold's budget
+	assert.IsType(t, contentcheck.Unknown{}, err)
+}
+
+func TestCheckCloudWatchFiringAndError(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{
+		Error:        "GetMetricStatistics",
+		FiringAlarms: [][]string{{"secondary-5xx"}},
+	}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{
+		alarms:  []string{"secondary-5xx"},
+		metrics: []metricThreshold{testThreshold},
+	}, testStart)
+	assert.EqualError(t, err, "alarm secondary-5xx is firing, could not get AWS/ApplicationELB HTTPCode_Target_5XX_Count Sum: Error")
+	assert.IsType(t, errors.New(""), err)
+}
+
+func TestCheckAlarmsExist(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{Alarms: []string{"secondary-5xx"}}
+
+	assert.Nil(t, checkAlarmsExist(mockSvc, []string{"secondary-5xx"}))
+	assert.EqualError(t,
+		checkAlarmsExist(mockSvc, []string{"secondary-5xx", "secondary-health", "typo"}),
+		"the alarms secondary-health, typo are not metric alarms, composite alarms can't be watched")
+	assert.Nil(t, mockSvc.describeInputs[0].StateValue)
+
+	mockSvc.Error = "DescribeAlarms"
+	assert.EqualError(t, checkAlarmsExist(mockSvc, []string{"secondary-5xx"}), "Error")
+}
+
+func TestCheckCloudWatchMetricOverThreshold(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{Datapoints: []*cloudwatch.Datapoint{
+		{Timestamp: aws.Time(testStart.Add(-2 * time.Minute)), Sum: aws.Float64(2)},
+		{Timestamp: aws.Time(testStart.Add(-time.Minute)), Sum: aws.Float64(25)},
+	}}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{metrics: []metricThreshold{testThreshold}}, testStart)
+	assert.EqualError(t, err, "AWS/ApplicationELB HTTPCode_Target_5XX_Count Sum is 25, over the maximum of 10")
+}
+
+func TestCheckCloudWatchMetricUnderThreshold(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{Datapoints: []*cloudwatch.Datapoint{
+		{Timestamp: aws.Time(testStart), Sum: aws.Float64(3)},
+	}}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{metrics: []metricThreshold{testThreshold}}, testStart)
+	assert.Nil(t, err)
+}
+
+func TestCheckCloudWatchMetricNoDatapoints(t *testing.T) {
+	mockSvc := &mockCloudWatchClient{}
+
+	err := checkCloudWatch(mockSvc, cloudWatchChecks{metrics: []metricThreshold{testThreshold}}, testStart)
+	assert.IsType(t, contentcheck.Unknown{}, err)
+	assert.EqualError(t, err, "no datapoints for AWS/ApplicationELB HTTPCode_Target_5XX_Count Sum")
+}
+
+func TestGetMetricStatisticsInput(t *testing.T) {
+	input := getMetricStatisticsInput(testThreshold, testStart)
+	assert.Equal(t, "AWS/ApplicationELB", aws.StringValue(input.Namespace))
+	assert.Equal(t, "HTTPCode_Target_5XX_Count", aws.StringValue(input.MetricName))
+	assert.Equal(t, int64(60), aws.Int64Value(input.Period))
+	assert.Equal(t, testStart.Add(-3*time.Minute), aws.TimeValue(input.StartTime))
+	assert.Equal(t, testStart, aws.TimeValue(input.EndTime))
+	assert.Equal(t, "LoadBalancer", aws.StringValue(input.Dimensions[0].Name))
+	assert.Equal(t, []string{"Sum"}, aws.StringValueSlice(input.Statistics))
+
+	latency := testThreshold
+	latency.statistic = "p99"
+	latency.period = 0
+	input = getMetricStatisticsInput(latency, testStart)
+	assert.Equal(t, int64(60), aws.Int64Value(input.Period))
+	assert.Nil(t, input.Statistics)
+	assert.Equal(t, []string{"p99"}, aws.StringValueSlice(input.ExtendedStatistics))
+}
+
+func TestGetLatestMetricValuePercentile(t *testing.T) {
+	latency := testThreshold
+	latency.statistic = "p99"
+	mockSvc := &mockCloudWatchClient{Datapoints: []*cloudwatch.Datapoint{
+		{Timestamp: aws.Time(testStart), ExtendedStatistics: map[string]*float64{"p99": aws.Float64(0.8)}},
+	}}
+
+	value, found, err := getLatestMetricValue(mockSvc, latency, testStart)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 0.8, value)
+}
+
+func TestIsPercentile(t *testing.T) {
+	for _, statistic := range []string{"p99", "p50", "p99.9", "p100"} {
+		assert.True(t, isPercentile(statistic), statistic)
+	}
+	for _, statistic := range []string{"p", "pct", "p99.", "p.9", "P99", "Sum"} {
+		assert.False(t, isPercentile(statistic), statistic)
+	}
+}
+
+func TestDoHoldChecksCloudWatch(t *testing.T) {
+	// The failover waits a poll for the secondary content, which then stays
+	// up but its alarm is firing
+	served := []string{"primary", "secondary", "secondary", "primary"}
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(served[count]))
+		count++
+	}))
+	defer ts.Close()
+
+	phases := testPhases(1*time.Millisecond, 3*time.Millisecond)
+	phases.Hold = drill.Hold{Duration: 3 * time.Millisecond, Poll: 1 * time.Millisecond}
+
+	mockCWSvc := &mockCloudWatchClient{
+		Alarms:       []string{"secondary-5xx"},
+		FiringAlarms: [][]string{{"secondary-5xx"}},
+	}
+	clients := testClients(&mockAutoScalingClient{Success: true})
+	clients.cloudWatch = mockCWSvc
+	opts := testDrill(ts.URL)
+	opts.phases = phases
+	opts.holdCloudWatch = cloudWatchChecks{
+		alarms:  []string{"secondary-5xx"},
+		metrics: []metricThreshold{testThreshold},
+	}
+	exitCode := do(clients, opts)
+	assert.Equal(t, 1, exitCode)
+
+	// The alarms are looked up before the drill, then checked on the
+	// hold's first poll which fails it
+	assert.Len(t, mockCWSvc.describeInputs, 2)
+	assert.Nil(t, mockCWSvc.describeInputs[0].StateValue)
+	if assert.Len(t, mockCWSvc.metricInputs, 1) {
+		assert.Equal(t, testStart.Add(time.Millisecond), aws.TimeValue(mockCWSvc.metricInputs[0].EndTime))
+	}
+}
+
+func TestDoHoldCountsCloudWatchErrors(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 || count >= 5 {
+			w.Write([]byte("primary"))
+		} else {
+			w.Write([]byte("secondary"))
+		}
+		count++
+	}))
+	defer ts.Close()
+
+	phases := testPhases(1*time.Millisecond, 3*time.Millisecond)
+	phases.Hold = drill.Hold{Duration: 3 * time.Millisecond, Poll: 1 * time.Millisecond}
+
+	mockCWSvc := &mockCloudWatchClient{Error: "GetMetricStatistics"}
+	clients := testClients(&mockAutoScalingClient{Success: true})
+	clients.cloudWatch = mockCWSvc
+	opts := testDrill(ts.URL)
+	opts.holdCloudWatch = cloudWatchChecks{metrics: []metricThreshold{testThreshold}}
+
+	// Every poll of the hold counts against a budget that has room for them
+	phases.Hold.Budget = 3
+	opts.phases = phases
+	assert.Equal(t, 0, do(clients, opts))
+	assert.Len(t, mockCWSvc.metricInputs, 3)
+
+	// Without the room the hold fails once it is spent
+	count = 0
+	mockCWSvc.metricInputs = nil
+	phases.Hold.Budget = 1
+	opts.phases = phases
+	assert.Equal(t, 1, do(clients, opts))
+	assert.Len(t, mockCWSvc.metricInputs, 2)
+}
+
+func TestDoRefusesUnknownAlarms(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Success: true}
+	mockCWSvc := &mockCloudWatchClient{}
+	clients := testClients(mockSvc)
+	clients.cloudWatch = mockCWSvc
+	opts := testDrill("http://localhost")
+	opts.holdCloudWatch = cloudWatchChecks{alarms: []string{"secondary-health"}}
+
+	assert.Equal(t, 1, do(clients, opts))
+	assert.Equal(t, 0, mockSvc.describeCount)
+}
+
+func TestLoadConfigCloudWatch(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("hold.duration", "10m")
+	viper.Set("hold.poll", "30s")
+	viper.Set("hold.cloudwatch.alarms", []string{"secondary-5xx"})
+	viper.Set("hold.cloudwatch.metrics", []map[string]interface{}{{
+		"namespace":  "AWS/ApplicationELB",
+		"name":       "TargetResponseTime",
+		"dimensions": map[string]string{"LoadBalancer": "app/secondary/1"},
+		"statistic":  "p99",
+		"period":     "5m",
+		"max":        1.5,
+	}})
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"secondary-5xx"}, cfg.holdCloudWatch.alarms)
+	assert.Equal(t, []metricThreshold{{
+		namespace:  "AWS/ApplicationELB",
+		name:       "TargetResponseTime",
+		dimensions: map[string]string{"LoadBalancer": "app/secondary/1"},
+		statistic:  "p99",
+		period:     5 * time.Minute,
+		max:        1.5,
+	}}, cfg.holdCloudWatch.metrics)
+}
+
+func TestLoadConfigInvalidCloudWatch(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("hold.cloudwatch.metrics", []map[string]interface{}{{
+		"name":      "TargetResponseTime",
+		"statistic": "median",
+	}})
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - hold.cloudwatch.metrics[0].namespace is required\n"+
+		"  - hold.cloudwatch.metrics[0].statistic \"median\" is unknown, expected Sum, Average, Maximum, Minimum, SampleCount or a percentile like p99\n"+
+		"  - hold.cloudwatch is only checked during a hold, set hold.duration")
+}
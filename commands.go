@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/growkudos/Anarchy-Kitten/asg"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+)
+
+// plan describes what a drill would do without making any changes, and
+// checks the group and site are in a fit state to start one.
+func plan(
+	w io.Writer,
+	svc autoscalingiface.AutoScalingAPI,
+	stsSvc stsiface.STSAPI,
+	asgName string,
+	primary string,
+	secondary string,
+	scripts contentScripts,
+	u string,
+	auth contentcheck.Auth,
+	phases drill.Phases,
+	holdCloudWatch cloudWatchChecks,
+) int {
+	exitCode := 0
+
+	err := checkCallerIdentity(stsSvc)
+	if err != nil {
+		return 1
+	}
+
+	group, err := getAutoScalingGroup(&asgName, svc)
+	if err != nil {
+		log.WithError(err).Error("Could not describe the autoscaling group")
+		return 1
+	}
+	instanceIDs := aws.StringValueSlice(asg.InstanceIDs(group.Instances))
+
+	fmt.Fprintf(w, "Plan for autoscaling group %s, finishing within %s:\n", asgName, phases.Deadline)
+	fmt.Fprintf(w, "  1. Put %d instances into standby within %s: %v\n", len(instanceIDs), phases.Standby.Timeout, instanceIDs)
+	fmt.Fprintf(w, "  2. Within %s, polling every %s:\n", phases.Failover.Timeout, phases.Failover.Poll)
+	fmt.Fprintf(w, "     - wait for %d target groups to stop sending traffic to them\n", len(group.TargetGroupARNs))
+	fmt.Fprintf(w, "     - wait for %s at %s\n", describeExpectation(secondary, scripts.secondary), u)
+	if phases.Hold.Duration > 0 {
+		fmt.Fprintf(w, "     - then check it is still there every %s for %s, allowing %d misses\n", phases.Hold.Poll, phases.Hold.Duration, phases.Hold.Budget)
+		if holdCloudWatch.enabled() {
+			fmt.Fprintf(w, "     - and that no watched alarm fires and %d metrics stay under their maximum\n", len(holdCloudWatch.metrics))
+		}
+	}
+	fmt.Fprintf(w, "  3. Take the instances out of standby until they are all in service, allowing %s each time\n", phases.Restore.Timeout)
+	fmt.Fprintf(w, "  4. Within %s, polling every %s:\n", phases.Recovery.Timeout, phases.Recovery.Poll)
+	fmt.Fprintf(w, "     - wait for %d target groups to report the instances healthy\n", len(group.TargetGroupARNs))
+	fmt.Fprintf(w, "     - wait for %s at %s\n", describeExpectation(primary, scripts.primary), u)
+
+	if !asg.AllInService(group.Instances) {
+		fmt.Fprintln(w, "Not all of the instances are in service, the drill should not be started")
+		exitCode++
+	}
+
+	tags, err := getDrillTags(svc, asgName)
+	if err != nil {
+		log.WithError(err).Error("Could not read the autoscaling group's tags")
+		exitCode++
+	} else if tags[tagRunID] != "" {
+		fmt.Fprintf(
+			w,
+			"The group is still tagged by drill %s, started by %s at %s, run recover before starting another\n",
+			tags[tagRunID],
+			tags[tagOperator],
+			tags[tagStarted])
+		exitCode++
+	}
+
+	if checkExpectation(primary, scripts.primary, u, auth) != 0 {
+		if scripts.primary != nil {
+			fmt.Fprintf(w, "The primary %s script fails at %s, the drill should not be started\n", scripts.primary.Name, u)
+		} else {
+			fmt.Fprintf(w, "The primary content %q is not being served at %s, the drill should not be started\n", primary, u)
+		}
+		exitCode++
+	}
+
+	return exitCode
+}
+
+// describeExpectation is how the plan refers to the content it waits for
+func describeExpectation(content string, script *contentcheck.Script) string {
+	if script != nil {
+		return "the " + script.Name + " script"
+	}
+
+	return fmt.Sprintf("%q", content)
+}
+
+func status(
+	w io.Writer,
+	svc autoscalingiface.AutoScalingAPI,
+	asgName string,
+) int {
+	group, err := getAutoScalingGroup(&asgName, svc)
+	if err != nil {
+		log.WithError(err).Error("Could not describe the autoscaling group")
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tLIFECYCLE STATE\tHEALTH")
+	for _, instance := range group.Instances {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\n",
+			aws.StringValue(instance.InstanceId),
+			aws.StringValue(instance.LifecycleState),
+			aws.StringValue(instance.HealthStatus))
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		log.WithError(err).Error("Could not write the status")
+		return 1
+	}
+
+	return 0
+}
+
+// recoverGroup takes any instances left in standby, e.g. by an interrupted
+// drill, back into service and removes the drill's tags.
+func recoverGroup(
+	c clock.Clock,
+	svc autoscalingiface.AutoScalingAPI,
+	elbSvc elbv2iface.ELBV2API,
+	ec2Svc ec2iface.EC2API,
+	asgName string,
+	phases drill.Phases,
+) int {
+	exitCode := 0
+
+	group, err := getAutoScalingGroup(&asgName, svc)
+	if err != nil {
+		log.WithError(err).Error("Could not describe the autoscaling group")
+		return 1
+	}
+	standby := getInstancesInState(group.Instances, "Standby")
+
+	tags, err := getDrillTags(svc, asgName)
+	if err != nil {
+		log.WithError(err).Error("Could not read the autoscaling group's tags")
+		exitCode++
+	} else if tags[tagRunID] != "" {
+		log.WithFields(log.Fields{
+			"asg":         asgName,
+			"runId":       tags[tagRunID],
+			"operator":    tags[tagOperator],
+			"started":     tags[tagStarted],
+			"expectedEnd": tags[tagExpectedEnd],
+		}).Info("Recovering the group from a drill")
+	}
+
+	if len(standby) == 0 {
+		log.Info("No instances in standby")
+	} else {
+		result, retries := asg.ExitStandby(
+			c,
+			svc,
+			asgName,
+			asg.InstanceIDs(standby),
+			phases.Restore.Poll,
+			phases.Restore.Timeout,
+		)
+		drillMetrics.add(metricRecoveryRetries, float64(retries))
+		exitCode += result
+	}
+
+	exitCode += asg.WaitForTargetHealth(
+		c,
+		elbSvc,
+		group.TargetGroupARNs,
+		asg.InstanceIDs(group.Instances),
+		asg.TargetStatesInService,
+		phases.Recovery.Poll,
+		phases.Recovery.Timeout,
+		nil,
+	)
+
+	// A group that didn't recover keeps its tags, so it is still found and
+	// the next drill still refuses it
+	if tags[tagRunID] != "" {
+		if exitCode != 0 {
+			log.WithField("asg", asgName).Warn("Leaving the drill tags as the group did not recover")
+			return exitCode
+		}
+		exitCode += untagDrill(svc, ec2Svc, asgName, asg.InstanceIDs(group.Instances))
+	}
+
+	return exitCode
+}
+
+func getInstancesInState(
+	instances []*autoscaling.Instance,
+	state string) []*autoscaling.Instance {
+	ret := []*autoscaling.Instance{}
+
+	for _, instance := range instances {
+		if aws.StringValue(instance.LifecycleState) == state {
+			ret = append(ret, instance)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	mockSvc := &mockAutoScalingClient{
+		TargetGroupARNs: []*string{aws.String("arn1")},
+	}
+	exitCode := plan(&buf, mockSvc, &mockSTSClient{}, "test", "primary", "secondary", contentScripts{}, ts.URL, contentcheck.Auth{}, testPhases(1*time.Millisecond, 3*time.Millisecond), cloudWatchChecks{})
+
+	assert.Equal(t, 0, exitCode)
+	assert.Contains(t, buf.String(), "Put 3 instances into standby within 3ms: [instance1 instance2 instance3]")
+	assert.Contains(t, buf.String(), "wait for 1 target groups")
+	assert.Contains(t, buf.String(), "\"secondary\" at "+ts.URL)
+}
+
+func TestPlanNotReady(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "secondary")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	mockSvc := &mockAutoScalingClient{ServiceStatus: []string{"Standby"}}
+	exitCode := plan(&buf, mockSvc, &mockSTSClient{}, "test", "primary", "secondary", contentScripts{}, ts.URL, contentcheck.Auth{}, testPhases(1*time.Millisecond, 3*time.Millisecond), cloudWatchChecks{})
+
+	assert.Equal(t, 2, exitCode)
+	assert.Contains(t, buf.String(), "Not all of the instances are in service")
+	assert.Contains(t, buf.String(), "is not being served")
+}
+
+func TestPlanScripts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	scripts := contentScripts{
+		primary:   &contentcheck.Script{Name: "checkout", Steps: []contentcheck.Step{{URL: "/"}}},
+		secondary: &contentcheck.Script{Name: "maintenance", Steps: []contentcheck.Step{{URL: "/"}}},
+	}
+
+	var buf bytes.Buffer
+	exitCode := plan(&buf, &mockAutoScalingClient{}, &mockSTSClient{}, "test", "", "", scripts, ts.URL, contentcheck.Auth{}, testPhases(1*time.Millisecond, 3*time.Millisecond), cloudWatchChecks{})
+
+	assert.Equal(t, 1, exitCode)
+	assert.Contains(t, buf.String(), "wait for the maintenance script at "+ts.URL)
+	assert.Contains(t, buf.String(), "wait for the checkout script at "+ts.URL)
+	assert.Contains(t, buf.String(), "The primary checkout script fails at "+ts.URL)
+}
+
+func TestPlanGroupLeftByDrill(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	mockSvc := &mockAutoScalingClient{
+		Tags: drillTags(testRun, time.Now(), time.Now().Add(time.Hour)),
+	}
+	exitCode := plan(&buf, mockSvc, &mockSTSClient{}, "test", "primary", "secondary", contentScripts{}, ts.URL, contentcheck.Auth{}, testPhases(1*time.Millisecond, 3*time.Millisecond), cloudWatchChecks{})
+
+	assert.Equal(t, 1, exitCode)
+	assert.Contains(t, buf.String(), "still tagged by drill run1, started by alice@host")
+}
+
+func TestPlanIdentityFail(t *testing.T) {
+	var buf bytes.Buffer
+	exitCode := plan(&buf, &mockAutoScalingClient{}, &mockSTSClient{Error: "GetCallerIdentity"}, "test", "primary", "secondary", contentScripts{}, "http://localhost", contentcheck.Auth{}, testPhases(1*time.Millisecond, 3*time.Millisecond), cloudWatchChecks{})
+
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestStatus(t *testing.T) {
+	var buf bytes.Buffer
+	mockSvc := &mockAutoScalingClient{ServiceStatus: []string{"Standby"}}
+
+	assert.Equal(t, 0, status(&buf, mockSvc, "test"))
+	assert.Contains(t, buf.String(), "INSTANCE")
+	assert.Contains(t, buf.String(), "instance1")
+	assert.Contains(t, buf.String(), "Standby")
+}
+
+func TestRecoverGroup(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"Standby"},
+	}
+
+	assert.Equal(t, 0, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+}
+
+func TestRecoverGroupCountsRetries(t *testing.T) {
+	defer useTestMetrics()()
+
+	// The first wait for the instances to leave standby fails, the next
+	// one works
+	mockSvc := &mockAutoScalingClient{
+		Success:        true,
+		ServiceStatus:  []string{"Standby"},
+		ActivityErrors: 1,
+	}
+
+	assert.Equal(t, 0, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+	assert.Contains(t, metricsText(drillMetrics), "anarchy_kitten_recovery_retries_total 1\n")
+}
+
+func TestRecoverGroupRemovesDrillTags(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"Standby"},
+		Tags:          drillTags(testRun, time.Now(), time.Now().Add(time.Hour)),
+	}
+	mockEC2 := &mockEC2Client{}
+	instanceIDs := aws.StringSlice([]string{"instance1", "instance2", "instance3"})
+	assert.Equal(t, 0, tagDrill(mockSvc, mockEC2, "test", instanceIDs, mockSvc.Tags))
+
+	assert.Equal(t, 0, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, mockEC2, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+	assert.Empty(t, mockSvc.Tags)
+	assert.Empty(t, mockEC2.Tags)
+}
+
+func TestRecoverGroupFailedKeepsDrillTags(t *testing.T) {
+	tags := drillTags(testRun, time.Now(), time.Now().Add(time.Hour))
+	mockSvc := &mockAutoScalingClient{
+		Error:         "ExitStandby",
+		ServiceStatus: []string{"Standby"},
+		Tags:          tags,
+	}
+
+	assert.Equal(t, 1, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+	assert.Equal(t, tags, mockSvc.Tags)
+}
+
+func TestRecoverGroupExitStandbyFail(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Error:         "ExitStandby",
+		ServiceStatus: []string{"Standby"},
+	}
+
+	assert.Equal(t, 1, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+}
+
+func TestRecoverGroupDescribeFail(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Error: "DescribeAutoScalingGroups"}
+
+	assert.Equal(t, 1, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+}
+
+func TestRecoverGroupNothingInStandby(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Error: "ExitStandby"}
+
+	assert.Equal(t, 0, recoverGroup(testClock(), mockSvc, &mockELBV2Client{}, &mockEC2Client{}, "test", testPhases(1*time.Millisecond, 3*time.Millisecond)))
+}
+
+func TestGetInstancesInState(t *testing.T) {
+	instances := []*autoscaling.Instance{
+		&autoscaling.Instance{
+			InstanceId:     aws.String("instance1"),
+			LifecycleState: aws.String("Standby")},
+		&autoscaling.Instance{
+			InstanceId:     aws.String("instance2"),
+			LifecycleState: aws.String("InService")},
+	}
+
+	standby := getInstancesInState(instances, "Standby")
+	assert.Equal(t, 1, len(standby))
+	assert.Equal(t, "instance1", *standby[0].InstanceId)
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// legacyEnv are the environment variables read before the AK_ prefix, by the
+// key they set. They are still read after the AK_ ones, so older setups keep
+// working until they move over.
+var legacyEnv = map[string]string{
+	"asg":       "ASG_NAME",
+	"url":       "URL",
+	"primary":   "PRIMARY",
+	"secondary": "SECONDARY",
+	"poll":      "POLL",
+	"timeout":   "TIMEOUT",
+	"expect":    "EXPECT",
+}
+
+// bindLegacyEnv reads each legacy environment variable that is set, warning
+// that it is deprecated
+func bindLegacyEnv() {
+	keys := []string{}
+	for key := range legacyEnv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, ok := os.LookupEnv(legacyEnv[key]); !ok {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"variable":    legacyEnv[key],
+			"replacement": "AK_" + strings.ToUpper(key),
+		}).Warn("The environment variable is deprecated, use its replacement")
+		viper.BindEnv(key, legacyEnv[key])
+	}
+}
+
+// readConfig reads the given config file, or config.yaml (or .json, .toml)
+// from the working directory if there is one. Every key can also be set with
+// an AK_ prefixed environment variable, e.g. AK_AUTH_USER for auth.user, and
+// the legacy unprefixed ones are still read.
+func readConfig(configFile string) error {
+	viper.SetEnvPrefix("AK")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	viper.SetDefault("poll", 10)
+	viper.SetDefault("timeout", 600)
+	viper.SetDefault("auth.insecure", false)
+	viper.SetDefault("http.userAgent", "Anarchy-Kitten")
+	viper.SetDefault("http.redirects", true)
+	viper.SetDefault("http.maxRedirects", contentcheck.DefaultMaxRedirects)
+	viper.SetDefault("aws.role.sessionName", "anarchy-kitten")
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", "text")
+	viper.SetDefault("lock.dir", os.TempDir())
+	viper.SetDefault("tracing.endpoint", "http://localhost:4318")
+	viper.SetDefault("guardrails.monitor.window", defaultMonitorWindow)
+	viper.SetDefault("daemon.timezone", "Local")
+	viper.SetDefault("daemon.lockFile", filepath.Join(os.TempDir(), "anarchy-kitten.lock"))
+	viper.SetDefault("daemon.reports.dir", "reports")
+	viper.SetDefault("daemon.reports.keep", 10)
+
+	bindLegacyEnv()
+
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		return viper.ReadInConfig()
+	}
+
+	viper.SetConfigName("config") // name of config file (without extension)
+	viper.AddConfigPath(".")      // look for config in the working directory
+	err := viper.ReadInConfig()   // Find and read the config file
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		log.Info("No config file found, using the flags and environment only")
+		return nil
+	}
+
+	return err
+}
+
+// What a command needs from the config on top of the settings that always
+// have to be valid.
+type requirement int
+
+const (
+	requireASG requirement = 1 << iota
+	requireContent
+)
+
+type config struct {
+	asg       string
+	url       string
+	primary   string
+	secondary string
+	scripts   contentScripts
+	poll      time.Duration
+	timeout   time.Duration
+	phases    drill.Phases
+	auth      contentcheck.Auth
+	aws       awsOptions
+	lock      lockOptions
+	notify    notifiers
+
+	// A Prometheus Pushgateway to push the metrics to after a one-shot drill
+	pushgateway string
+
+	// Where to send the traces of each drill, nil if tracing is off
+	tracing spanExporter
+
+	// The CloudWatch checks made on each poll of the hold
+	holdCloudWatch cloudWatchChecks
+
+	guardrails guardrailOptions
+
+	// What to do when the group isn't left as the drill found it
+	drift string
+
+	hooks hooks
+}
+
+type lockOptions struct {
+	backend string
+	dir     string
+	ttl     time.Duration
+}
+
+// configError lists every problem found with the config
+type configError struct {
+	problems []string
+}
+
+func (e *configError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.problems, "\n  - ")
+}
+
+// loadConfig builds the config from viper and validates it, collecting every
+// problem rather than stopping at the first.
+func loadConfig(requires requirement) (config, error) {
+	problems := []string{}
+
+	c := config{
+		asg:       viper.GetString("asg"),
+		url:       viper.GetString("url"),
+		primary:   viper.GetString("primary"),
+		secondary: viper.GetString("secondary"),
+		poll:      getDuration("poll", &problems),
+		timeout:   getDuration("timeout", &problems),
+		aws: awsOptions{
+			profile:     viper.GetString("aws.profile"),
+			region:      viper.GetString("aws.region"),
+			roleARN:     viper.GetString("aws.role.arn"),
+			externalID:  viper.GetString("aws.role.externalId"),
+			sessionName: viper.GetString("aws.role.sessionName"),
+		},
+	}
+	c.phases = drill.Phases{
+		Standby:  getPhase("standby", c.poll, c.timeout, &problems),
+		Failover: getPhase("failover", c.poll, c.timeout, &problems),
+		Hold: drill.Hold{
+			Duration: getDuration("hold.duration", &problems),
+			Poll:     getDuration("hold.poll", &problems),
+			Budget:   viper.GetInt("hold.budget"),
+		},
+		Restore:  getPhase("restore", c.poll, c.timeout, &problems),
+		Recovery: getPhase("recovery", c.poll, c.timeout, &problems),
+		Deadline: getDuration("deadline", &problems),
+	}
+	c.holdCloudWatch = getCloudWatchChecks(&problems)
+	if !viper.IsSet("hold.poll") {
+		c.phases.Hold.Poll = c.phases.Failover.Poll
+	}
+	if c.phases.Deadline == 0 {
+		c.phases.Deadline = c.phases.Budget()
+	}
+	c.scripts = contentScripts{
+		primary:   getScript("scripts.primary", &problems),
+		secondary: getScript("scripts.secondary", &problems),
+	}
+	c.auth = getContentAuth(c.poll, &problems)
+	c.notify = getNotifiers(&problems)
+	c.pushgateway = viper.GetString("metrics.pushgateway")
+	c.tracing = getSpanExporter(&problems)
+	c.hooks = getHooks(&problems)
+	c.drift = viper.GetString("drift")
+	if c.drift == "" {
+		c.drift = drill.DriftReport
+	}
+	c.guardrails = guardrailOptions{
+		alarms:         viper.GetStringSlice("guardrails.alarms"),
+		killSwitchFile: viper.GetString("guardrails.killSwitch.file"),
+		killSwitchURL:  viper.GetString("guardrails.killSwitch.url"),
+		monitorURL:     viper.GetString("guardrails.monitor.url"),
+		maxErrorRate:   viper.GetFloat64("guardrails.monitor.maxErrorRate"),
+		window:         viper.GetInt("guardrails.monitor.window"),
+	}
+	c.lock = lockOptions{
+		backend: viper.GetString("lock.backend"),
+		dir:     viper.GetString("lock.dir"),
+		ttl:     getDuration("lock.ttl", &problems),
+	}
+	if c.lock.backend == "" {
+		c.lock.backend = lockBackendASGTag
+	}
+	// Restoring the group can run past the deadline so leave room for it
+	if c.lock.ttl == 0 && c.phases.Deadline > 0 {
+		c.lock.ttl = 2 * c.phases.Deadline
+	}
+
+	problems = append(problems, c.validate(requires)...)
+
+	if len(problems) > 0 {
+		return c, &configError{problems: problems}
+	}
+
+	return c, nil
+}
+
+func (c config) validate(requires requirement) []string {
+	problems := []string{}
+
+	if requires&requireASG != 0 && c.asg == "" {
+		problems = append(problems, "asg is required")
+	}
+
+	if requires&requireContent != 0 {
+		if c.url == "" {
+			problems = append(problems, "url is required")
+		} else if !isHTTPURL(c.url) {
+			problems = append(problems, fmt.Sprintf("url %q is not a valid URL", c.url))
+		}
+
+		if c.primary == "" && c.scripts.primary == nil {
+			problems = append(problems, "primary or scripts.primary is required")
+		}
+
+		if c.secondary == "" && c.scripts.secondary == nil {
+			problems = append(problems, "secondary or scripts.secondary is required")
+		}
+
+		if c.primary != "" && c.primary == c.secondary {
+			problems = append(problems, "primary and secondary must be different or a failover can't be detected")
+		}
+	}
+
+	problems = append(problems, validatePhase("", drill.Phase{Poll: c.poll, Timeout: c.timeout})...)
+
+	for _, p := range []struct {
+		name  string
+		phase drill.Phase
+	}{
+		{"standby", c.phases.Standby},
+		{"failover", c.phases.Failover},
+		{"restore", c.phases.Restore},
+		{"recovery", c.phases.Recovery},
+	} {
+		// Phases that use the global poll and timeout are already checked
+		if p.phase.Poll == c.poll && p.phase.Timeout == c.timeout {
+			continue
+		}
+		problems = append(problems, validatePhase(p.name, p.phase)...)
+	}
+
+	if c.phases.Hold.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("hold.duration must not be negative, got %s", c.phases.Hold.Duration))
+	}
+
+	if c.phases.Hold.Duration > 0 {
+		if c.phases.Hold.Poll <= 0 {
+			problems = append(problems, fmt.Sprintf("hold.poll must be positive, got %s", c.phases.Hold.Poll))
+		} else if c.phases.Hold.Poll >= c.phases.Hold.Duration {
+			problems = append(problems, fmt.Sprintf(
+				"hold.poll (%s) must be less than hold.duration (%s)",
+				c.phases.Hold.Poll,
+				c.phases.Hold.Duration))
+		}
+	}
+
+	if c.phases.Hold.Budget < 0 {
+		problems = append(problems, fmt.Sprintf("hold.budget must not be negative, got %d", c.phases.Hold.Budget))
+	}
+
+	if c.holdCloudWatch.enabled() && c.phases.Hold.Duration == 0 {
+		problems = append(problems, "hold.cloudwatch is only checked during a hold, set hold.duration")
+	}
+
+	if c.phases.Deadline < c.phases.Budget() {
+		problems = append(problems, fmt.Sprintf(
+			"the phase timeouts add up to %s, more than the deadline (%s)",
+			c.phases.Budget(),
+			c.phases.Deadline))
+	}
+
+	if c.auth.HTTP.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("http.timeout must not be negative, got %s", c.auth.HTTP.Timeout))
+	}
+
+	switch c.lock.backend {
+	case lockBackendASGTag, lockBackendNone:
+	case lockBackendFile:
+		if c.lock.dir == "" {
+			problems = append(problems, "lock.dir is required for the file lock")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("lock.backend %q is unknown, expected asg-tag, file or none", c.lock.backend))
+	}
+
+	if c.lock.ttl < 0 {
+		problems = append(problems, fmt.Sprintf("lock.ttl must not be negative, got %s", c.lock.ttl))
+	}
+
+	switch c.drift {
+	case drill.DriftOff, drill.DriftReport, drill.DriftFail:
+	default:
+		problems = append(problems, fmt.Sprintf("drift %q is unknown, expected off, report or fail", c.drift))
+	}
+
+	if c.guardrails.killSwitchURL != "" {
+		if !isHTTPURL(c.guardrails.killSwitchURL) {
+			problems = append(problems, fmt.Sprintf("guardrails.killSwitch.url %q is not a valid URL", c.guardrails.killSwitchURL))
+		}
+	}
+
+	if c.guardrails.maxErrorRate < 0 || c.guardrails.maxErrorRate > 1 {
+		problems = append(problems, fmt.Sprintf("guardrails.monitor.maxErrorRate must be between 0 and 1, got %v", c.guardrails.maxErrorRate))
+	}
+
+	// The drilled URL isn't a default, as its failover page can return a
+	// server error on every poll of a drill that is going to plan
+	if c.guardrails.maxErrorRate > 0 && c.guardrails.monitorURL == "" {
+		problems = append(problems, "guardrails.monitor.url is required with guardrails.monitor.maxErrorRate")
+	}
+	if c.guardrails.monitorURL != "" && !isHTTPURL(c.guardrails.monitorURL) {
+		problems = append(problems, fmt.Sprintf("guardrails.monitor.url %q is not a valid URL", c.guardrails.monitorURL))
+	}
+
+	if c.guardrails.window < 0 {
+		problems = append(problems, fmt.Sprintf("guardrails.monitor.window must not be negative, got %d", c.guardrails.window))
+	}
+
+	if c.pushgateway != "" {
+		if !isHTTPURL(c.pushgateway) {
+			problems = append(problems, fmt.Sprintf("metrics.pushgateway %q is not a valid URL", c.pushgateway))
+		}
+	}
+
+	switch c.auth.Mode {
+	case contentcheck.AuthModeAuto, contentcheck.AuthModeNone:
+	case contentcheck.AuthModeBasic:
+		if c.auth.User == "" {
+			problems = append(problems, "auth.user is required for basic auth")
+		}
+	case contentcheck.AuthModeBearer:
+		if c.auth.Token == "" {
+			problems = append(problems, "auth.token is required for bearer auth")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("auth.mode %q is unknown, expected none, basic or bearer", c.auth.Mode))
+	}
+
+	return problems
+}
+
+// validatePhase checks a phase's poll and timeout, the global ones when the
+// name is empty.
+func validatePhase(name string, p drill.Phase) []string {
+	problems := []string{}
+
+	prefix := ""
+	if name != "" {
+		prefix = name + "."
+	}
+
+	if p.Poll <= 0 {
+		problems = append(problems, fmt.Sprintf("%spoll must be positive, got %s", prefix, p.Poll))
+	}
+
+	if p.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("%stimeout must be positive, got %s", prefix, p.Timeout))
+	}
+
+	if p.Poll > 0 && p.Timeout > 0 && p.Poll >= p.Timeout {
+		problems = append(problems, fmt.Sprintf("%spoll (%s) must be less than %stimeout (%s)", prefix, p.Poll, prefix, p.Timeout))
+	}
+
+	return problems
+}
+
+// getPhase reads the phase's poll and timeout, falling back to the global
+// ones when they aren't set.
+func getPhase(
+	name string,
+	poll time.Duration,
+	timeout time.Duration,
+	problems *[]string) drill.Phase {
+	p := drill.Phase{
+		Poll:    getDuration(name+".poll", problems),
+		Timeout: getDuration(name+".timeout", problems),
+	}
+
+	if !viper.IsSet(name + ".poll") {
+		p.Poll = poll
+	}
+
+	if !viper.IsSet(name + ".timeout") {
+		p.Timeout = timeout
+	}
+
+	return p
+}
+
+// getDuration reads a duration given either as a whole number of seconds or
+// as a Go duration string such as "30s" or "5m".
+func getDuration(key string, problems *[]string) time.Duration {
+	value := viper.GetString(key)
+	if value == "" {
+		return 0
+	}
+
+	d, err := parseDuration(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %q is not a number of seconds or a duration like 30s", key, value))
+	}
+
+	return d
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// isHTTPURL is true for an absolute http or https URL with a host, the only
+// kind the drill can send anything to
+func isHTTPURL(value string) bool {
+	u, err := neturl.ParseRequestURI(value)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// getNotifiers builds a notifier for each webhook set. The Slack webhook URL
+// is a secret so it can also be read from a file or environment variable.
+func getNotifiers(problems *[]string) notifiers {
+	ns := notifiers{}
+
+	webhook := viper.GetString("notify.webhook")
+	if webhook != "" {
+		if !isHTTPURL(webhook) {
+			*problems = append(*problems, fmt.Sprintf("notify.webhook %q is not a valid URL", webhook))
+		} else {
+			ns = append(ns, newWebhookNotifier(webhook))
+		}
+	}
+
+	slack, err := resolveSecret(
+		viper.GetString("notify.slack"),
+		viper.GetString("notify.slackFile"),
+		viper.GetString("notify.slackEnv"))
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("notify.slack could not be read: %s", err))
+	} else if slack != "" {
+		if !isHTTPURL(slack) {
+			*problems = append(*problems, "notify.slack is not a valid URL")
+		} else {
+			ns = append(ns, newSlackNotifier(slack))
+		}
+	}
+
+	return ns
+}
+
+// getSpanExporter builds the exporter set in the config, none if tracing is
+// off
+func getSpanExporter(problems *[]string) spanExporter {
+	switch exporter := viper.GetString("tracing.exporter"); exporter {
+	case "", tracingExporterNone:
+		return nil
+	case tracingExporterOTLP:
+		endpoint := viper.GetString("tracing.endpoint")
+		if !isHTTPURL(endpoint) {
+			*problems = append(*problems, fmt.Sprintf("tracing.endpoint %q is not a valid URL", endpoint))
+			return nil
+		}
+		return newOTLPExporter(endpoint)
+	case tracingExporterFile:
+		path := viper.GetString("tracing.file")
+		if path == "" {
+			*problems = append(*problems, "tracing.file is required for the file exporter")
+			return nil
+		}
+		return &fileExporter{path: path}
+	default:
+		*problems = append(*problems, fmt.Sprintf("tracing.exporter %q is unknown, expected none, otlp or file", exporter))
+		return nil
+	}
+}
+
+// metricThresholdConfig is how a metric threshold is given in the config
+type metricThresholdConfig struct {
+	Namespace  string            `mapstructure:"namespace"`
+	Name       string            `mapstructure:"name"`
+	Dimensions map[string]string `mapstructure:"dimensions"`
+	Statistic  string            `mapstructure:"statistic"`
+	Period     string            `mapstructure:"period"`
+	Max        float64           `mapstructure:"max"`
+}
+
+// getCloudWatchChecks reads the alarms and metrics to check during the hold
+func getCloudWatchChecks(problems *[]string) cloudWatchChecks {
+	checks := cloudWatchChecks{
+		alarms:      viper.GetStringSlice("hold.cloudwatch.alarms"),
+		alarmPrefix: viper.GetString("hold.cloudwatch.alarmPrefix"),
+		allowed:     viper.GetStringSlice("hold.cloudwatch.allowed"),
+	}
+
+	configs := []metricThresholdConfig{}
+	err := viper.UnmarshalKey("hold.cloudwatch.metrics", &configs)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("hold.cloudwatch.metrics could not be read: %s", err))
+		return checks
+	}
+
+	for i, mc := range configs {
+		key := fmt.Sprintf("hold.cloudwatch.metrics[%d]", i)
+		m := metricThreshold{
+			namespace:  mc.Namespace,
+			name:       mc.Name,
+			dimensions: mc.Dimensions,
+			statistic:  mc.Statistic,
+			max:        mc.Max,
+		}
+
+		if m.namespace == "" {
+			*problems = append(*problems, key+".namespace is required")
+		}
+		if m.name == "" {
+			*problems = append(*problems, key+".name is required")
+		}
+
+		switch {
+		case m.statistic == "":
+			m.statistic = cloudwatch.StatisticSum
+		case isPercentile(m.statistic):
+		case isStatistic(m.statistic):
+		default:
+			*problems = append(*problems, fmt.Sprintf(
+				"%s.statistic %q is unknown, expected Sum, Average, Maximum, Minimum, SampleCount or a percentile like p99",
+				key,
+				m.statistic))
+		}
+
+		if mc.Period != "" {
+			m.period, err = parseDuration(mc.Period)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s.period %q is not a number of seconds or a duration like 30s", key, mc.Period))
+			}
+		}
+
+		checks.metrics = append(checks.metrics, m)
+	}
+
+	return checks
+}
+
+// getScript reads a synthetic transaction to run in place of a content
+// check, nil if there isn't one
+func getScript(key string, problems *[]string) *contentcheck.Script {
+	if !viper.IsSet(key) {
+		return nil
+	}
+
+	script := &contentcheck.Script{}
+	err := viper.UnmarshalKey(key, script)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s could not be read: %s", key, err))
+		return nil
+	}
+
+	if script.Name == "" {
+		script.Name = strings.TrimPrefix(key, "scripts.")
+	}
+
+	if err := script.Validate(); err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %s", key, err))
+	}
+
+	return script
+}
+
+// hookConfig is how a hook is given in the config
+type hookConfig struct {
+	On          string `mapstructure:"on"`
+	Command     string `mapstructure:"command"`
+	URL         string `mapstructure:"url"`
+	Timeout     string `mapstructure:"timeout"`
+	FailOnError bool   `mapstructure:"failOnError"`
+}
+
+// getHooks reads the commands and URLs to run at points in the drill
+func getHooks(problems *[]string) hooks {
+	configs := []hookConfig{}
+	err := viper.UnmarshalKey("hooks", &configs)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("hooks could not be read: %s", err))
+		return nil
+	}
+
+	hs := hooks{}
+	for i, hc := range configs {
+		key := fmt.Sprintf("hooks[%d]", i)
+		h := hook{
+			on:          hc.On,
+			command:     hc.Command,
+			url:         hc.URL,
+			failOnError: hc.FailOnError,
+		}
+
+		switch h.on {
+		case hookPreStandby, hookFailoverDetected, hookPreRestore, hookPostRestore, hookFailure:
+		default:
+			*problems = append(*problems, fmt.Sprintf(
+				"%s.on %q is unknown, expected pre-standby, failover-detected, pre-restore, post-restore or failure",
+				key,
+				h.on))
+		}
+
+		switch {
+		case h.command == "" && h.url == "":
+			*problems = append(*problems, key+" needs a command or a url")
+		case h.command != "" && h.url != "":
+			*problems = append(*problems, key+" can have a command or a url, not both")
+		case h.url != "":
+			if !isHTTPURL(h.url) {
+				*problems = append(*problems, fmt.Sprintf("%s.url %q is not a valid URL", key, h.url))
+			}
+		}
+
+		if hc.Timeout != "" {
+			h.timeout, err = parseDuration(hc.Timeout)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s.timeout %q is not a number of seconds or a duration like 30s", key, hc.Timeout))
+			}
+		}
+
+		hs = append(hs, h)
+	}
+
+	return hs
+}
+
+func isStatistic(statistic string) bool {
+	switch statistic {
+	case cloudwatch.StatisticSum,
+		cloudwatch.StatisticAverage,
+		cloudwatch.StatisticMaximum,
+		cloudwatch.StatisticMinimum,
+		cloudwatch.StatisticSampleCount:
+		return true
+	}
+
+	return false
+}
+
+func getContentAuth(poll time.Duration, problems *[]string) contentcheck.Auth {
+	password, err := resolveSecret(
+		viper.GetString("auth.password"),
+		viper.GetString("auth.passwordFile"),
+		viper.GetString("auth.passwordEnv"))
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("auth.password could not be read: %s", err))
+	}
+
+	token, err := resolveSecret(
+		viper.GetString("auth.token"),
+		viper.GetString("auth.tokenFile"),
+		viper.GetString("auth.tokenEnv"))
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("auth.token could not be read: %s", err))
+	}
+
+	// A request shouldn't outlive the poll interval unless told otherwise
+	requestTimeout := getDuration("http.timeout", problems)
+	if requestTimeout == 0 {
+		requestTimeout = poll
+	}
+
+	auth := contentcheck.Auth{
+		Mode:     viper.GetString("auth.mode"),
+		User:     viper.GetString("auth.user"),
+		Password: password,
+		Token:    token,
+		Insecure: viper.GetBool("auth.insecure"),
+		CAFile:   viper.GetString("tls.ca"),
+		CertFile: viper.GetString("tls.cert"),
+		KeyFile:  viper.GetString("tls.key"),
+		HTTP: contentcheck.HTTPOptions{
+			Timeout:      requestTimeout,
+			Headers:      viper.GetStringMapString("http.headers"),
+			Host:         viper.GetString("http.host"),
+			UserAgent:    viper.GetString("http.userAgent"),
+			CacheBust:    viper.GetString("http.cacheBust"),
+			Proxy:        viper.GetString("http.proxy"),
+			NoRedirects:  !viper.GetBool("http.redirects"),
+			MaxRedirects: viper.GetInt("http.maxRedirects"),
+			Fresh:        viper.GetBool("http.fresh"),
+		},
+	}
+
+	// One client for the whole drill, so the certificates are read once and
+	// the checks share their connections
+	auth.Client, err = contentcheck.NewClient(auth)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("the content check client could not be made: %s", err))
+	}
+
+	return auth
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	return path
+}
+
+func TestReadConfigYAML(t *testing.T) {
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "drill.yaml", "url: https://www.mywebsite.com\nauth:\n  user: USER\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Nil(t, readConfig(path))
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, "USER", viper.GetString("auth.user"))
+	assert.Equal(t, 10, viper.GetInt("poll"))
+}
+
+func TestReadConfigJSON(t *testing.T) {
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "drill.json", `{"url": "https://www.mywebsite.com", "auth": {"user": "USER"}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Nil(t, readConfig(path))
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, "USER", viper.GetString("auth.user"))
+}
+
+func TestReadConfigTOML(t *testing.T) {
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "drill.toml", "url = \"https://www.mywebsite.com\"\n[auth]\nuser = \"USER\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Nil(t, readConfig(path))
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, "USER", viper.GetString("auth.user"))
+}
+
+func TestReadConfigMissingFile(t *testing.T) {
+	defer viper.Reset()
+
+	assert.NotNil(t, readConfig("/does/not/exist.yaml"))
+}
+
+func TestReadConfigEnvOnly(t *testing.T) {
+	defer viper.Reset()
+
+	assert.Nil(t, os.Setenv("AK_URL", "https://www.mywebsite.com"))
+	assert.Nil(t, os.Setenv("AK_AUTH_USER", "USER"))
+	assert.Nil(t, os.Setenv("AK_ASG", "prod"))
+
+	// There is no config.yaml in the working directory
+	assert.Nil(t, readConfig(""))
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, "USER", viper.GetString("auth.user"))
+	assert.Equal(t, "prod", viper.GetString("asg"))
+
+	assert.Nil(t, os.Unsetenv("AK_URL"))
+	assert.Nil(t, os.Unsetenv("AK_AUTH_USER"))
+	assert.Nil(t, os.Unsetenv("AK_ASG"))
+}
+
+func TestReadConfigEnvOverridesFile(t *testing.T) {
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "drill.yaml", "auth:\n  user: USER\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	assert.Nil(t, os.Setenv("AK_AUTH_USER", "ENVUSER"))
+
+	assert.Nil(t, readConfig(path))
+	assert.Equal(t, "ENVUSER", viper.GetString("auth.user"))
+
+	assert.Nil(t, os.Unsetenv("AK_AUTH_USER"))
+}
+
+func TestReadConfigLegacyASGName(t *testing.T) {
+	defer viper.Reset()
+
+	assert.Nil(t, os.Setenv("ASG_NAME", "legacy"))
+
+	assert.Nil(t, readConfig(""))
+	assert.Equal(t, "legacy", viper.GetString("asg"))
+
+	assert.Nil(t, os.Unsetenv("ASG_NAME"))
+}
+
+func TestReadConfigLegacyEnv(t *testing.T) {
+	defer viper.Reset()
+
+	path := writeConfigFile(t, "drill.yaml", "url: https://file.mywebsite.com\nprimary: FILE\n")
+	assert.Nil(t, os.Setenv("URL", "https://www.mywebsite.com"))
+	assert.Nil(t, os.Setenv("PRIMARY", "LEGACY"))
+	assert.Nil(t, os.Setenv("AK_PRIMARY", "PREFIXED"))
+	defer func() {
+		os.Unsetenv("URL")
+		os.Unsetenv("PRIMARY")
+		os.Unsetenv("AK_PRIMARY")
+	}()
+
+	assert.Nil(t, readConfig(path))
+
+	// The legacy variables still override the config file, but the AK_ ones
+	// win over them
+	assert.Equal(t, "https://www.mywebsite.com", viper.GetString("url"))
+	assert.Equal(t, "PREFIXED", viper.GetString("primary"))
+}
+
+func setValidConfig() {
+	viper.Set("asg", "prod")
+	viper.Set("url", "https://www.mywebsite.com")
+	viper.Set("primary", "My Working Site")
+	viper.Set("secondary", "Back soon!")
+	viper.Set("poll", 10)
+	viper.Set("timeout", 600)
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, "prod", cfg.asg)
+	assert.Equal(t, 10*time.Second, cfg.poll)
+	assert.Equal(t, 10*time.Minute, cfg.timeout)
+	assert.Equal(t, 10*time.Second, cfg.auth.HTTP.Timeout)
+}
+
+func TestLoadConfigDurationStrings(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("poll", "30s")
+	viper.Set("timeout", "15m")
+	viper.Set("http.timeout", "5s")
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, cfg.poll)
+	assert.Equal(t, 15*time.Minute, cfg.timeout)
+	assert.Equal(t, 5*time.Second, cfg.auth.HTTP.Timeout)
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("primary", "Same")
+	viper.Set("secondary", "Same")
+	viper.Set("poll", "soon")
+	viper.Set("timeout", -5)
+	viper.Set("auth.mode", "digest")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.NotNil(t, err)
+
+	problems := err.(*configError).problems
+	assert.Equal(t, []string{
+		"poll \"soon\" is not a number of seconds or a duration like 30s",
+		"asg is required",
+		"url is required",
+		"primary and secondary must be different or a failover can't be detected",
+		"poll must be positive, got 0s",
+		"timeout must be positive, got -5s",
+		"auth.mode \"digest\" is unknown, expected none, basic or bearer",
+	}, problems)
+	assert.Contains(t, err.Error(), "invalid config:\n  - poll")
+}
+
+func TestLoadConfigPollNotLessThanTimeout(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("poll", "10m")
+	viper.Set("timeout", "10m")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n  - poll (10m0s) must be less than timeout (10m0s)")
+}
+
+func TestLoadConfigInvalidURL(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("url", "ftp://www.mywebsite.com")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - url \"ftp://www.mywebsite.com\" is not a valid URL")
+}
+
+func TestLoadConfigOnlyChecksWhatIsRequired(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("asg", "prod")
+	viper.Set("poll", 10)
+	viper.Set("timeout", 600)
+
+	_, err := loadConfig(requireASG)
+	assert.Nil(t, err)
+
+	_, err = loadConfig(requireContent)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigAuthModes(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("auth.mode", "basic")
+
+	_, err := loadConfig(requireContent)
+	assert.EqualError(t, err, "invalid config:\n  - auth.user is required for basic auth")
+
+	viper.Set("auth.mode", "bearer")
+	_, err = loadConfig(requireContent)
+	assert.EqualError(t, err, "invalid config:\n  - auth.token is required for bearer auth")
+}
+
+func TestLoadConfigUnreadableSecret(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("auth.passwordFile", "/does/not/exist")
+
+	_, err := loadConfig(requireContent)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "auth.password could not be read")
+}
+
+func TestLoadConfigBuildsContentClientOnce(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+
+	cfg, err := loadConfig(requireContent)
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg.auth.Client)
+}
+
+func TestLoadConfigUnreadableCA(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("tls.ca", "/does/not/exist")
+
+	_, err := loadConfig(requireContent)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the content check client could not be made")
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("45")
+	assert.Nil(t, err)
+	assert.Equal(t, 45*time.Second, d)
+
+	d, err = parseDuration("1m30s")
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, d)
+
+	_, err = parseDuration("soon")
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigPhases(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("standby.timeout", "2m")
+	viper.Set("failover.poll", "30s")
+	viper.Set("failover.timeout", "20m")
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, drill.Phase{Poll: 10 * time.Second, Timeout: 2 * time.Minute}, cfg.phases.Standby)
+	assert.Equal(t, drill.Phase{Poll: 30 * time.Second, Timeout: 20 * time.Minute}, cfg.phases.Failover)
+	assert.Equal(t, drill.Phase{Poll: 10 * time.Second, Timeout: 10 * time.Minute}, cfg.phases.Restore)
+	assert.Equal(t, drill.Phase{Poll: 10 * time.Second, Timeout: 10 * time.Minute}, cfg.phases.Recovery)
+	assert.Equal(t, 42*time.Minute, cfg.phases.Deadline)
+}
+
+func TestLoadConfigInvalidPhase(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("restore.poll", "5m")
+	viper.Set("restore.timeout", "1m")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n  - restore.poll (5m0s) must be less than restore.timeout (1m0s)")
+}
+
+func TestLoadConfigDeadlineTooShort(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("deadline", "30m")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n  - the phase timeouts add up to 40m0s, more than the deadline (30m0s)")
+}
+
+func TestLoadConfigHold(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("failover.poll", "30s")
+	viper.Set("hold.duration", "15m")
+	viper.Set("hold.budget", 2)
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, drill.Hold{Duration: 15 * time.Minute, Poll: 30 * time.Second, Budget: 2}, cfg.phases.Hold)
+	assert.Equal(t, 55*time.Minute, cfg.phases.Deadline)
+}
+
+func TestLoadConfigInvalidHold(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("hold.duration", "1m")
+	viper.Set("hold.poll", "2m")
+	viper.Set("hold.budget", -1)
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - hold.poll (2m0s) must be less than hold.duration (1m0s)\n"+
+		"  - hold.budget must not be negative, got -1")
+}
+
+func TestLoadConfigLock(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, lockBackendASGTag, cfg.lock.backend)
+	assert.Equal(t, 80*time.Minute, cfg.lock.ttl)
+}
+
+func TestLoadConfigInvalidLock(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("lock.backend", "zookeeper")
+	viper.Set("lock.ttl", -1)
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - lock.backend \"zookeeper\" is unknown, expected asg-tag, file or none\n"+
+		"  - lock.ttl must not be negative, got -1s")
+}
+
+func TestLoadConfigInvalidPushgateway(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("metrics.pushgateway", "pushgateway:9091")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - metrics.pushgateway \"pushgateway:9091\" is not a valid URL")
+}
+
+func TestLoadConfigTracing(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("tracing.exporter", "file")
+	viper.Set("tracing.file", "traces.jsonl")
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, &fileExporter{path: "traces.jsonl"}, cfg.tracing)
+}
+
+func TestLoadConfigInvalidTracing(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("tracing.exporter", "jaeger")
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - tracing.exporter \"jaeger\" is unknown, expected none, otlp or file")
+}
+
+func TestLoadConfigScripts(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("primary", "")
+	viper.Set("scripts.primary", map[string]interface{}{
+		"name": "checkout",
+		"steps": []map[string]interface{}{
+			{
+				"name":    "login",
+				"method":  "POST",
+				"url":     "/login",
+				"body":    "user=drill",
+				"capture": map[string]string{"token": `name="token" value="(\w+)"`},
+				"status":  200,
+			},
+			{"url": "/checkout/${token}", "contains": []string{"Order placed"}},
+		},
+	})
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.scripts.secondary)
+	assert.Equal(t, &contentcheck.Script{
+		Name: "checkout",
+		Steps: []contentcheck.Step{
+			{
+				Name:    "login",
+				Method:  "POST",
+				URL:     "/login",
+				Body:    "user=drill",
+				Capture: map[string]string{"token": `name="token" value="(\w+)"`},
+				Status:  200,
+			},
+			{URL: "/checkout/${token}", Contains: []string{"Order placed"}},
+		},
+	}, cfg.scripts.primary)
+}
+
+func TestLoadConfigScriptNamedForItsExpectation(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("scripts.secondary", map[string]interface{}{
+		"steps": []map[string]interface{}{{"url": "/"}},
+	})
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, "secondary", cfg.scripts.secondary.Name)
+}
+
+func TestLoadConfigInvalidScripts(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("primary", "")
+	viper.Set("secondary", "")
+	viper.Set("scripts.secondary", map[string]interface{}{
+		"steps": []map[string]interface{}{{"name": "home"}},
+	})
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - scripts.secondary home has no url\n"+
+		"  - primary or scripts.primary is required")
+}
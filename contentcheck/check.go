@@ -0,0 +1,219 @@
+// Package contentcheck looks for the expected content at the site's URL,
+// once, until it appears, or for as long as it should stay.
+package contentcheck
+
+import (
+	"io/ioutil"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// Func checks for the content at the URL, returning 0 if it is there
+type Func func(content string, u string, auth Auth) int
+
+// Result is what a content check found. The status code is 0 if there was
+// no response.
+type Result struct {
+	StatusCode int
+	RemoteAddr string
+	Matched    bool
+	Err        error
+}
+
+// Check requests the URL and looks for the content in the response
+func Check(content string, u string, auth Auth) Result {
+	log.WithFields(log.Fields{
+		"url":     u,
+		"content": content,
+	}).Debug("Check")
+
+	_, err := neturl.ParseRequestURI(u)
+	if err != nil {
+		log.
+			WithError(err).
+			WithField("url", u).
+			Error("Could not parse the URL")
+		return Result{Err: err}
+	}
+
+	res, remoteAddr, err := Get(u, auth)
+	if err != nil {
+		log.
+			WithError(err).
+			WithField("url", u).
+			Error("Could not get the URL")
+		return Result{Err: err}
+	}
+	defer res.Body.Close()
+
+	result := Result{StatusCode: res.StatusCode, RemoteAddr: remoteAddr}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(log.Fields{
+				"url":    u,
+				"status": res.StatusCode,
+			}).
+			Error("Could not read the response body")
+		result.Err = err
+		return result
+	}
+
+	result.Matched = strings.Contains(string(body), content)
+	if !result.Matched {
+		// Only the status is logged from the response, as its request
+		// carries the auth and custom headers
+		log.WithFields(log.Fields{
+			"status": res.StatusCode,
+			"body":   string(body),
+		}).Debug("Did not find the expected content at the failover url")
+		log.WithFields(log.Fields{
+			"content":    content,
+			"remoteAddr": remoteAddr,
+		}).Warn("Did not find the expected content at the failover url")
+		return result
+	}
+
+	log.WithFields(log.Fields{
+		"content":    content,
+		"url":        u,
+		"remoteAddr": remoteAddr,
+	}).Info("Found the expected content")
+	return result
+}
+
+// Found is the Func for a plain Check
+func Found(content string, u string, auth Auth) int {
+	if Check(content, u, auth).Matched {
+		return 0
+	}
+
+	return 1
+}
+
+// Poll checks for the content every poll on the clock until it is found,
+// returning 1 if it isn't by the timeout or abort is closed first. The time
+// the checks take counts towards the timeout, so slow checks leave room for
+// fewer of them.
+func Poll(
+	c clock.Clock,
+	content string,
+	u string,
+	auth Auth,
+	poll time.Duration,
+	timeout time.Duration,
+	check Func,
+	abort <-chan struct{},
+) int {
+	start := c.Now()
+	for attempt := 0; timeout > 0; attempt++ {
+		if attempt > 0 {
+			// The next check has to start inside the timeout, without a
+			// poll there is only time for the one
+			if poll <= 0 || c.Now().Sub(start)+poll >= timeout {
+				break
+			}
+
+			if !clock.SleepUnlessAborted(c, poll, abort) {
+				log.Warn("Content check polling aborted")
+				return 1
+			}
+		}
+
+		log.WithField("poll", attempt).Debug("Poll for content check")
+		if check(content, u, auth) == 0 {
+			log.Info("Content check polling finished")
+			return 0
+		}
+	}
+
+	log.Warn("Content check polling timed out")
+	return 1
+}
+
+// Unknown is returned by a hold's assertion when it couldn't tell whether the
+// stack is healthy, e.g. because the API it reads failed
+type Unknown struct {
+	Err error
+}
+
+func (u Unknown) Error() string {
+	return u.Err.Error()
+}
+
+// Hold keeps checking for the content for the duration, failing as soon as
+// more checks have missed it than the budget allows. Any assertion, e.g. on
+// the health of the stack serving it, is made on every check too and fails
+// the hold straight away, as does abort being closed. An assertion that
+// returns Unknown counts against the budget instead.
+func Hold(
+	c clock.Clock,
+	content string,
+	u string,
+	auth Auth,
+	poll time.Duration,
+	duration time.Duration,
+	budget int,
+	check Func,
+	assert func() error,
+	abort <-chan struct{},
+) int {
+	log.WithFields(log.Fields{
+		"duration": duration,
+		"budget":   budget,
+	}).Info("Holding the failover")
+
+	var pollIteration int64
+	failures := 0
+
+	for {
+		if pollIteration >= clock.Attempts(duration, poll) {
+			break
+		}
+
+		if check(content, u, auth) != 0 {
+			failures++
+			log.WithFields(log.Fields{
+				"failures": failures,
+				"budget":   budget,
+			}).Warn("The secondary content was missing during the hold")
+		}
+
+		if assert != nil {
+			err := assert()
+			if _, unknown := err.(Unknown); unknown {
+				failures++
+				log.WithError(err).WithFields(log.Fields{
+					"failures": failures,
+					"budget":   budget,
+				}).Warn("Could not check the secondary stack during the hold")
+			} else if err != nil {
+				log.WithError(err).Error("The secondary stack was unhealthy during the hold")
+				return 1
+			}
+		}
+
+		if failures > budget {
+			log.WithFields(log.Fields{
+				"failures": failures,
+				"budget":   budget,
+			}).Error("The failover did not hold")
+			return 1
+		}
+
+		if !clock.SleepUnlessAborted(c, poll, abort) {
+			log.Warn("The hold was aborted")
+			return 1
+		}
+		pollIteration++
+	}
+
+	log.WithField("failures", failures).Info("The failover held")
+	return 0
+}
@@ -0,0 +1,297 @@
+package contentcheck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.PanicLevel)
+	os.Exit(m.Run())
+}
+
+// testClock is a fake clock for the tests to poll by
+func testClock() *clock.Fake {
+	return clock.NewFake(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC))
+}
+
+func TestCheckInvalidURL(t *testing.T) {
+	res := Check("test", "Invalid", Auth{})
+	assert.NotNil(t, res.Err)
+	assert.False(t, res.Matched)
+	assert.Equal(t, 1, Found("test", "Invalid", Auth{}))
+}
+
+func TestCheckIncorrectContent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "not matching")
+	}))
+	defer ts.Close()
+
+	res := Check("test", ts.URL, Auth{})
+	assert.Nil(t, res.Err)
+	assert.False(t, res.Matched)
+	assert.Equal(t, 1, Found("test", ts.URL, Auth{}))
+}
+
+func TestCheckDoesNotLogTheRequestHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "not matching")
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.PanicLevel)
+	}()
+
+	auth := Auth{Token: "secret-token", HTTP: HTTPOptions{
+		Headers: map[string]string{"X-Api-Key": "secret-key"},
+	}}
+	res := Check("test", ts.URL, auth)
+	assert.False(t, res.Matched)
+	assert.Contains(t, out.String(), "status=200")
+	assert.NotContains(t, out.String(), "secret-token")
+	assert.NotContains(t, out.String(), "secret-key")
+}
+
+func TestCheckCorrectContent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "matching")
+	}))
+	defer ts.Close()
+
+	res := Check("matching", ts.URL, Auth{})
+	assert.Equal(t, Result{
+		StatusCode: http.StatusOK,
+		RemoteAddr: ts.Listener.Addr().String(),
+		Matched:    true,
+	}, res)
+	assert.Equal(t, 0, Found("matching", ts.URL, Auth{}))
+}
+
+func TestPollSuccessNoPoll(t *testing.T) {
+	check := func(content string, url string, auth Auth) int {
+		return 0
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 3*time.Millisecond, check, nil)
+	assert.Equal(t, 0, res)
+}
+
+func TestPollSuccessPoll(t *testing.T) {
+	poll := 0
+	check := func(content string, url string, auth Auth) int {
+		poll++
+		if poll == 2 {
+			return 0
+		}
+		return 1
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, check, nil)
+	assert.Equal(t, 0, res)
+}
+
+func TestPollTimeout(t *testing.T) {
+	check := func(content string, url string, auth Auth) int {
+		return 1
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, check, nil)
+	assert.Equal(t, 1, res)
+}
+
+func TestPollAborted(t *testing.T) {
+	abort := make(chan struct{})
+	close(abort)
+	check := func(string, string, Auth) int { return 1 }
+
+	c := testClock()
+	res := Poll(c, "test", "url", Auth{}, time.Millisecond, time.Minute, check, abort)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, time.Duration(0), c.Elapsed())
+}
+
+func TestPollTimeoutNotDivisibleByPoll(t *testing.T) {
+	c := testClock()
+
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		return 1
+	}
+
+	res := Poll(c, "test", "url", Auth{}, 3*time.Minute, 10*time.Minute, check, nil)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 4, checks)
+	assert.Equal(t, 9*time.Minute, c.Elapsed())
+}
+
+func TestPollSlowChecks(t *testing.T) {
+	c := testClock()
+
+	// Each check takes as long as the poll
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		c.Sleep(time.Minute)
+		return 1
+	}
+
+	res := Poll(c, "test", "url", Auth{}, time.Minute, 5*time.Minute, check, nil)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 3, checks)
+	assert.Equal(t, 5*time.Minute, c.Elapsed())
+}
+
+func TestPollZeroTimeout(t *testing.T) {
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		return 0
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, time.Minute, 0, check, nil)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 0, checks)
+}
+
+func TestPollSuccessOnLastTick(t *testing.T) {
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		if checks == 5 {
+			return 0
+		}
+		return 1
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, time.Minute, 5*time.Minute, check, nil)
+	assert.Equal(t, 0, res)
+}
+
+func TestPollZeroPoll(t *testing.T) {
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		return 1
+	}
+
+	res := Poll(testClock(), "test", "url", Auth{}, 0, time.Minute, check, nil)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 1, checks)
+}
+
+func TestHoldHolds(t *testing.T) {
+	checks := 0
+	check := func(content string, url string, auth Auth) int {
+		checks++
+		return 0
+	}
+
+	res := Hold(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, 0, check, nil, nil)
+	assert.Equal(t, 0, res)
+	assert.Equal(t, 5, checks)
+}
+
+func TestHoldWithinBudget(t *testing.T) {
+	checks := 0
+	check := func(content string, url string, auth Auth) int {
+		checks++
+		if checks == 2 || checks == 4 {
+			return 1
+		}
+		return 0
+	}
+
+	res := Hold(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, 2, check, nil, nil)
+	assert.Equal(t, 0, res)
+}
+
+func TestHoldOverBudget(t *testing.T) {
+	checks := 0
+	check := func(content string, url string, auth Auth) int {
+		checks++
+		return 1
+	}
+
+	res := Hold(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, 1, check, nil, nil)
+	assert.Equal(t, 1, res)
+
+	// It gives up as soon as the budget is spent
+	assert.Equal(t, 2, checks)
+}
+
+func TestHoldUnhealthy(t *testing.T) {
+	checks := 0
+	res := Hold(testClock(), "test", "url", Auth{}, 1*time.Millisecond, 5*time.Millisecond, 2,
+		func(string, string, Auth) int { return 0 },
+		func() error {
+			checks++
+			return errors.New("alarm secondary-5xx is firing")
+		},
+		nil)
+
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 1, checks)
+}
+
+func TestHoldUnknownCountsAgainstTheBudget(t *testing.T) {
+	asserts := 0
+	assertion := func() error {
+		asserts++
+		if asserts <= 2 {
+			return Unknown{errors.New("throttled")}
+		}
+		return nil
+	}
+	check := func(string, string, Auth) int { return 0 }
+
+	c := testClock()
+	res := Hold(c, "test", "url", Auth{}, time.Minute, 5*time.Minute, 2, check, assertion, nil)
+	assert.Equal(t, 0, res)
+	assert.Equal(t, 5, asserts)
+
+	asserts = 0
+	res = Hold(c, "test", "url", Auth{}, time.Minute, 5*time.Minute, 1, check, assertion, nil)
+	assert.Equal(t, 1, res)
+	assert.Equal(t, 2, asserts)
+}
+
+func TestHoldAborted(t *testing.T) {
+	abort := make(chan struct{})
+	close(abort)
+	check := func(string, string, Auth) int { return 0 }
+
+	res := Hold(testClock(), "test", "url", Auth{}, time.Minute, time.Hour, 0, check, nil, abort)
+	assert.Equal(t, 1, res)
+}
+
+func TestHoldTakesTheDuration(t *testing.T) {
+	c := testClock()
+
+	checks := 0
+	check := func(string, string, Auth) int {
+		checks++
+		return 0
+	}
+
+	res := Hold(c, "test", "url", Auth{}, time.Minute, time.Hour, 0, check, nil, nil)
+	assert.Equal(t, 0, res)
+	assert.Equal(t, 60, checks)
+	assert.Equal(t, time.Hour, c.Elapsed())
+}
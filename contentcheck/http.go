@@ -0,0 +1,285 @@
+package contentcheck
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	neturl "net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxRedirects is how many redirects are followed unless told otherwise
+const DefaultMaxRedirects = 10
+
+// Auth modes for the content checks. The default picks bearer if there is a
+// token, basic if there is a user and otherwise none.
+const (
+	AuthModeAuto   = ""
+	AuthModeNone   = "none"
+	AuthModeBasic  = "basic"
+	AuthModeBearer = "bearer"
+)
+
+// Auth holds everything needed to make the content check requests
+type Auth struct {
+	Mode     string
+	User     string
+	Password string
+	Token    string
+	Insecure bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	HTTP     HTTPOptions
+
+	// Client makes the requests when set, e.g. built once for a drill by
+	// NewClient so the connections and TLS material are reused. Without it
+	// each check builds a client of its own that keeps no connections open.
+	Client *http.Client
+}
+
+// HTTPOptions shape the content check requests
+type HTTPOptions struct {
+	Timeout      time.Duration
+	Headers      map[string]string
+	Host         string
+	UserAgent    string
+	CacheBust    string
+	Proxy        string
+	NoRedirects  bool
+	MaxRedirects int
+	// Fresh opens a new connection for every check and asks any caches on
+	// the way not to answer, so each check reaches the current target
+	Fresh bool
+}
+
+// NewClient makes the client for the content check requests
+func NewClient(auth Auth) (*http.Client, error) {
+	client := &http.Client{
+		Timeout:       auth.HTTP.Timeout,
+		CheckRedirect: getRedirectPolicy(auth.HTTP),
+	}
+
+	if !needsCustomTransport(auth) {
+		return client, nil
+	}
+
+	tlsConfig, err := getTLSConfig(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: auth.HTTP.Fresh,
+	}
+
+	if auth.HTTP.Proxy != "" {
+		proxyURL, err := neturl.Parse(auth.HTTP.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	client.Transport = tr
+
+	return client, nil
+}
+
+func needsCustomTransport(auth Auth) bool {
+	return auth.Insecure ||
+		auth.CAFile != "" ||
+		auth.CertFile != "" ||
+		auth.HTTP.Proxy != "" ||
+		auth.HTTP.Fresh
+}
+
+func getTLSConfig(auth Auth) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: auth.Insecure}
+
+	if auth.CAFile != "" {
+		pem, err := ioutil.ReadFile(auth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", auth.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if auth.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func getRedirectPolicy(
+	options HTTPOptions) func(*http.Request, []*http.Request) error {
+	if options.NoRedirects {
+		return func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	maxRedirects := options.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// NewRequest makes a content check request for the URL
+func NewRequest(u string, auth Auth) (*http.Request, error) {
+	return newRequest(http.MethodGet, u, nil, auth)
+}
+
+func newRequest(method string, u string, body io.Reader, auth Auth) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.HTTP.CacheBust != "" {
+		value, err := randomHex(8)
+		if err != nil {
+			return nil, err
+		}
+
+		query := req.URL.Query()
+		query.Set(auth.HTTP.CacheBust, value)
+		req.URL.RawQuery = query.Encode()
+	}
+
+	if auth.HTTP.Fresh {
+		req.Close = true
+		req.Header.Set("Cache-Control", "no-cache, no-store")
+		req.Header.Set("Pragma", "no-cache")
+	}
+
+	switch AuthMode(auth) {
+	case AuthModeBearer:
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	case AuthModeBasic:
+		req.SetBasicAuth(auth.User, auth.Password)
+	}
+
+	if auth.HTTP.UserAgent != "" {
+		req.Header.Set("User-Agent", auth.HTTP.UserAgent)
+	}
+
+	for name, value := range auth.HTTP.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if auth.HTTP.Host != "" {
+		req.Host = auth.HTTP.Host
+	}
+
+	return req, nil
+}
+
+// clientFor returns the auth's client, or a new one for a single check
+func clientFor(auth Auth) (*http.Client, error) {
+	if auth.Client != nil {
+		return auth.Client, nil
+	}
+
+	client, err := NewClient(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing reuses the connections, so they'd sit idle until the server
+	// closed them
+	if tr, ok := client.Transport.(*http.Transport); ok {
+		tr.DisableKeepAlives = true
+	}
+
+	return client, nil
+}
+
+// Get makes the content check request, also returning the address of the
+// server that answered it
+func Get(u string, auth Auth) (*http.Response, string, error) {
+	req, err := NewRequest(u, auth)
+	if err != nil {
+		log.WithError(err).Error("Creating request")
+		return nil, "", err
+	}
+
+	client, err := clientFor(auth)
+	if err != nil {
+		log.WithError(err).Error("Creating HTTP client")
+		return nil, "", err
+	}
+
+	remoteAddr := ""
+	response, err := client.Do(traceRemoteAddr(req, &remoteAddr))
+	if err != nil {
+		log.WithError(err).Error("Request")
+	}
+
+	return response, remoteAddr, err
+}
+
+// traceRemoteAddr records the address of the server that answers the request
+func traceRemoteAddr(req *http.Request, remoteAddr *string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			*remoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// AuthMode is the auth mode the requests use, picking one if it isn't set
+func AuthMode(auth Auth) string {
+	if auth.Mode != AuthModeAuto {
+		return auth.Mode
+	}
+
+	if auth.Token != "" {
+		return AuthModeBearer
+	}
+
+	if auth.User != "" {
+		return AuthModeBasic
+	}
+
+	return AuthModeNone
+}
@@ -0,0 +1,312 @@
+package contentcheck
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRequestHeaders(t *testing.T) {
+	auth := Auth{
+		HTTP: HTTPOptions{
+			Headers:   map[string]string{"X-Drill": "true"},
+			Host:      "www.mywebsite.com",
+			UserAgent: "Anarchy-Kitten",
+			CacheBust: "ak",
+		},
+	}
+
+	req, err := NewRequest("http://localhost/path?a=b", auth)
+	assert.Nil(t, err)
+	assert.Equal(t, "true", req.Header.Get("X-Drill"))
+	assert.Equal(t, "www.mywebsite.com", req.Host)
+	assert.Equal(t, "Anarchy-Kitten", req.Header.Get("User-Agent"))
+	assert.Equal(t, "b", req.URL.Query().Get("a"))
+	assert.NotEqual(t, "", req.URL.Query().Get("ak"))
+}
+
+func TestNewRequestBearerToken(t *testing.T) {
+	auth := Auth{User: "USER", Password: "PASSWORD", Token: "TOKEN"}
+
+	req, err := NewRequest("http://localhost", auth)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer TOKEN", req.Header.Get("Authorization"))
+}
+
+func TestNewRequestBasicAuth(t *testing.T) {
+	auth := Auth{User: "USER", Password: "PASSWORD"}
+
+	req, err := NewRequest("http://localhost", auth)
+	assert.Nil(t, err)
+	user, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "USER", user)
+	assert.Equal(t, "PASSWORD", password)
+}
+
+func TestGetTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	auth := Auth{HTTP: HTTPOptions{Timeout: 5 * time.Millisecond}}
+	_, _, err := Get(ts.URL, auth)
+	assert.NotNil(t, err)
+}
+
+func TestGetNoRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	auth := Auth{HTTP: HTTPOptions{NoRedirects: true}}
+	resp, _, err := Get(ts.URL, auth)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestGetMaxRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/again", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	auth := Auth{HTTP: HTTPOptions{MaxRedirects: 2}}
+	_, _, err := Get(ts.URL, auth)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stopped after 2 redirects")
+}
+
+func TestGetProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "proxied "+r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	auth := Auth{HTTP: HTTPOptions{Proxy: proxy.URL}}
+	resp, _, err := Get("http://www.mywebsite.com", auth)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "proxied www.mywebsite.com\n", string(body))
+}
+
+func TestGetCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "matching")
+	}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "ca")
+	assert.Nil(t, err)
+	defer os.Remove(caFile.Name())
+
+	err = pem.Encode(caFile, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.TLS.Certificates[0].Certificate[0],
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, caFile.Close())
+
+	// Without the CA bundle the self signed certificate is rejected
+	_, _, err = Get(ts.URL, Auth{})
+	assert.NotNil(t, err)
+
+	resp, _, err := Get(ts.URL, Auth{CAFile: caFile.Name()})
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestGetTLSConfigInvalidCA(t *testing.T) {
+	caFile, err := ioutil.TempFile("", "ca")
+	assert.Nil(t, err)
+	defer os.Remove(caFile.Name())
+	assert.Nil(t, caFile.Close())
+
+	_, err = getTLSConfig(Auth{CAFile: caFile.Name()})
+	assert.EqualError(
+		t,
+		err,
+		fmt.Sprintf("no certificates found in %s", caFile.Name()))
+}
+
+func TestGetTLSConfigMissingClientCertificate(t *testing.T) {
+	_, err := getTLSConfig(Auth{
+		CertFile: "/does/not/exist.crt",
+		KeyFile:  "/does/not/exist.key",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestGetTLSConfigInsecure(t *testing.T) {
+	tlsConfig, err := getTLSConfig(Auth{Insecure: true})
+	assert.Nil(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+}
+
+func TestNewRequestFresh(t *testing.T) {
+	auth := Auth{HTTP: HTTPOptions{Fresh: true}}
+
+	req, err := NewRequest("http://localhost", auth)
+	assert.Nil(t, err)
+	assert.True(t, req.Close)
+	assert.Equal(t, "no-cache, no-store", req.Header.Get("Cache-Control"))
+	assert.Equal(t, "no-cache", req.Header.Get("Pragma"))
+}
+
+func TestNewRequestCacheBustIsRandom(t *testing.T) {
+	auth := Auth{HTTP: HTTPOptions{CacheBust: "ak"}}
+
+	first, err := NewRequest("http://localhost", auth)
+	assert.Nil(t, err)
+	second, err := NewRequest("http://localhost", auth)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 16, len(first.URL.Query().Get("ak")))
+	assert.NotEqual(t, first.URL.Query().Get("ak"), second.URL.Query().Get("ak"))
+}
+
+func TestGetFreshConnections(t *testing.T) {
+	remoteAddrs := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs[r.RemoteAddr] = true
+	}))
+	defer ts.Close()
+
+	auth := Auth{HTTP: HTTPOptions{Fresh: true}}
+	for i := 0; i < 3; i++ {
+		resp, _, err := Get(ts.URL, auth)
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	// Every check came in on its own connection
+	assert.Equal(t, 3, len(remoteAddrs))
+}
+
+func TestGetSharedClientReusesConnections(t *testing.T) {
+	remoteAddrs := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs[r.RemoteAddr] = true
+	}))
+	defer ts.Close()
+
+	auth := Auth{Insecure: true}
+	client, err := NewClient(auth)
+	assert.Nil(t, err)
+	auth.Client = client
+
+	for i := 0; i < 3; i++ {
+		resp, _, err := Get(ts.URL, auth)
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, 1, len(remoteAddrs))
+}
+
+func TestClientForOneOffKeepsNoConnections(t *testing.T) {
+	client, err := clientFor(Auth{Insecure: true})
+	assert.Nil(t, err)
+	assert.True(t, client.Transport.(*http.Transport).DisableKeepAlives)
+
+	shared, err := NewClient(Auth{Insecure: true})
+	assert.Nil(t, err)
+	client, err = clientFor(Auth{Insecure: true, Client: shared})
+	assert.Nil(t, err)
+	assert.True(t, shared == client)
+	assert.False(t, client.Transport.(*http.Transport).DisableKeepAlives)
+}
+
+func TestGetRemoteAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "matching")
+	}))
+	defer ts.Close()
+
+	resp, remoteAddr, err := Get(ts.URL, Auth{})
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, ts.Listener.Addr().String(), remoteAddr)
+}
+
+func TestAuthMode(t *testing.T) {
+	assert.Equal(t, AuthModeNone, AuthMode(Auth{}))
+	assert.Equal(t, AuthModeBasic, AuthMode(Auth{User: "USER"}))
+	assert.Equal(t, AuthModeBearer, AuthMode(Auth{User: "USER", Token: "TOKEN"}))
+	assert.Equal(t, AuthModeBasic, AuthMode(Auth{Mode: "basic", User: "USER", Token: "TOKEN"}))
+	assert.Equal(t, AuthModeNone, AuthMode(Auth{Mode: "none", User: "USER"}))
+}
+
+func TestGetSecureNoAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "matching")
+	}))
+	defer ts.Close()
+
+	resp, _, err := Get(ts.URL, Auth{})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "matching\n", string(body))
+}
+
+func TestGetSecureAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "USER", user)
+		assert.Equal(t, "PASSWORD", password)
+	}))
+	defer ts.Close()
+
+	resp, _, err := Get(ts.URL, Auth{User: "USER", Password: "PASSWORD"})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestGetInsecureAuth(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "USER", user)
+		assert.Equal(t, "PASSWORD", password)
+	}))
+	defer ts.Close()
+
+	resp, _, err := Get(ts.URL, Auth{User: "USER", Password: "PASSWORD", Insecure: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestGetTLSInsecureNoAuth(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "matching")
+	}))
+	defer ts.Close()
+
+	resp, _, err := Get(ts.URL, Auth{Insecure: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "matching\n", string(body))
+}
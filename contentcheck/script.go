@@ -0,0 +1,286 @@
+package contentcheck
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	neturl "net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Script is a synthetic transaction, e.g. logging in, searching and checking
+// out, for when the site working means more than one page having the right
+// content. The steps are made in order as one visitor, so cookies set by
+// one step are sent with the next.
+type Script struct {
+	Name  string
+	Steps []Step
+}
+
+// Step is one request in a script. The URL is relative to the site's URL
+// unless it is absolute. ${name} in the URL, body or headers is replaced
+// with what an earlier step captured as name.
+type Step struct {
+	Name    string
+	Method  string
+	URL     string
+	Body    string
+	Headers map[string]string
+
+	// Capture maps a name to a regular expression matched against the
+	// response body, keeping its first group, or the whole match if it
+	// has none, for the later steps
+	Capture map[string]string
+
+	// The status code expected, any below 400 when 0
+	Status int
+	// Contains must all be in the response body, Excludes none of it
+	Contains []string
+	Excludes []string
+}
+
+// ScriptFunc runs the script against the URL, returning 0 if it passed
+type ScriptFunc func(s *Script, u string, auth Auth) int
+
+// ScriptResult is how far a script got. Step is the step that failed, and
+// the status code and address are from its response, or the last one if
+// every step passed.
+type ScriptResult struct {
+	Passed     int
+	Step       string
+	StatusCode int
+	RemoteAddr string
+	Err        error
+}
+
+var captureRef = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// Validate checks the script can be run, without making any requests
+func (s *Script) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("has no steps")
+	}
+
+	for i, step := range s.Steps {
+		if step.URL == "" {
+			return fmt.Errorf("%s has no url", step.label(i))
+		}
+
+		for name, expr := range step.Capture {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%s can't capture %s: %s", step.label(i), name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run makes each step's request in turn, stopping at the first that fails
+func (s *Script) Run(u string, auth Auth) ScriptResult {
+	log.WithFields(log.Fields{
+		"url":    u,
+		"script": s.Name,
+	}).Debug("Run script")
+
+	base, err := neturl.ParseRequestURI(u)
+	if err != nil {
+		log.
+			WithError(err).
+			WithField("url", u).
+			Error("Could not parse the URL")
+		return ScriptResult{Err: err}
+	}
+
+	shared, err := clientFor(auth)
+	if err != nil {
+		log.WithError(err).Error("Creating HTTP client")
+		return ScriptResult{Err: err}
+	}
+
+	// Each run has cookies of its own, over the shared connections
+	client := *shared
+	client.Jar, err = cookiejar.New(nil)
+	if err != nil {
+		return ScriptResult{Err: err}
+	}
+
+	result := ScriptResult{}
+	captures := map[string]string{}
+	for i, step := range s.Steps {
+		result.Step = step.label(i)
+		result.StatusCode = 0
+		result.RemoteAddr = ""
+
+		err = step.run(&client, base, auth, captures, &result)
+		if err != nil {
+			result.Err = fmt.Errorf("%s: %s", result.Step, err)
+			log.
+				WithError(err).
+				WithFields(log.Fields{
+					"script":     s.Name,
+					"step":       result.Step,
+					"remoteAddr": result.RemoteAddr,
+				}).
+				Warn("The script failed")
+			return result
+		}
+
+		result.Passed++
+	}
+
+	result.Step = ""
+	log.WithFields(log.Fields{
+		"script":     s.Name,
+		"url":        u,
+		"remoteAddr": result.RemoteAddr,
+	}).Info("The script passed")
+
+	return result
+}
+
+// Passed is the ScriptFunc for a plain Run
+func Passed(s *Script, u string, auth Auth) int {
+	if s.Run(u, auth).Err == nil {
+		return 0
+	}
+
+	return 1
+}
+
+// Func checks with the script rather than looking for the content, so it
+// can stand in for either of the drill's expectations
+func (s *Script) Func(run ScriptFunc) Func {
+	return func(content string, u string, auth Auth) int {
+		return run(s, u, auth)
+	}
+}
+
+func (step Step) label(i int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+
+	return fmt.Sprintf("step %d", i+1)
+}
+
+func (step Step) run(
+	client *http.Client,
+	base *neturl.URL,
+	auth Auth,
+	captures map[string]string,
+	result *ScriptResult,
+) error {
+	ref, err := expand(step.URL, captures)
+	if err != nil {
+		return err
+	}
+
+	u, err := base.Parse(ref)
+	if err != nil {
+		return err
+	}
+
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if step.Body != "" {
+		text, err := expand(step.Body, captures)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(text)
+	}
+
+	req, err := newRequest(strings.ToUpper(method), u.String(), body, auth)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range step.Headers {
+		value, err = expand(value, captures)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(name, value)
+	}
+
+	res, err := client.Do(traceRemoteAddr(req, &result.RemoteAddr))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	result.StatusCode = res.StatusCode
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	text := string(b)
+
+	switch {
+	case step.Status == 0 && res.StatusCode >= 400:
+		return fmt.Errorf("got %s", res.Status)
+	case step.Status != 0 && res.StatusCode != step.Status:
+		return fmt.Errorf("expected the status %d but got %s", step.Status, res.Status)
+	}
+
+	for _, content := range step.Contains {
+		if !strings.Contains(text, content) {
+			return fmt.Errorf("did not find %q", content)
+		}
+	}
+
+	for _, content := range step.Excludes {
+		if strings.Contains(text, content) {
+			return fmt.Errorf("found %q", content)
+		}
+	}
+
+	for name, expr := range step.Capture {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+
+		match := re.FindStringSubmatch(text)
+		switch {
+		case match == nil:
+			return fmt.Errorf("could not capture %s, nothing matched %q", name, expr)
+		case len(match) > 1:
+			captures[name] = match[1]
+		default:
+			captures[name] = match[0]
+		}
+	}
+
+	return nil
+}
+
+// expand replaces each ${name} with what was captured as name
+func expand(text string, captures map[string]string) (string, error) {
+	var missing string
+	expanded := captureRef.ReplaceAllStringFunc(text, func(ref string) string {
+		name := captureRef.FindStringSubmatch(ref)[1]
+		value, ok := captures[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("nothing has been captured as %s", missing)
+	}
+
+	return expanded, nil
+}
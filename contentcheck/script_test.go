@@ -0,0 +1,173 @@
+package contentcheck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shop logs a visitor in, then lets them check out with the token from the
+// basket page
+func shop() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("user") != "drill" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		fmt.Fprintln(w, "Welcome back")
+	})
+	mux.HandleFunc("/basket", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, `<input name="token" value="t123">`)
+	})
+	mux.HandleFunc("/checkout/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/checkout/t123" || string(body) != "token=t123" || r.Header.Get("X-Token") != "t123" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Order placed")
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func checkout() *Script {
+	return &Script{
+		Name: "checkout",
+		Steps: []Step{
+			{
+				Name:     "login",
+				Method:   "post",
+				URL:      "/login",
+				Body:     "user=drill",
+				Headers:  map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+				Contains: []string{"Welcome"},
+			},
+			{
+				URL:     "/basket",
+				Capture: map[string]string{"token": `name="token" value="(\w+)"`},
+			},
+			{
+				Name:     "checkout",
+				Method:   "POST",
+				URL:      "/checkout/${token}",
+				Body:     "token=${token}",
+				Headers:  map[string]string{"X-Token": "${token}"},
+				Status:   http.StatusOK,
+				Contains: []string{"Order placed"},
+				Excludes: []string{"Out of stock"},
+			},
+		},
+	}
+}
+
+func TestScriptRun(t *testing.T) {
+	ts := shop()
+	defer ts.Close()
+
+	res := checkout().Run(ts.URL, Auth{})
+	assert.Nil(t, res.Err)
+	assert.Equal(t, 3, res.Passed)
+	assert.Equal(t, "", res.Step)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, ts.Listener.Addr().String(), res.RemoteAddr)
+	assert.Equal(t, 0, Passed(checkout(), ts.URL, Auth{}))
+}
+
+func TestScriptRunFails(t *testing.T) {
+	ts := shop()
+	defer ts.Close()
+
+	tests := []struct {
+		change func(s *Script)
+		passed int
+		err    string
+	}{
+		{
+			func(s *Script) { s.Steps[0].Body = "user=someone" },
+			0,
+			"login: got 403 Forbidden",
+		},
+		{
+			func(s *Script) { s.Steps[0].Contains = []string{"Goodbye"} },
+			0,
+			`login: did not find "Goodbye"`,
+		},
+		{
+			func(s *Script) { s.Steps[0].Status = http.StatusCreated },
+			0,
+			"login: expected the status 201 but got 200 OK",
+		},
+		{
+			func(s *Script) { s.Steps[1].Capture = map[string]string{"token": `name="csrf"`} },
+			1,
+			`step 2: could not capture token, nothing matched "name=\"csrf\""`,
+		},
+		{
+			func(s *Script) { s.Steps[2].Excludes = []string{"Order"} },
+			2,
+			`checkout: found "Order"`,
+		},
+		{
+			func(s *Script) { s.Steps = s.Steps[1:] },
+			0,
+			"step 1: got 401 Unauthorized",
+		},
+		{
+			func(s *Script) { s.Steps[2].URL = "/checkout/${basket}" },
+			2,
+			"checkout: nothing has been captured as basket",
+		},
+	}
+
+	for _, test := range tests {
+		s := checkout()
+		test.change(s)
+
+		res := s.Run(ts.URL, Auth{})
+		assert.EqualError(t, res.Err, test.err)
+		assert.Equal(t, test.passed, res.Passed, test.err)
+		assert.Equal(t, 1, Passed(s, ts.URL, Auth{}), test.err)
+	}
+}
+
+func TestScriptRunInvalidURL(t *testing.T) {
+	res := checkout().Run("Invalid", Auth{})
+	assert.NotNil(t, res.Err)
+	assert.Equal(t, 0, res.Passed)
+}
+
+func TestScriptFunc(t *testing.T) {
+	var ran *Script
+	run := func(s *Script, u string, auth Auth) int {
+		ran = s
+		return 1
+	}
+
+	s := checkout()
+	assert.Equal(t, 1, s.Func(run)("ignored", "http://localhost", Auth{}))
+	assert.Equal(t, s, ran)
+}
+
+func TestScriptValidate(t *testing.T) {
+	assert.Nil(t, checkout().Validate())
+	assert.EqualError(t, (&Script{}).Validate(), "has no steps")
+
+	s := checkout()
+	s.Steps[1].URL = ""
+	assert.EqualError(t, s.Validate(), "step 2 has no url")
+
+	s = checkout()
+	s.Steps[1].Capture = map[string]string{"token": "("}
+	assert.EqualError(t, s.Validate(), "step 2 can't capture token: error parsing regexp: missing closing ): `(`")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	reportPrefix     = "drill-"
+	reportSuffix     = ".json"
+	reportTimeFormat = "20060102T150405Z"
+)
+
+// daemon runs drills on a schedule until it is stopped
+type daemon struct {
+	calendar    drillCalendar
+	lockFile    string
+	reportDir   string
+	keepReports int
+
+	// An address to serve the metrics on, none if empty
+	metricsAddr string
+
+	// How long a drill holds the lock file, after which it counts as left
+	// by a daemon that crashed mid drill
+	lockTTL time.Duration
+
+	// drill runs one drill and returns its exit code
+	drill func() int
+}
+
+// runReport is what is kept on disk about each drill the daemon runs
+type runReport struct {
+	Scheduled time.Time `json:"scheduled"`
+	Start     time.Time `json:"start"`
+	Finish    time.Time `json:"finish"`
+	Duration  string    `json:"duration"`
+	ASG       string    `json:"asg"`
+	ExitCode  int       `json:"exitCode"`
+	Result    string    `json:"result"`
+}
+
+// loadDaemon builds the daemon's schedule and settings from viper, collecting
+// every problem in the same way as loadConfig
+func loadDaemon() (*daemon, error) {
+	problems := []string{}
+
+	d := &daemon{
+		lockFile:    viper.GetString("daemon.lockFile"),
+		reportDir:   viper.GetString("daemon.reports.dir"),
+		keepReports: viper.GetInt("daemon.reports.keep"),
+		metricsAddr: viper.GetString("daemon.metrics"),
+		calendar:    drillCalendar{blackouts: map[string]bool{}},
+	}
+
+	var err error
+	d.calendar.location, err = time.LoadLocation(viper.GetString("daemon.timezone"))
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("daemon.timezone is invalid: %s", err))
+		d.calendar.location = time.Local
+	}
+
+	if viper.GetString("daemon.schedule") == "" {
+		problems = append(problems, "daemon.schedule is required")
+	} else {
+		d.calendar.schedule, err = parseCronSchedule(viper.GetString("daemon.schedule"))
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if d.calendar.schedule.next(time.Now()).IsZero() {
+			problems = append(problems, "daemon.schedule never matches a date")
+		}
+	}
+
+	for _, value := range getList("daemon.windows") {
+		w, err := parseTimeWindow(value)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		d.calendar.windows = append(d.calendar.windows, w)
+	}
+
+	for _, value := range getList("daemon.blackouts") {
+		_, err := time.Parse(blackoutDateFormat, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("the blackout date %q is not a date like 2006-01-02", value))
+			continue
+		}
+		d.calendar.blackouts[value] = true
+	}
+
+	if d.lockFile == "" {
+		problems = append(problems, "daemon.lockFile is required")
+	}
+
+	if d.keepReports < 0 {
+		problems = append(problems, fmt.Sprintf("daemon.reports.keep must not be negative, got %d", d.keepReports))
+	}
+
+	if len(problems) > 0 {
+		return d, &configError{problems: problems}
+	}
+
+	return d, nil
+}
+
+// getList reads a list from the config. A list set with an environment
+// variable is separated by semicolons as the windows contain spaces and
+// commas.
+func getList(key string) []string {
+	value, ok := viper.Get(key).(string)
+	if !ok {
+		return viper.GetStringSlice(key)
+	}
+
+	list := []string{}
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// serve waits for each scheduled time and runs a drill if it is allowed. A
+// stop signal ends it, though a drill already running is left to finish and
+// restore the group first.
+func (d *daemon) serve() int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	if d.metricsAddr != "" {
+		server := d.serveMetrics()
+		defer server.Close()
+	}
+
+	for {
+		next := d.calendar.next(time.Now())
+		if next.IsZero() {
+			log.Error("The schedule never matches again")
+			return 1
+		}
+
+		log.WithField("next", next).Info("Waiting for the next drill")
+
+		select {
+		case <-stop:
+			log.Info("Stopping the daemon")
+			return 0
+		case <-time.After(time.Until(next)):
+		}
+
+		d.runScheduled(next)
+	}
+}
+
+// serveMetrics serves the metrics at /metrics in the background
+func (d *daemon) serveMetrics() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", drillMetrics)
+
+	server := &http.Server{Addr: d.metricsAddr, Handler: mux}
+	go func() {
+		log.WithField("addr", d.metricsAddr).Info("Serving the metrics")
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Could not serve the metrics")
+		}
+	}()
+
+	return server
+}
+
+// runScheduled runs the drill scheduled for the given time, unless it falls
+// outside the calendar or another drill holds the lock. It returns the report
+// when a drill was run.
+func (d *daemon) runScheduled(scheduled time.Time) *runReport {
+	logger := log.WithField("scheduled", scheduled)
+
+	ok, reason := d.calendar.allowed(scheduled)
+	if !ok {
+		logger.WithField("reason", reason).Info("Skipping the drill")
+		return nil
+	}
+
+	release, err := d.acquireLock()
+	if err != nil {
+		logger.WithError(err).Warn("Skipping the drill as another may be running")
+		return nil
+	}
+	defer release()
+
+	report := &runReport{
+		Scheduled: scheduled,
+		Start:     time.Now(),
+		ASG:       viper.GetString("asg"),
+	}
+
+	report.ExitCode = d.drill()
+	report.Finish = time.Now()
+	report.Duration = report.Finish.Sub(report.Start).String()
+
+	report.Result = "success"
+	if report.ExitCode != 0 {
+		report.Result = "failure"
+	}
+
+	logger.WithFields(log.Fields{
+		"result":   report.Result,
+		"exitCode": report.ExitCode,
+	}).Info("Drill finished")
+
+	err = d.saveReport(report)
+	if err != nil {
+		logger.WithError(err).Error("Could not save the drill report")
+	}
+
+	return report
+}
+
+// acquireLock takes the lock file for one drill, failing if another daemon
+// holds it. The returned function releases it again.
+func (d *daemon) acquireLock() (func(), error) {
+	lock := &fileLock{path: d.lockFile}
+	l := lockInfo{
+		RunID:   newRunID(),
+		Owner:   fmt.Sprintf("daemon pid %d", os.Getpid()),
+		Expires: time.Now().Add(d.lockTTL),
+	}
+
+	err := lock.acquire(l)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		err := lock.release(l)
+		if err != nil {
+			log.WithError(err).WithField("lockFile", d.lockFile).Error("Could not remove the lock file")
+		}
+	}, nil
+}
+
+// saveReport writes the report to the report directory and removes all but
+// the newest reports
+func (d *daemon) saveReport(report *runReport) error {
+	if d.reportDir == "" || d.keepReports == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(d.reportDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := reportPrefix + report.Start.UTC().Format(reportTimeFormat) + reportSuffix
+	err = ioutil.WriteFile(filepath.Join(d.reportDir, name), contents, 0644)
+	if err != nil {
+		return err
+	}
+
+	return d.pruneReports()
+}
+
+func (d *daemon) pruneReports() error {
+	files, err := ioutil.ReadDir(d.reportDir)
+	if err != nil {
+		return err
+	}
+
+	reports := []string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), reportPrefix) && strings.HasSuffix(f.Name(), reportSuffix) {
+			reports = append(reports, f.Name())
+		}
+	}
+
+	// The names sort oldest first
+	sort.Strings(reports)
+
+	for len(reports) > d.keepReports {
+		err = os.Remove(filepath.Join(d.reportDir, reports[0]))
+		if err != nil {
+			return err
+		}
+		reports = reports[1:]
+	}
+
+	return nil
+}
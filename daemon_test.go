@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDaemon(t *testing.T, drill func() int) (*daemon, func()) {
+	dir, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+
+	d := &daemon{
+		calendar:    drillCalendar{location: time.UTC},
+		lockFile:    filepath.Join(dir, "drill.lock"),
+		reportDir:   filepath.Join(dir, "reports"),
+		keepReports: 2,
+		lockTTL:     time.Hour,
+		drill:       drill,
+	}
+
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestRunScheduled(t *testing.T) {
+	runs := 0
+	d, cleanup := testDaemon(t, func() int {
+		runs++
+		return 0
+	})
+	defer cleanup()
+
+	scheduled := time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)
+	report := d.runScheduled(scheduled)
+
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, "success", report.Result)
+	assert.Equal(t, scheduled, report.Scheduled)
+
+	// The report is saved and the lock released
+	files, err := ioutil.ReadDir(d.reportDir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	contents, err := ioutil.ReadFile(filepath.Join(d.reportDir, files[0].Name()))
+	assert.Nil(t, err)
+	var saved runReport
+	assert.Nil(t, json.Unmarshal(contents, &saved))
+	assert.Equal(t, "success", saved.Result)
+
+	_, err = os.Stat(d.lockFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunScheduledFailure(t *testing.T) {
+	d, cleanup := testDaemon(t, func() int { return 2 })
+	defer cleanup()
+
+	report := d.runScheduled(time.Now())
+
+	assert.Equal(t, "failure", report.Result)
+	assert.Equal(t, 2, report.ExitCode)
+}
+
+func TestRunScheduledOutsideCalendar(t *testing.T) {
+	runs := 0
+	d, cleanup := testDaemon(t, func() int {
+		runs++
+		return 0
+	})
+	defer cleanup()
+	d.calendar.blackouts = map[string]bool{"2026-10-19": true}
+
+	assert.Nil(t, d.runScheduled(time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 0, runs)
+}
+
+func TestRunScheduledLocked(t *testing.T) {
+	runs := 0
+	d, cleanup := testDaemon(t, func() int {
+		runs++
+		return 0
+	})
+	defer cleanup()
+
+	release, err := d.acquireLock()
+	assert.Nil(t, err)
+	defer release()
+
+	assert.Nil(t, d.runScheduled(time.Now()))
+	assert.Equal(t, 0, runs)
+}
+
+func TestRunScheduledTakesOverStaleLock(t *testing.T) {
+	runs := 0
+	d, cleanup := testDaemon(t, func() int {
+		runs++
+		return 0
+	})
+	defer cleanup()
+
+	// Left by a daemon that crashed mid drill
+	lock := &fileLock{path: d.lockFile}
+	assert.Nil(t, lock.acquire(testLockInfo("crashed", -time.Minute)))
+
+	assert.NotNil(t, d.runScheduled(time.Now()))
+	assert.Equal(t, 1, runs)
+}
+
+func TestAcquireLockTwice(t *testing.T) {
+	d, cleanup := testDaemon(t, nil)
+	defer cleanup()
+
+	release, err := d.acquireLock()
+	assert.Nil(t, err)
+
+	_, err = d.acquireLock()
+	assert.IsType(t, &lockHeldError{}, err)
+
+	release()
+	release, err = d.acquireLock()
+	assert.Nil(t, err)
+	release()
+}
+
+func TestSaveReportKeepsTheNewest(t *testing.T) {
+	d, cleanup := testDaemon(t, nil)
+	defer cleanup()
+
+	start := time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, d.saveReport(&runReport{Start: start.Add(time.Duration(i) * time.Hour)}))
+	}
+
+	files, err := ioutil.ReadDir(d.reportDir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "drill-20261019T130000Z.json", files[0].Name())
+	assert.Equal(t, "drill-20261019T140000Z.json", files[1].Name())
+}
+
+func TestLoadDaemon(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("daemon.schedule", "0 11 * * 2")
+	viper.Set("daemon.timezone", "UTC")
+	viper.Set("daemon.windows", []string{"Mon-Fri 10:00-16:00"})
+	viper.Set("daemon.blackouts", []string{"2026-12-24"})
+	viper.Set("daemon.lockFile", "/tmp/drill.lock")
+	viper.Set("daemon.reports.keep", 5)
+
+	d, err := loadDaemon()
+	assert.Nil(t, err)
+	assert.Len(t, d.calendar.windows, 1)
+	assert.True(t, d.calendar.blackouts["2026-12-24"])
+	assert.Equal(t, time.UTC, d.calendar.location)
+	assert.Equal(t, 5, d.keepReports)
+}
+
+func TestLoadDaemonListsFromEnvironment(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("daemon.windows", "Mon-Fri 10:00-12:00; Sat,Sun 09:00-10:00")
+
+	assert.Equal(t, []string{"Mon-Fri 10:00-12:00", "Sat,Sun 09:00-10:00"}, getList("daemon.windows"))
+}
+
+func TestLoadDaemonReportsEveryProblem(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("daemon.schedule", "0 11 * *")
+	viper.Set("daemon.timezone", "Nowhere/Special")
+	viper.Set("daemon.windows", []string{"Weekdays"})
+	viper.Set("daemon.blackouts", []string{"24/12/2026"})
+	viper.Set("daemon.reports.keep", -1)
+
+	_, err := loadDaemon()
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - daemon.timezone is invalid: unknown time zone Nowhere/Special\n"+
+		"  - the schedule \"0 11 * *\" should have 5 fields, it has 4\n"+
+		"  - the window \"Weekdays\" should be days and times, e.g. Mon-Fri 10:00-16:00\n"+
+		"  - the blackout date \"24/12/2026\" is not a date like 2006-01-02\n"+
+		"  - daemon.lockFile is required\n"+
+		"  - daemon.reports.keep must not be negative, got -1")
+}
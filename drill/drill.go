@@ -0,0 +1,524 @@
+// Package drill runs a disaster recovery drill against an autoscaling group.
+// It puts the instances into standby, checks the site fails over to the
+// secondary content, optionally holds it there, then restores the group and
+// checks the primary content comes back.
+//
+//	d := drill.New(asgSvc, elbSvc, drill.Options{
+//		Group:     "web",
+//		Primary:   "Welcome",
+//		Secondary: "Down for maintenance",
+//		URL:       "https://example.com",
+//		Phases:    phases,
+//	})
+//	result, err := d.Run()
+package drill
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/growkudos/Anarchy-Kitten/asg"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	log "github.com/sirupsen/logrus"
+)
+
+// The events a drill sends as it progresses
+const (
+	EventStart            = "start"
+	EventFailoverDetected = "failover-detected"
+	EventAborted          = "aborted"
+	EventRestoreStarted   = "restore-started"
+	EventSuccess          = "success"
+	EventFailure          = "failure"
+
+	// Sent either side of each phase
+	EventPhaseStarted  = "phase-started"
+	EventPhaseFinished = "phase-finished"
+
+	// Sent each time the instances are waited for again on the way back
+	// into service
+	EventRestoreRetried = "restore-retried"
+)
+
+// The phases of a drill, in the order they run
+const (
+	PhaseStandby  = "standby"
+	PhaseFailover = "failover"
+	PhaseHold     = "hold"
+	PhaseRestore  = "restore"
+	PhaseRecovery = "recovery"
+)
+
+// Event tells the caller how the drill is going. Phase events carry the
+// content expected in the "content" detail, if any, and when the phase
+// started; a finished phase says whether it failed.
+type Event struct {
+	Type    string
+	Phase   string
+	Message string
+	Details map[string]string
+	Failed  bool
+	Started time.Time
+}
+
+// Guard can abort a drill while the group is out of service. The drill
+// watches it from standby to the end of the hold, and once Aborted is closed
+// stops waiting and goes straight to restoring the group.
+type Guard interface {
+	// Watch starts checking every poll until the returned function is called
+	Watch(poll time.Duration) func()
+	Aborted() <-chan struct{}
+	// AbortReason is why the drill was aborted, empty if it wasn't
+	AbortReason() string
+}
+
+// noGuard never aborts
+type noGuard struct{}
+
+func (noGuard) Watch(time.Duration) func() { return func() {} }
+func (noGuard) Aborted() <-chan struct{}   { return nil }
+func (noGuard) AbortReason() string        { return "" }
+
+// Options are everything a drill needs beyond the AWS clients. Only Group,
+// the content and URL are needed, everything else has a sensible zero value.
+type Options struct {
+	Group     string
+	Primary   string
+	Secondary string
+	URL       string
+	Auth      contentcheck.Auth
+	Phases    Phases
+
+	// Drift is what to do when the group isn't as it was before the drill,
+	// off when empty
+	Drift string
+	// OwnTagPrefix is left out of the drift check, for the tags the caller
+	// adds and removes itself
+	OwnTagPrefix string
+
+	Guard Guard
+	// Check looks for the content, contentcheck.Found when nil
+	Check contentcheck.Func
+
+	// PrimaryScript and SecondaryScript, if set, are run instead of looking
+	// for the primary and secondary content, with RunScript,
+	// contentcheck.Passed when nil
+	PrimaryScript   *contentcheck.Script
+	SecondaryScript *contentcheck.Script
+	RunScript       contentcheck.ScriptFunc
+
+	// Tag and Untag, if set, mark the group and instances as being drilled
+	// and return how many steps failed
+	Tag   func(instanceIDs []*string, start time.Time, expectedEnd time.Time) int
+	Untag func(instanceIDs []*string) int
+
+	// Clock is what the drill polls and times its phases by, the wall clock
+	// when nil
+	Clock clock.Clock
+
+	OnEvent func(Event)
+	// Hook, if set, is called after OnEvent with every event and returns
+	// how many failures it should add to the drill's, e.g. for a custom
+	// action that has to work for the drill to pass. It is called with the
+	// success event before OnEvent, as it can still fail the drill, and a
+	// failure on the standby phase starting stops the drill before the
+	// instances go into standby.
+	Hook func(Event) int
+}
+
+// PhaseResult is how one phase of the drill went
+type PhaseResult struct {
+	Name     string
+	Took     time.Duration
+	Failures int
+}
+
+// Result is how the drill went. Failures counts every step that failed, so
+// is 0 when the drill succeeded.
+type Result struct {
+	Failures    int
+	Phases      []PhaseResult
+	AbortReason string
+	Drift       []string
+	Took        time.Duration
+}
+
+// Succeeded is true when nothing failed
+func (r Result) Succeeded() bool {
+	return r.Failures == 0
+}
+
+// Drill is a single drill against a group, ready to run
+type Drill struct {
+	svc    autoscalingiface.AutoScalingAPI
+	elbSvc elbv2iface.ELBV2API
+	opts   Options
+
+	// The failures the hook has added so far this run
+	hookFailures int
+}
+
+// New sets up a drill, filling in the defaults for anything not set
+func New(
+	svc autoscalingiface.AutoScalingAPI,
+	elbSvc elbv2iface.ELBV2API,
+	opts Options) *Drill {
+	if opts.Guard == nil {
+		opts.Guard = noGuard{}
+	}
+	if opts.Check == nil {
+		opts.Check = contentcheck.Found
+	}
+	if opts.RunScript == nil {
+		opts.RunScript = contentcheck.Passed
+	}
+	if opts.Drift == "" {
+		opts.Drift = DriftOff
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real{}
+	}
+
+	return &Drill{svc: svc, elbSvc: elbSvc, opts: opts}
+}
+
+func (d *Drill) emit(e Event) {
+	d.announce(e)
+	if d.opts.Hook != nil {
+		d.hookFailures += d.opts.Hook(e)
+	}
+}
+
+// announce sends the event to OnEvent without calling the hook
+func (d *Drill) announce(e Event) {
+	if d.opts.OnEvent != nil {
+		d.opts.OnEvent(e)
+	}
+}
+
+// since is how long it has been since t by the drill's clock
+func (d *Drill) since(t time.Time) time.Duration {
+	return d.opts.Clock.Now().Sub(t)
+}
+
+// check is how to check for the expected content, by running the script
+// when there is one
+func (d *Drill) check(script *contentcheck.Script) contentcheck.Func {
+	if script == nil {
+		return d.opts.Check
+	}
+
+	return script.Func(d.opts.RunScript)
+}
+
+// expected describes what a phase expects to find
+func expected(content string, script *contentcheck.Script) string {
+	if script == nil {
+		return content
+	}
+
+	return "the " + script.Name + " script"
+}
+
+// phase runs one phase of the drill, sending its events and recording the
+// result. The content is what the phase expects to find, if anything.
+func (d *Drill) phase(res *Result, name string, content string, run func() int) int {
+	start := d.opts.Clock.Now()
+	details := map[string]string{}
+	if content != "" {
+		details["content"] = content
+	}
+
+	d.emit(Event{Type: EventPhaseStarted, Phase: name, Details: details, Started: start})
+	failures := run()
+	d.emit(Event{Type: EventPhaseFinished, Phase: name, Details: details, Started: start, Failed: failures != 0})
+
+	res.Failures += failures
+	res.Phases = append(res.Phases, PhaseResult{Name: name, Took: d.since(start), Failures: failures})
+
+	return failures
+}
+
+// Run runs the drill, returning an error only when the group can't be read
+// before anything has been done to it. Once the instances are in standby
+// the drill always tries to restore the group, whatever else fails.
+func (d *Drill) Run() (Result, error) {
+	o := d.opts
+	p := o.Phases
+	res := Result{}
+	d.hookFailures = 0
+
+	drillStart := o.Clock.Now()
+
+	d.emit(Event{
+		Type:    EventStart,
+		Message: "The drill is starting, expect the secondary site",
+		Details: map[string]string{
+			"url":      o.URL,
+			"deadline": p.Deadline.String(),
+		},
+		Started: drillStart,
+	})
+
+	group, err := asg.Group(d.svc, o.Group)
+	if err != nil {
+		return res, err
+	}
+	instanceIDs := asg.InstanceIDs(group.Instances)
+	before := takeSnapshot(group, o.OwnTagPrefix)
+
+	// Anyone looking at the group in the console can see why the instances
+	// are in standby
+	if o.Tag != nil {
+		expectedEnd := drillStart.Add(p.Deadline)
+		if p.Deadline == 0 {
+			expectedEnd = drillStart.Add(p.Budget())
+		}
+		res.Failures += o.Tag(instanceIDs, drillStart, expectedEnd)
+	}
+
+	// From here on the guard aborts the drill and restores the group
+	// straight away
+	stopWatching := o.Guard.Watch(p.Failover.Poll)
+	defer stopWatching()
+
+	result := d.phase(&res, PhaseStandby, "", func() int {
+		// A hook that had to work before the instances go into standby
+		// fails the phase instead
+		if d.hookFailures > 0 {
+			log.Error("A hook failed, not putting the instances into standby")
+			failures := d.hookFailures
+			d.hookFailures = 0
+			return failures
+		}
+
+		return asg.EnterStandby(
+			o.Clock,
+			d.svc,
+			o.Group,
+			instanceIDs,
+			p.Standby.Poll,
+			timeLeft(o.Clock, drillStart, p.Standby.Timeout, drillStart, p.Deadline),
+			o.Guard.Aborted())
+	})
+
+	if result == 0 && o.Guard.AbortReason() == "" {
+		failoverStart := o.Clock.Now()
+		d.phase(&res, PhaseFailover, expected(o.Secondary, o.SecondaryScript), func() int {
+			// The site only fails over once the load balancer has stopped
+			// sending traffic to the instances
+			failures := asg.WaitForTargetHealth(
+				o.Clock,
+				d.elbSvc,
+				group.TargetGroupARNs,
+				instanceIDs,
+				asg.TargetStatesOutOfService,
+				p.Failover.Poll,
+				timeLeft(o.Clock, failoverStart, p.Failover.Timeout, drillStart, p.Deadline),
+				o.Guard.Aborted(),
+			)
+			result = contentcheck.Poll(
+				o.Clock,
+				o.Secondary,
+				o.URL,
+				o.Auth,
+				p.Failover.Poll,
+				timeLeft(o.Clock, failoverStart, p.Failover.Timeout, drillStart, p.Deadline),
+				d.check(o.SecondaryScript),
+				o.Guard.Aborted())
+
+			return failures + result
+		})
+
+		if result == 0 {
+			d.emit(Event{
+				Type:    EventFailoverDetected,
+				Message: "The secondary content is being served",
+				Details: map[string]string{"took": d.since(failoverStart).String()},
+				Started: failoverStart,
+			})
+		}
+
+		if result == 0 && p.Hold.Duration > 0 {
+			holdStart := o.Clock.Now()
+			d.phase(&res, PhaseHold, expected(o.Secondary, o.SecondaryScript), func() int {
+				return contentcheck.Hold(
+					o.Clock,
+					o.Secondary,
+					o.URL,
+					o.Auth,
+					p.Hold.Poll,
+					timeLeft(o.Clock, holdStart, p.Hold.Duration, drillStart, p.Deadline),
+					p.Hold.Budget,
+					d.check(o.SecondaryScript),
+					p.Hold.Assert,
+					o.Guard.Aborted())
+			})
+		}
+	}
+
+	stopWatching()
+	if reason := o.Guard.AbortReason(); reason != "" {
+		res.Failures++
+		res.AbortReason = reason
+		d.emit(Event{
+			Type:    EventAborted,
+			Message: "The drill was aborted",
+			Details: map[string]string{"reason": reason},
+		})
+	}
+
+	d.emit(Event{Type: EventRestoreStarted, Message: "Taking the instances out of standby"})
+	d.phase(&res, PhaseRestore, "", func() int {
+		return d.restore(instanceIDs)
+	})
+
+	if o.Untag != nil {
+		res.Failures += o.Untag(instanceIDs)
+	}
+
+	recoveryStart := o.Clock.Now()
+	d.phase(&res, PhaseRecovery, expected(o.Primary, o.PrimaryScript), func() int {
+		// The load balancer should be sending traffic to the instances
+		// again before we expect to see the primary content
+		failures := asg.WaitForTargetHealth(
+			o.Clock,
+			d.elbSvc,
+			group.TargetGroupARNs,
+			instanceIDs,
+			asg.TargetStatesInService,
+			p.Recovery.Poll,
+			p.Recovery.Timeout,
+			nil,
+		)
+
+		// Now check that the content of the url is the original primary
+		// content
+		return failures + contentcheck.Poll(
+			o.Clock,
+			o.Primary,
+			o.URL,
+			o.Auth,
+			p.Recovery.Poll,
+			timeLeft(o.Clock, recoveryStart, p.Recovery.Timeout, recoveryStart, 0),
+			d.check(o.PrimaryScript),
+			nil)
+	})
+
+	// The drill should leave the group as it found it
+	if o.Drift != DriftOff {
+		res.Failures += d.verify(&res, before)
+	}
+
+	if p.Deadline > 0 && d.since(drillStart) > p.Deadline {
+		log.WithFields(log.Fields{
+			"deadline": p.Deadline,
+			"took":     d.since(drillStart),
+		}).Error("The drill overran its deadline")
+		res.Failures++
+	}
+
+	// The hooks count towards whether the drill succeeded
+	res.Failures += d.hookFailures
+	d.hookFailures = 0
+
+	res.Took = d.since(drillStart)
+
+	// A hook on success can still fail the drill, so it runs before the
+	// outcome is announced
+	if res.Succeeded() && o.Hook != nil {
+		res.Failures += o.Hook(d.outcome(res, drillStart))
+	}
+	if res.Succeeded() {
+		d.announce(d.outcome(res, drillStart))
+	} else {
+		d.emit(d.outcome(res, drillStart))
+	}
+
+	// A hook on the last event can't change how the drill was reported, but
+	// still counts
+	res.Failures += d.hookFailures
+
+	log.WithField("failures", res.Failures).Info("Finished")
+
+	return res, nil
+}
+
+// outcome is the success or failure event for the result
+func (d *Drill) outcome(res Result, drillStart time.Time) Event {
+	details := map[string]string{
+		"took":     res.Took.String(),
+		"exitCode": fmt.Sprintf("%d", res.Failures),
+	}
+	if len(res.Drift) > 0 {
+		details["drift"] = strings.Join(res.Drift, "; ")
+	}
+
+	// Say what went wrong, so the notification can be acted on without
+	// reading the logs
+	failed := []string{}
+	for _, p := range res.Phases {
+		if p.Failures > 0 {
+			failed = append(failed, p.Name)
+		}
+	}
+	if len(failed) > 0 {
+		details["failedPhases"] = strings.Join(failed, ", ")
+	}
+	if res.AbortReason != "" {
+		details["abortReason"] = res.AbortReason
+	}
+
+	if res.Succeeded() {
+		return Event{Type: EventSuccess, Message: "The drill succeeded", Details: details, Started: drillStart}
+	}
+
+	return Event{Type: EventFailure, Message: "The drill failed, check the logs", Details: details, Started: drillStart}
+}
+
+// restore tries forever to get all the instances back into service
+func (d *Drill) restore(instanceIDs []*string) int {
+	p := d.opts.Phases
+	failures := 0
+
+	for attempt := 0; ; attempt++ {
+		group, err := asg.Group(d.svc, d.opts.Group)
+		if err != nil {
+			log.WithError(err).Error("Could not check the instances are back in service")
+			d.opts.Clock.Sleep(p.Restore.Poll)
+			continue
+		}
+		if asg.AllInService(group.Instances) {
+			return failures
+		}
+
+		if attempt > 0 {
+			d.emit(Event{Type: EventRestoreRetried, Phase: PhaseRestore})
+		}
+
+		result, retries := asg.ExitStandby(d.opts.Clock, d.svc, d.opts.Group, instanceIDs, p.Restore.Poll, p.Restore.Timeout)
+		for i := 0; i < retries; i++ {
+			d.emit(Event{Type: EventRestoreRetried, Phase: PhaseRestore})
+		}
+		failures += result
+	}
+}
+
+// verify compares the group with the snapshot taken before the drill,
+// returning 1 when it can't be read or has drifted and that fails the drill
+func (d *Drill) verify(res *Result, before groupSnapshot) int {
+	group, err := asg.Group(d.svc, d.opts.Group)
+	if err != nil {
+		log.WithError(err).Error("Could not check the group is as it was before the drill")
+		return 1
+	}
+
+	result, drift := verifyGroup(before, group, d.opts.OwnTagPrefix, d.opts.Drift)
+	res.Drift = drift
+
+	return result
+}
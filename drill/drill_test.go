@@ -0,0 +1,475 @@
+package drill
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.PanicLevel)
+	os.Exit(m.Run())
+}
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+	Error string
+
+	// The instances' lifecycle state on each describe, InService after
+	// the last
+	ServiceStatus []string
+	// The group's max size after the drill
+	MaxSizeAfter int64
+	// The scaling activities never finish
+	ActivitiesInProgress bool
+	// The describe scaling activities call that fails, counting from 1,
+	// none when 0
+	ActivityErrorAt int
+	describeCount   int
+	activityCount   int
+	enterCount      int
+	exitCount       int
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingGroups(
+	input *autoscaling.DescribeAutoScalingGroupsInput) (
+	*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if m.Error == "DescribeAutoScalingGroups" {
+		return nil, errors.New("Error")
+	}
+
+	status := "InService"
+	if len(m.ServiceStatus) > m.describeCount {
+		status = m.ServiceStatus[m.describeCount]
+	}
+
+	maxSize := int64(4)
+	if m.describeCount > 0 && m.MaxSizeAfter > 0 {
+		maxSize = m.MaxSizeAfter
+	}
+	m.describeCount++
+
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: input.AutoScalingGroupNames[0],
+				MaxSize:              aws.Int64(maxSize),
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("instance1"), LifecycleState: aws.String(status)},
+					{InstanceId: aws.String("instance2"), LifecycleState: aws.String(status)},
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockAutoScalingClient) DescribeScalingActivities(
+	*autoscaling.DescribeScalingActivitiesInput) (
+	*autoscaling.DescribeScalingActivitiesOutput, error) {
+	m.activityCount++
+	if m.activityCount == m.ActivityErrorAt {
+		return nil, errors.New("Error")
+	}
+
+	statusCode := "Successful"
+	if m.ActivitiesInProgress {
+		statusCode = "InProgress"
+	}
+
+	return &autoscaling.DescribeScalingActivitiesOutput{
+		Activities: []*autoscaling.Activity{
+			{StatusCode: aws.String(statusCode)},
+		},
+	}, nil
+}
+
+func (m *mockAutoScalingClient) EnterStandby(
+	*autoscaling.EnterStandbyInput) (*autoscaling.EnterStandbyOutput, error) {
+	m.enterCount++
+	if m.Error == "EnterStandby" {
+		return nil, errors.New("Error")
+	}
+
+	return &autoscaling.EnterStandbyOutput{
+		Activities: []*autoscaling.Activity{
+			{ActivityId: aws.String("activity1")},
+		},
+	}, nil
+}
+
+func (m *mockAutoScalingClient) ExitStandby(
+	*autoscaling.ExitStandbyInput) (*autoscaling.ExitStandbyOutput, error) {
+	m.exitCount++
+
+	return &autoscaling.ExitStandbyOutput{
+		Activities: []*autoscaling.Activity{
+			{ActivityId: aws.String("activity2")},
+		},
+	}, nil
+}
+
+// stubGuard has already aborted the drill when the reason is set
+type stubGuard struct {
+	reason  string
+	aborted chan struct{}
+}
+
+func newStubGuard(reason string) *stubGuard {
+	g := &stubGuard{reason: reason, aborted: make(chan struct{})}
+	if reason != "" {
+		close(g.aborted)
+	}
+
+	return g
+}
+
+func (g *stubGuard) Watch(time.Duration) func() { return func() {} }
+func (g *stubGuard) Aborted() <-chan struct{}   { return g.aborted }
+func (g *stubGuard) AbortReason() string        { return g.reason }
+
+// failoverSite serves the secondary content for the first requests, then
+// the primary
+func failoverSite(secondaryRequests int) *httptest.Server {
+	count := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count < secondaryRequests {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
+	}))
+}
+
+func testOptions(u string) Options {
+	p := Phase{Poll: time.Millisecond, Timeout: 3 * time.Millisecond}
+	return Options{
+		Group:     "test",
+		Primary:   "primary",
+		Secondary: "secondary",
+		URL:       u,
+		Phases:    Phases{Standby: p, Failover: p, Restore: p, Recovery: p},
+		Clock:     testClock(),
+	}
+}
+
+// eventTypes lists the events that aren't about a single phase
+func eventTypes(events []Event) []string {
+	types := []string{}
+	for _, e := range events {
+		if e.Phase == "" {
+			types = append(types, e.Type)
+		}
+	}
+
+	return types
+}
+
+func TestRunSucceeds(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	events := []Event{}
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, []string{
+		EventStart,
+		EventFailoverDetected,
+		EventRestoreStarted,
+		EventSuccess,
+	}, eventTypes(events))
+
+	phases := []string{}
+	for _, p := range res.Phases {
+		phases = append(phases, p.Name)
+	}
+	assert.Equal(t, []string{PhaseStandby, PhaseFailover, PhaseRestore, PhaseRecovery}, phases)
+
+	assert.Equal(t, EventPhaseStarted, events[1].Type)
+	assert.Equal(t, PhaseStandby, events[1].Phase)
+	assert.Equal(t, "secondary", events[3].Details["content"])
+}
+
+func TestRunTagsAndUntags(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	var tagged, untagged []string
+	opts := testOptions(ts.URL)
+	opts.Phases.Deadline = time.Hour
+	opts.Tag = func(ids []*string, start time.Time, expectedEnd time.Time) int {
+		tagged = aws.StringValueSlice(ids)
+		assert.Equal(t, time.Hour, expectedEnd.Sub(start))
+		return 0
+	}
+	opts.Untag = func(ids []*string) int {
+		untagged = aws.StringValueSlice(ids)
+		return 1
+	}
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Failures)
+	assert.Equal(t, []string{"instance1", "instance2"}, tagged)
+	assert.Equal(t, tagged, untagged)
+}
+
+func TestRunGroupError(t *testing.T) {
+	_, err := New(&mockAutoScalingClient{Error: "DescribeAutoScalingGroups"}, nil, testOptions("http://localhost")).Run()
+	assert.EqualError(t, err, "Error")
+}
+
+func TestRunEnterStandbyFails(t *testing.T) {
+	ts := failoverSite(0)
+	defer ts.Close()
+
+	events := []Event{}
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+
+	res, err := New(&mockAutoScalingClient{Error: "EnterStandby"}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Failures)
+	assert.Equal(t, []string{EventStart, EventRestoreStarted, EventFailure}, eventTypes(events))
+	assert.Equal(t, "2", events[len(events)-1].Details["exitCode"])
+	assert.Equal(t, "standby", events[len(events)-1].Details["failedPhases"])
+}
+
+func TestRunAborted(t *testing.T) {
+	ts := failoverSite(0)
+	defer ts.Close()
+
+	events := []Event{}
+	opts := testOptions(ts.URL)
+	opts.Guard = newStubGuard("the kill switch says stop")
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Failures)
+	assert.Equal(t, "the kill switch says stop", res.AbortReason)
+	assert.Equal(t, []string{EventStart, EventAborted, EventRestoreStarted, EventFailure}, eventTypes(events))
+	assert.Equal(t, "the kill switch says stop", events[len(events)-1].Details["abortReason"])
+}
+
+func TestRunAbortedDuringStandby(t *testing.T) {
+	ts := failoverSite(0)
+	defer ts.Close()
+
+	c := testClock()
+	opts := testOptions(ts.URL)
+	opts.Clock = c
+	opts.Phases.Standby = Phase{Poll: time.Minute, Timeout: time.Hour}
+	opts.Guard = newStubGuard("the kill switch says stop")
+
+	res, err := New(&mockAutoScalingClient{ActivitiesInProgress: true}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Failures)
+	assert.Equal(t, "the kill switch says stop", res.AbortReason)
+
+	// It stops waiting for the instances to enter standby straight away
+	assert.Equal(t, time.Duration(0), c.Elapsed())
+}
+
+func TestRunRestoreRetried(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	retries := 0
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) {
+		if e.Type == EventRestoreRetried {
+			retries++
+		}
+	}
+
+	mockSvc := &mockAutoScalingClient{
+		ServiceStatus: []string{"InService", "Standby", "Standby", "InService"},
+	}
+	res, err := New(mockSvc, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, 2, mockSvc.exitCount)
+	assert.Equal(t, 1, retries)
+}
+
+func TestRunRestoreWaitRetried(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	retries := 0
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) {
+		if e.Type == EventRestoreRetried {
+			retries++
+		}
+	}
+
+	// The first wait for the instances to leave standby fails, the next
+	// one works
+	mockSvc := &mockAutoScalingClient{
+		ServiceStatus:   []string{"InService", "Standby", "InService"},
+		ActivityErrorAt: 2,
+	}
+	res, err := New(mockSvc, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, 1, mockSvc.exitCount)
+	assert.Equal(t, 1, retries)
+}
+
+func TestRunHold(t *testing.T) {
+	ts := failoverSite(3)
+	defer ts.Close()
+
+	asserts := 0
+	opts := testOptions(ts.URL)
+	opts.Phases.Hold = Hold{
+		Duration: 2 * time.Millisecond,
+		Poll:     time.Millisecond,
+		Assert: func() error {
+			asserts++
+			return nil
+		},
+	}
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, PhaseHold, res.Phases[2].Name)
+	assert.Equal(t, 2, asserts)
+}
+
+func TestRunDrift(t *testing.T) {
+	run := func(drift string) Result {
+		ts := failoverSite(1)
+		defer ts.Close()
+
+		opts := testOptions(ts.URL)
+		opts.Drift = drift
+		res, err := New(&mockAutoScalingClient{MaxSizeAfter: 8}, nil, opts).Run()
+		assert.Nil(t, err)
+		return res
+	}
+
+	res := run(DriftReport)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, []string{"the max size was 4 and is now 8"}, res.Drift)
+
+	res = run(DriftFail)
+	assert.Equal(t, 1, res.Failures)
+
+	// Drift isn't checked by default
+	res = run("")
+	assert.True(t, res.Succeeded())
+	assert.Empty(t, res.Drift)
+}
+
+func TestRunHookFailures(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	events := []Event{}
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+	opts.Hook = func(e Event) int {
+		if e.Type == EventFailoverDetected || e.Type == EventFailure {
+			return 1
+		}
+		return 0
+	}
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Failures)
+	assert.Equal(t, EventFailure, events[len(events)-1].Type)
+	assert.Equal(t, "1", events[len(events)-1].Details["exitCode"])
+}
+
+func TestRunSuccessHookFails(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	events := []Event{}
+	hooked := []string{}
+	opts := testOptions(ts.URL)
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+	opts.Hook = func(e Event) int {
+		hooked = append(hooked, e.Type)
+		if e.Type == EventSuccess {
+			return 1
+		}
+		return 0
+	}
+
+	// The success is never announced, the failure hooks run instead
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Failures)
+	assert.Equal(t, []string{EventStart, EventFailoverDetected, EventRestoreStarted, EventFailure}, eventTypes(events))
+	assert.Equal(t, "1", events[len(events)-1].Details["exitCode"])
+	assert.Equal(t, []string{EventSuccess, EventFailure}, hooked[len(hooked)-2:])
+}
+
+func TestRunPreStandbyHookFails(t *testing.T) {
+	ts := failoverSite(0)
+	defer ts.Close()
+
+	mockSvc := &mockAutoScalingClient{}
+	opts := testOptions(ts.URL)
+	opts.Hook = func(e Event) int {
+		if e.Type == EventPhaseStarted && e.Phase == PhaseStandby {
+			return 1
+		}
+		return 0
+	}
+
+	res, err := New(mockSvc, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Failures)
+	assert.Equal(t, 0, mockSvc.enterCount)
+	assert.Equal(t, PhaseResult{Name: PhaseStandby, Failures: 1}, res.Phases[0])
+}
+
+func TestRunScripts(t *testing.T) {
+	ts := failoverSite(1)
+	defer ts.Close()
+
+	events := []Event{}
+	opts := testOptions(ts.URL)
+	opts.Primary = ""
+	opts.Secondary = ""
+	opts.PrimaryScript = &contentcheck.Script{
+		Name:  "home",
+		Steps: []contentcheck.Step{{URL: "/", Contains: []string{"primary"}}},
+	}
+	opts.SecondaryScript = &contentcheck.Script{
+		Name:  "maintenance",
+		Steps: []contentcheck.Step{{URL: "/", Contains: []string{"secondary"}}},
+	}
+	opts.Check = func(string, string, contentcheck.Auth) int {
+		t.Error("The content was checked instead of running the script")
+		return 1
+	}
+	opts.OnEvent = func(e Event) { events = append(events, e) }
+
+	res, err := New(&mockAutoScalingClient{}, nil, opts).Run()
+	assert.Nil(t, err)
+	assert.True(t, res.Succeeded())
+	assert.Equal(t, "the maintenance script", events[3].Details["content"])
+}
@@ -0,0 +1,79 @@
+package drill
+
+import (
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/clock"
+)
+
+// Phase is the poll interval and time allowed for one part of a drill
+type Phase struct {
+	Poll    time.Duration
+	Timeout time.Duration
+}
+
+// Phases times each part of a drill separately as e.g. a Route53 failover
+// takes far longer than putting instances into standby.
+//   - Standby: the instances entering standby
+//   - Failover: the load balancer draining and the secondary content appearing
+//   - Hold: the secondary content staying up, if a hold is set
+//   - Restore: the instances exiting standby
+//   - Recovery: the load balancer targets healthy and the primary content back
+//
+// The standby and failover phases are also cut short by the deadline for the
+// whole drill, restoring the group always runs to completion.
+type Phases struct {
+	Standby  Phase
+	Failover Phase
+	Hold     Hold
+	Restore  Phase
+	Recovery Phase
+	Deadline time.Duration
+}
+
+// Hold keeps the drill in the failed over state for a while to check the
+// secondary site can carry the traffic. Each check that doesn't find the
+// secondary content, e.g. because the primary came back or the request failed,
+// counts against the budget. Assert, if set, is called on each poll as well
+// and fails the hold when it returns an error, unless the error is a
+// contentcheck.Unknown which counts against the budget.
+type Hold struct {
+	Duration time.Duration
+	Poll     time.Duration
+	Budget   int
+	Assert   func() error
+}
+
+// Budget is the time needed if every phase runs to its timeout
+func (p Phases) Budget() time.Duration {
+	return p.Standby.Timeout +
+		p.Failover.Timeout +
+		p.Hold.Duration +
+		p.Restore.Timeout +
+		p.Recovery.Timeout
+}
+
+// timeLeft returns what is left of a phase's timeout since it started, cut
+// short by whatever is left of the drill deadline. A zero deadline means
+// there isn't one.
+func timeLeft(
+	c clock.Clock,
+	phaseStart time.Time,
+	timeout time.Duration,
+	drillStart time.Time,
+	deadline time.Duration) time.Duration {
+	left := timeout - c.Now().Sub(phaseStart)
+
+	if deadline > 0 {
+		untilDeadline := deadline - c.Now().Sub(drillStart)
+		if untilDeadline < left {
+			left = untilDeadline
+		}
+	}
+
+	if left < 0 {
+		return 0
+	}
+
+	return left
+}
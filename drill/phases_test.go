@@ -0,0 +1,48 @@
+package drill
+
+import (
+	"testing"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhasesBudget(t *testing.T) {
+	phases := Phases{
+		Standby:  Phase{Poll: time.Second, Timeout: 2 * time.Minute},
+		Failover: Phase{Poll: time.Second, Timeout: 10 * time.Minute},
+		Hold:     Hold{Duration: 15 * time.Minute, Poll: time.Second},
+		Restore:  Phase{Poll: time.Second, Timeout: 3 * time.Minute},
+		Recovery: Phase{Poll: time.Second, Timeout: 5 * time.Minute},
+	}
+
+	assert.Equal(t, 35*time.Minute, phases.Budget())
+}
+
+// testClock is a fake clock for the tests to time the phases by
+func testClock() *clock.Fake {
+	return clock.NewFake(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC))
+}
+
+func TestTimeLeft(t *testing.T) {
+	c := testClock()
+	now := c.Now()
+
+	assert.Equal(t, 4*time.Minute, timeLeft(c, now.Add(-time.Minute), 5*time.Minute, now, 0))
+}
+
+func TestTimeLeftCutShortByDeadline(t *testing.T) {
+	c := testClock()
+	now := c.Now()
+
+	assert.Equal(t, time.Minute, timeLeft(c, now, 5*time.Minute, now.Add(-9*time.Minute), 10*time.Minute))
+}
+
+func TestTimeLeftNeverNegative(t *testing.T) {
+	c := testClock()
+	now := c.Now()
+
+	assert.Equal(t, time.Duration(0), timeLeft(c, now.Add(-time.Hour), time.Minute, now, 0))
+	assert.Equal(t, time.Duration(0), timeLeft(c, now, time.Minute, now.Add(-time.Hour), time.Minute))
+}
@@ -0,0 +1,179 @@
+package drill
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do when the group has drifted from how it was before the drill
+const (
+	DriftOff    = "off"
+	DriftReport = "report"
+	DriftFail   = "fail"
+)
+
+// groupSnapshot is the state of an autoscaling group that a drill should
+// leave as it found it
+type groupSnapshot struct {
+	// The health status of each instance, by ID
+	instances map[string]string
+
+	desired int64
+	min     int64
+	max     int64
+
+	suspended    []string
+	tags         map[string]string
+	targetGroups []string
+}
+
+// takeSnapshot ignores the tags with the prefix as the caller's own tags
+// come and go during a drill
+func takeSnapshot(group *autoscaling.Group, ignoreTagPrefix string) groupSnapshot {
+	s := groupSnapshot{
+		instances: map[string]string{},
+		desired:   aws.Int64Value(group.DesiredCapacity),
+		min:       aws.Int64Value(group.MinSize),
+		max:       aws.Int64Value(group.MaxSize),
+		tags:      map[string]string{},
+	}
+
+	for _, instance := range group.Instances {
+		s.instances[aws.StringValue(instance.InstanceId)] = aws.StringValue(instance.HealthStatus)
+	}
+
+	for _, process := range group.SuspendedProcesses {
+		s.suspended = append(s.suspended, aws.StringValue(process.ProcessName))
+	}
+	sort.Strings(s.suspended)
+
+	for _, tag := range group.Tags {
+		key := aws.StringValue(tag.Key)
+		if ignoreTagPrefix != "" && strings.HasPrefix(key, ignoreTagPrefix) {
+			continue
+		}
+		s.tags[key] = aws.StringValue(tag.Value)
+	}
+
+	s.targetGroups = aws.StringValueSlice(group.TargetGroupARNs)
+	sort.Strings(s.targetGroups)
+
+	return s
+}
+
+// drift lists every way the group after the drill differs from before it
+func (before groupSnapshot) drift(after groupSnapshot) []string {
+	drift := []string{}
+
+	for _, id := range sortedStringKeys(before.instances) {
+		health, ok := after.instances[id]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("instance %s has gone", id))
+		case health != before.instances[id]:
+			drift = append(drift, fmt.Sprintf("instance %s was %s and is now %s", id, before.instances[id], health))
+		}
+	}
+	for _, id := range sortedStringKeys(after.instances) {
+		if _, ok := before.instances[id]; !ok {
+			drift = append(drift, fmt.Sprintf("instance %s is new", id))
+		}
+	}
+
+	for _, size := range []struct {
+		name          string
+		before, after int64
+	}{
+		{"desired capacity", before.desired, after.desired},
+		{"min size", before.min, after.min},
+		{"max size", before.max, after.max},
+	} {
+		if size.before != size.after {
+			drift = append(drift, fmt.Sprintf("the %s was %d and is now %d", size.name, size.before, size.after))
+		}
+	}
+
+	for _, process := range missingFrom(after.suspended, before.suspended) {
+		drift = append(drift, fmt.Sprintf("the %s process has been left suspended", process))
+	}
+	for _, process := range missingFrom(before.suspended, after.suspended) {
+		drift = append(drift, fmt.Sprintf("the %s process is no longer suspended", process))
+	}
+
+	for _, key := range sortedStringKeys(before.tags) {
+		value, ok := after.tags[key]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("the %s tag has gone", key))
+		case value != before.tags[key]:
+			drift = append(drift, fmt.Sprintf("the %s tag was %q and is now %q", key, before.tags[key], value))
+		}
+	}
+	for _, key := range sortedStringKeys(after.tags) {
+		if _, ok := before.tags[key]; !ok {
+			drift = append(drift, fmt.Sprintf("the %s tag is new", key))
+		}
+	}
+
+	for _, arn := range missingFrom(before.targetGroups, after.targetGroups) {
+		drift = append(drift, fmt.Sprintf("target group %s has been detached", arn))
+	}
+	for _, arn := range missingFrom(after.targetGroups, before.targetGroups) {
+		drift = append(drift, fmt.Sprintf("target group %s has been attached", arn))
+	}
+
+	return drift
+}
+
+// verifyGroup compares the group with how it was before the drill, returning
+// 1 when it has drifted and drift should fail the drill
+func verifyGroup(before groupSnapshot, group *autoscaling.Group, ignoreTagPrefix string, mode string) (int, []string) {
+	drift := before.drift(takeSnapshot(group, ignoreTagPrefix))
+	if len(drift) == 0 {
+		log.Info("The group is as it was before the drill")
+		return 0, nil
+	}
+
+	for _, d := range drift {
+		log.WithField("drift", d).Warn("The group has drifted during the drill")
+	}
+
+	if mode == DriftFail {
+		log.Error("The group is not as it was before the drill")
+		return 1, drift
+	}
+
+	return 0, drift
+}
+
+// missingFrom lists the values in a that aren't in b
+func missingFrom(a []string, b []string) []string {
+	in := map[string]bool{}
+	for _, v := range b {
+		in[v] = true
+	}
+
+	missing := []string{}
+	for _, v := range a {
+		if !in[v] {
+			missing = append(missing, v)
+		}
+	}
+
+	return missing
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
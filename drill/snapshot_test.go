@@ -0,0 +1,104 @@
+package drill
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+// The tags the caller adds during a drill
+const testTagPrefix = "owner:"
+
+func testGroup() *autoscaling.Group {
+	return &autoscaling.Group{
+		DesiredCapacity: aws.Int64(2),
+		MinSize:         aws.Int64(1),
+		MaxSize:         aws.Int64(4),
+		Instances: []*autoscaling.Instance{
+			{InstanceId: aws.String("instance1"), HealthStatus: aws.String("Healthy")},
+			{InstanceId: aws.String("instance2"), HealthStatus: aws.String("Healthy")},
+		},
+		SuspendedProcesses: []*autoscaling.SuspendedProcess{
+			{ProcessName: aws.String("AZRebalance")},
+		},
+		Tags: []*autoscaling.TagDescription{
+			{Key: aws.String("team"), Value: aws.String("web")},
+			{Key: aws.String("owner:lock"), Value: aws.String("run1")},
+		},
+		TargetGroupARNs: aws.StringSlice([]string{"arn2", "arn1"}),
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	s := takeSnapshot(testGroup(), testTagPrefix)
+
+	assert.Equal(t, map[string]string{"instance1": "Healthy", "instance2": "Healthy"}, s.instances)
+	assert.Equal(t, int64(2), s.desired)
+	assert.Equal(t, int64(1), s.min)
+	assert.Equal(t, int64(4), s.max)
+	assert.Equal(t, []string{"AZRebalance"}, s.suspended)
+	assert.Equal(t, map[string]string{"team": "web"}, s.tags)
+	assert.Equal(t, []string{"arn1", "arn2"}, s.targetGroups)
+}
+
+func TestSnapshotNoDrift(t *testing.T) {
+	after := testGroup()
+	after.Tags = append(after.Tags, &autoscaling.TagDescription{
+		Key:   aws.String("owner:run-id"),
+		Value: aws.String("run1"),
+	})
+
+	assert.Empty(t, takeSnapshot(testGroup(), testTagPrefix).drift(takeSnapshot(after, testTagPrefix)))
+}
+
+func TestSnapshotDrift(t *testing.T) {
+	after := testGroup()
+	after.DesiredCapacity = aws.Int64(1)
+	after.Instances = []*autoscaling.Instance{
+		{InstanceId: aws.String("instance1"), HealthStatus: aws.String("Unhealthy")},
+		{InstanceId: aws.String("instance3"), HealthStatus: aws.String("Healthy")},
+	}
+	after.SuspendedProcesses = []*autoscaling.SuspendedProcess{
+		{ProcessName: aws.String("Launch")},
+	}
+	after.Tags = []*autoscaling.TagDescription{
+		{Key: aws.String("team"), Value: aws.String("platform")},
+	}
+	after.TargetGroupARNs = aws.StringSlice([]string{"arn1"})
+
+	assert.Equal(t, []string{
+		"instance instance1 was Healthy and is now Unhealthy",
+		"instance instance2 has gone",
+		"instance instance3 is new",
+		"the desired capacity was 2 and is now 1",
+		"the Launch process has been left suspended",
+		"the AZRebalance process is no longer suspended",
+		"the team tag was \"web\" and is now \"platform\"",
+		"target group arn2 has been detached",
+	}, takeSnapshot(testGroup(), testTagPrefix).drift(takeSnapshot(after, testTagPrefix)))
+}
+
+func TestVerifyGroup(t *testing.T) {
+	before := takeSnapshot(testGroup(), testTagPrefix)
+	after := testGroup()
+	after.MaxSize = aws.Int64(8)
+
+	result, drift := verifyGroup(before, after, testTagPrefix, DriftReport)
+	assert.Equal(t, 0, result)
+	assert.Equal(t, []string{"the max size was 4 and is now 8"}, drift)
+
+	result, _ = verifyGroup(before, after, testTagPrefix, DriftFail)
+	assert.Equal(t, 1, result)
+
+	result, drift = verifyGroup(before, testGroup(), testTagPrefix, DriftFail)
+	assert.Equal(t, 0, result)
+	assert.Empty(t, drift)
+}
+
+func TestTakeSnapshotWithoutPrefix(t *testing.T) {
+	s := takeSnapshot(testGroup(), "")
+
+	assert.Equal(t, map[string]string{"team": "web", "owner:lock": "run1"}, s.tags)
+}
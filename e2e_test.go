@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	"github.com/stretchr/testify/assert"
+)
+
+// The fake's transitions take a few polls, so the drill has to wait for them
+const fakeTransition = 30 * time.Second
+
+func fakePhases() drill.Phases {
+	return testPhases(10*time.Second, 5*time.Minute)
+}
+
+// describeFake describes the fake group, failing the test if it can't
+func describeFake(t *testing.T, asg *fakeAutoScaling) *autoscaling.Group {
+	group, err := getAutoScalingGroup(aws.String(asg.name), asg)
+	assert.Nil(t, err)
+	return group
+}
+
+// drillAgainstFakes runs a drill against the fake group and site
+func drillAgainstFakes(asg *fakeAutoScaling, site *fakeSite, notify notifiers) int {
+	opts := testDrill(site.URL)
+	opts.asg = asg.name
+	opts.phases = fakePhases()
+	opts.drift = drill.DriftFail
+	opts.notify = notify
+	opts.clock = asg.clock
+	return do(testClients(asg), opts)
+}
+
+func enterStandbyInput(group string, ids []*string) *autoscaling.EnterStandbyInput {
+	return &autoscaling.EnterStandbyInput{
+		AutoScalingGroupName:           aws.String(group),
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+		InstanceIds:                    ids,
+	}
+}
+
+func activityInput(group string, id *string) *autoscaling.DescribeScalingActivitiesInput {
+	return &autoscaling.DescribeScalingActivitiesInput{
+		ActivityIds:          []*string{id},
+		AutoScalingGroupName: aws.String(group),
+	}
+}
+
+func allInService(asg *fakeAutoScaling) map[string]string {
+	states := map[string]string{}
+	for id := range asg.states() {
+		states[id] = stateInService
+	}
+
+	return states
+}
+
+func TestFakeAutoScalingLifecycle(t *testing.T) {
+	asg := newFakeAutoScaling("test", 2, fakeTransition, testClock())
+	ids := aws.StringSlice([]string{"i-0001", "i-0002"})
+
+	output, err := asg.EnterStandby(enterStandbyInput("test", ids))
+	assert.Nil(t, err)
+	assert.Equal(t, activityInProgress, aws.StringValue(output.Activities[0].StatusCode))
+	assert.Equal(t, 2, asg.countInState(stateEnteringStandby))
+
+	// The same instances can't go into standby twice
+	_, err = asg.EnterStandby(enterStandbyInput("test", ids))
+	assert.EqualError(t, err, "fake: instance i-0001 is EnteringStandby, not InService")
+
+	asg.clock.Sleep(fakeTransition)
+	activities, err := asg.DescribeScalingActivities(
+		activityInput("test", output.Activities[0].ActivityId))
+	assert.Nil(t, err)
+	assert.Equal(t, activitySuccessful, aws.StringValue(activities.Activities[0].StatusCode))
+	assert.Equal(t, 2, asg.countInState(stateStandby))
+	assert.Equal(t, int64(0), aws.Int64Value(describeFake(t, asg).DesiredCapacity))
+
+	_, err = asg.ExitStandby(&autoscaling.ExitStandbyInput{InstanceIds: ids})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, asg.countInState(statePending))
+
+	asg.clock.Sleep(fakeTransition)
+	assert.Equal(t, allInService(asg), asg.states())
+	assert.Equal(t, int64(2), aws.Int64Value(describeFake(t, asg).DesiredCapacity))
+}
+
+func TestFakeAutoScalingFailedTransition(t *testing.T) {
+	asg := newFakeAutoScaling("test", 2, fakeTransition, testClock())
+	asg.failTransitions("i-0002", stateStandby, 1)
+
+	output, err := asg.EnterStandby(enterStandbyInput(
+		"test", aws.StringSlice([]string{"i-0001", "i-0002"})))
+	assert.Nil(t, err)
+
+	asg.clock.Sleep(fakeTransition)
+	activities, _ := asg.DescribeScalingActivities(
+		activityInput("test", output.Activities[0].ActivityId))
+	assert.Equal(t, activityFailed, aws.StringValue(activities.Activities[0].StatusCode))
+	assert.Equal(t, map[string]string{"i-0001": stateStandby, "i-0002": stateInService}, asg.states())
+	assert.Equal(t, int64(1), aws.Int64Value(describeFake(t, asg).DesiredCapacity))
+}
+
+func TestDrillAgainstFakes(t *testing.T) {
+	asg := newFakeAutoScaling("test", 3, fakeTransition, testClock())
+	site := newFakeSite(asg, "primary", "secondary")
+	defer site.Close()
+
+	// The site wobbles as the failover starts
+	site.play(fakeSiteError)
+
+	recorder := &recordingNotifier{}
+	exitCode := drillAgainstFakes(asg, site, notifiers{recorder})
+
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, allInService(asg), asg.states())
+	assert.Equal(t, []string{"503", "secondary", "primary"}, site.servedDistinct())
+	assert.Equal(t, []string{eventStart, eventFailoverDetected, eventRestoreStarted, eventSuccess}, recorder.types())
+
+	// The drill's tags are cleaned up and the group is as it was
+	group := describeFake(t, asg)
+	assert.Empty(t, group.Tags)
+	assert.Equal(t, int64(3), aws.Int64Value(group.DesiredCapacity))
+}
+
+func TestDrillAgainstFakesPartialStandby(t *testing.T) {
+	asg := newFakeAutoScaling("test", 3, fakeTransition, testClock())
+	asg.failTransitions("i-0002", stateStandby, 1)
+	site := newFakeSite(asg, "primary", "secondary")
+	defer site.Close()
+
+	exitCode := drillAgainstFakes(asg, site, nil)
+
+	// The instance left in service keeps the primary up, but the group is
+	// still put back together
+	assert.True(t, exitCode > 0)
+	assert.Equal(t, []string{"primary"}, site.servedDistinct())
+	assert.Equal(t, allInService(asg), asg.states())
+	assert.Equal(t, int64(3), aws.Int64Value(describeFake(t, asg).DesiredCapacity))
+}
+
+func TestDrillAgainstFakesExitStandbyRetried(t *testing.T) {
+	asg := newFakeAutoScaling("test", 3, fakeTransition, testClock())
+	asg.failTransitions("i-0003", stateInService, 1)
+	site := newFakeSite(asg, "primary", "secondary")
+	defer site.Close()
+
+	exitCode := drillAgainstFakes(asg, site, nil)
+
+	assert.True(t, exitCode > 0)
+	assert.Equal(t, 2, asg.callCounts()["ExitStandby"])
+	assert.Equal(t, allInService(asg), asg.states())
+	assert.Equal(t, []string{"secondary", "primary"}, site.servedDistinct())
+	assert.Equal(t, int64(3), aws.Int64Value(describeFake(t, asg).DesiredCapacity))
+}
+
+func TestDrillAgainstFakesActivityError(t *testing.T) {
+	asg := newFakeAutoScaling("test", 2, fakeTransition, testClock())
+	asg.failCalls("DescribeScalingActivities", 1)
+	site := newFakeSite(asg, "primary", "secondary")
+	defer site.Close()
+
+	recorder := &recordingNotifier{}
+	exitCode := drillAgainstFakes(asg, site, notifiers{recorder})
+
+	// Without knowing the instances went into standby the drill skips
+	// straight to restoring them
+	assert.True(t, exitCode > 0)
+	assert.Equal(t, []string{eventStart, eventRestoreStarted, eventFailure}, recorder.types())
+	assert.Equal(t, allInService(asg), asg.states())
+}
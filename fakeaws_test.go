@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+)
+
+// Lifecycle states the fake moves instances through
+const (
+	stateInService       = "InService"
+	stateEnteringStandby = "EnteringStandby"
+	stateStandby         = "Standby"
+	statePending         = "Pending"
+)
+
+// Statuses of the fake's scaling activities
+const (
+	activityInProgress = "InProgress"
+	activitySuccessful = "Successful"
+	activityFailed     = "Failed"
+)
+
+// fakeAutoScaling is a stateful stand-in for the autoscaling API. Standby and
+// exit standby start activities that stay InProgress for the transition
+// time, moving the instances through EnteringStandby to Standby and through
+// Pending back to InService, so the drill sees what it would in AWS.
+type fakeAutoScaling struct {
+	autoscalingiface.AutoScalingAPI
+
+	mu sync.Mutex
+
+	name       string
+	order      []string
+	instances  map[string]*fakeInstance
+	activities map[string]*fakeActivity
+	tags       map[string]string
+	desired    int64
+	min        int64
+	max        int64
+	targets    []*string
+
+	// How long each lifecycle transition takes, by the clock
+	transition time.Duration
+	clock      clock.Clock
+
+	// Transitions that fail, leaving the instance where it was, by instance
+	// and the state it was going to, with how many more times
+	failing map[string]int
+
+	// API calls that fail, by operation, with how many more times
+	errors map[string]int
+
+	calls    map[string]int
+	activity int
+}
+
+type fakeInstance struct {
+	id     string
+	state  string
+	health string
+}
+
+type fakeActivity struct {
+	id        string
+	start     time.Time
+	instances []string
+	from      string
+	to        string
+	status    string
+
+	// How much each instance changed the desired capacity by, undone when
+	// the instance fails its transition
+	capacity int64
+}
+
+func newFakeAutoScaling(name string, instanceCount int, transition time.Duration, c clock.Clock) *fakeAutoScaling {
+	f := &fakeAutoScaling{
+		name:       name,
+		instances:  map[string]*fakeInstance{},
+		activities: map[string]*fakeActivity{},
+		tags:       map[string]string{},
+		desired:    int64(instanceCount),
+		min:        1,
+		max:        int64(instanceCount) * 2,
+		transition: transition,
+		clock:      c,
+		failing:    map[string]int{},
+		errors:     map[string]int{},
+		calls:      map[string]int{},
+	}
+
+	for i := 1; i <= instanceCount; i++ {
+		id := fmt.Sprintf("i-%04d", i)
+		f.order = append(f.order, id)
+		f.instances[id] = &fakeInstance{id: id, state: stateInService, health: "Healthy"}
+	}
+
+	return f
+}
+
+// failTransitions makes the instance's next transitions to a state fail
+func (f *fakeAutoScaling) failTransitions(id string, to string, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failing[id+" "+to] = times
+}
+
+// failCalls makes the next calls of the operation fail
+func (f *fakeAutoScaling) failCalls(operation string, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.errors[operation] = times
+}
+
+// call records the call and returns an error if it should fail, the lock
+// must be held
+func (f *fakeAutoScaling) call(operation string) error {
+	f.calls[operation]++
+	f.advance(f.clock.Now())
+
+	if f.errors[operation] > 0 {
+		f.errors[operation]--
+		return errors.New("fake " + operation + " error")
+	}
+
+	return nil
+}
+
+// states returns the lifecycle state of each instance
+func (f *fakeAutoScaling) states() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance(f.clock.Now())
+
+	states := map[string]string{}
+	for id, instance := range f.instances {
+		states[id] = instance.state
+	}
+
+	return states
+}
+
+// countInState counts the instances in a lifecycle state
+func (f *fakeAutoScaling) countInState(state string) int {
+	count := 0
+	for _, s := range f.states() {
+		if s == state {
+			count++
+		}
+	}
+
+	return count
+}
+
+// advance finishes the activities whose transition time has passed
+func (f *fakeAutoScaling) advance(now time.Time) {
+	for _, a := range f.activities {
+		if a.status != activityInProgress ||
+			now.Sub(a.start) < f.transition {
+			continue
+		}
+
+		a.status = activitySuccessful
+		for _, id := range a.instances {
+			instance := f.instances[id]
+			if f.failing[id+" "+a.to] > 0 {
+				f.failing[id+" "+a.to]--
+				instance.state = a.from
+				f.desired -= a.capacity
+				a.status = activityFailed
+				continue
+			}
+			instance.state = a.to
+		}
+	}
+}
+
+// startActivity moves the instances into the transition state, they reach
+// the final one once the transition time has passed. The lock must be held.
+func (f *fakeAutoScaling) startActivity(
+	ids []*string,
+	from string,
+	during string,
+	to string) (*autoscaling.Activity, error) {
+	for _, id := range ids {
+		instance, ok := f.instances[aws.StringValue(id)]
+		if !ok {
+			return nil, fmt.Errorf("fake: no instance %s", aws.StringValue(id))
+		}
+		if instance.state != from {
+			return nil, fmt.Errorf("fake: instance %s is %s, not %s", instance.id, instance.state, from)
+		}
+	}
+
+	f.activity++
+	a := &fakeActivity{
+		id:     fmt.Sprintf("activity-%d", f.activity),
+		start:  f.clock.Now(),
+		from:   from,
+		to:     to,
+		status: activityInProgress,
+	}
+	for _, id := range ids {
+		a.instances = append(a.instances, aws.StringValue(id))
+		f.instances[aws.StringValue(id)].state = during
+	}
+	f.activities[a.id] = a
+
+	return &autoscaling.Activity{
+		ActivityId:           aws.String(a.id),
+		AutoScalingGroupName: aws.String(f.name),
+		StatusCode:           aws.String(a.status),
+	}, nil
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroups(
+	*autoscaling.DescribeAutoScalingGroupsInput) (
+	*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeAutoScalingGroups"); err != nil {
+		return nil, err
+	}
+
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String(f.name),
+		DesiredCapacity:      aws.Int64(f.desired),
+		MinSize:              aws.Int64(f.min),
+		MaxSize:              aws.Int64(f.max),
+		TargetGroupARNs:      f.targets,
+	}
+	for _, id := range f.order {
+		instance := f.instances[id]
+		group.Instances = append(group.Instances, &autoscaling.Instance{
+			InstanceId:     aws.String(instance.id),
+			LifecycleState: aws.String(instance.state),
+			HealthStatus:   aws.String(instance.health),
+		})
+	}
+	for _, key := range sortedStringKeys(f.tags) {
+		group.Tags = append(group.Tags, &autoscaling.TagDescription{
+			Key:          aws.String(key),
+			Value:        aws.String(f.tags[key]),
+			ResourceId:   aws.String(f.name),
+			ResourceType: aws.String("auto-scaling-group"),
+		})
+	}
+
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{group},
+	}, nil
+}
+
+func (f *fakeAutoScaling) EnterStandby(
+	input *autoscaling.EnterStandbyInput) (*autoscaling.EnterStandbyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("EnterStandby"); err != nil {
+		return nil, err
+	}
+
+	activity, err := f.startActivity(input.InstanceIds, stateInService, stateEnteringStandby, stateStandby)
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.BoolValue(input.ShouldDecrementDesiredCapacity) {
+		f.desired -= int64(len(input.InstanceIds))
+		f.activities[aws.StringValue(activity.ActivityId)].capacity = -1
+	}
+
+	return &autoscaling.EnterStandbyOutput{Activities: []*autoscaling.Activity{activity}}, nil
+}
+
+func (f *fakeAutoScaling) ExitStandby(
+	input *autoscaling.ExitStandbyInput) (*autoscaling.ExitStandbyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ExitStandby"); err != nil {
+		return nil, err
+	}
+
+	// Instances already back in service are left alone, as AWS would reject
+	// them
+	ids := []*string{}
+	for _, id := range input.InstanceIds {
+		if instance, ok := f.instances[aws.StringValue(id)]; ok && instance.state == stateStandby {
+			ids = append(ids, id)
+		}
+	}
+
+	activity, err := f.startActivity(ids, stateStandby, statePending, stateInService)
+	if err != nil {
+		return nil, err
+	}
+	f.desired += int64(len(ids))
+	f.activities[aws.StringValue(activity.ActivityId)].capacity = 1
+
+	return &autoscaling.ExitStandbyOutput{Activities: []*autoscaling.Activity{activity}}, nil
+}
+
+func (f *fakeAutoScaling) DescribeScalingActivities(
+	input *autoscaling.DescribeScalingActivitiesInput) (
+	*autoscaling.DescribeScalingActivitiesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeScalingActivities"); err != nil {
+		return nil, err
+	}
+
+	output := &autoscaling.DescribeScalingActivitiesOutput{}
+	for _, id := range input.ActivityIds {
+		a, ok := f.activities[aws.StringValue(id)]
+		if !ok {
+			continue
+		}
+		output.Activities = append(output.Activities, &autoscaling.Activity{
+			ActivityId:           aws.String(a.id),
+			AutoScalingGroupName: aws.String(f.name),
+			StatusCode:           aws.String(a.status),
+		})
+	}
+
+	return output, nil
+}
+
+func (f *fakeAutoScaling) DescribeTags(
+	input *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) == "key" {
+			for _, key := range filter.Values {
+				keys[aws.StringValue(key)] = true
+			}
+		}
+	}
+
+	output := &autoscaling.DescribeTagsOutput{}
+	for _, key := range sortedStringKeys(f.tags) {
+		if len(keys) > 0 && !keys[key] {
+			continue
+		}
+		output.Tags = append(output.Tags, &autoscaling.TagDescription{
+			Key:          aws.String(key),
+			Value:        aws.String(f.tags[key]),
+			ResourceId:   aws.String(f.name),
+			ResourceType: aws.String("auto-scaling-group"),
+		})
+	}
+
+	return output, nil
+}
+
+func (f *fakeAutoScaling) CreateOrUpdateTags(
+	input *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateOrUpdateTags"); err != nil {
+		return nil, err
+	}
+
+	for _, tag := range input.Tags {
+		f.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (f *fakeAutoScaling) DeleteTags(
+	input *autoscaling.DeleteTagsInput) (*autoscaling.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteTags"); err != nil {
+		return nil, err
+	}
+
+	for _, tag := range input.Tags {
+		delete(f.tags, aws.StringValue(tag.Key))
+	}
+
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+// fakeSite serves the primary content while any of the group's instances
+// are in service and the secondary content once they are all out, like a
+// Route53 failover would. A script of responses can be played first.
+type fakeSite struct {
+	*httptest.Server
+
+	asg       *fakeAutoScaling
+	primary   string
+	secondary string
+
+	mu     sync.Mutex
+	script []int
+	served []string
+}
+
+// A scripted response that fails with a server error
+const fakeSiteError = http.StatusServiceUnavailable
+
+func newFakeSite(asg *fakeAutoScaling, primary string, secondary string) *fakeSite {
+	s := &fakeSite{asg: asg, primary: primary, secondary: secondary}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	return s
+}
+
+// play makes the next requests get these status codes before the site goes
+// back to following the group
+func (s *fakeSite) play(script ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = append(s.script, script...)
+}
+
+func (s *fakeSite) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.script) > 0 {
+		status := s.script[0]
+		s.script = s.script[1:]
+		if status != http.StatusOK {
+			s.served = append(s.served, fmt.Sprintf("%d", status))
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	content := s.secondary
+	if s.asg.countInState(stateInService) > 0 {
+		content = s.primary
+	}
+
+	s.served = append(s.served, content)
+	fmt.Fprintf(w, "<html><body>%s</body></html>", content)
+}
+
+// servedDistinct lists what the site served, without repeats in a row
+func (s *fakeSite) servedDistinct() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	distinct := []string{}
+	for _, served := range s.served {
+		if len(distinct) == 0 || distinct[len(distinct)-1] != served {
+			distinct = append(distinct, served)
+		}
+	}
+
+	return distinct
+}
+
+// callCounts returns how many times each operation was called
+func (f *fakeAutoScaling) callCounts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := map[string]int{}
+	for operation, count := range f.calls {
+		counts[operation] = count
+	}
+
+	return counts
+}
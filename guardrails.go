@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	log "github.com/sirupsen/logrus"
+)
+
+// The kill switch stops the drill once it reads this
+const killSwitchStop = "stop"
+
+const defaultMonitorWindow = 5
+
+// guardrailOptions are the signals that abort a drill once the instances are
+// going into standby
+type guardrailOptions struct {
+	// Alarms that abort the drill when they go into ALARM
+	alarms []string
+
+	// A file or URL that aborts the drill when it reads "stop"
+	killSwitchFile string
+	killSwitchURL  string
+
+	// A URL requested on every tick, the drill is aborted when more of the
+	// last window of requests fail than the maximum error rate
+	monitorURL   string
+	maxErrorRate float64
+	window       int
+}
+
+func (o guardrailOptions) enabled() bool {
+	return len(o.alarms) > 0 ||
+		o.killSwitchFile != "" ||
+		o.killSwitchURL != "" ||
+		o.maxErrorRate > 0
+}
+
+// guardrails are checked on every poll tick while the group is out of
+// service. The first one to trip aborts the drill, which stops the waiting
+// and goes straight to restoring the group.
+type guardrails struct {
+	opts   guardrailOptions
+	cwSvc  cloudwatchiface.CloudWatchAPI
+	auth   contentcheck.Auth
+	client *http.Client
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	results  []bool
+	reason   string
+	abort    chan struct{}
+	tripOnce sync.Once
+}
+
+func newGuardrails(
+	cwSvc cloudwatchiface.CloudWatchAPI,
+	opts guardrailOptions,
+	auth contentcheck.Auth) *guardrails {
+	if opts.window <= 0 {
+		opts.window = defaultMonitorWindow
+	}
+
+	return &guardrails{
+		opts:   opts,
+		cwSvc:  cwSvc,
+		auth:   auth,
+		client: &http.Client{Timeout: notifyTimeout},
+		clock:  clock.Real{},
+		abort:  make(chan struct{}),
+	}
+}
+
+// Aborted is closed when a guardrail trips. It is nil, and so never closes,
+// when there are no guardrails.
+func (g *guardrails) Aborted() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+
+	return g.abort
+}
+
+// AbortReason is why the drill was aborted, empty if it wasn't
+func (g *guardrails) AbortReason() string {
+	if g == nil {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.reason
+}
+
+func (g *guardrails) trip(reason string) {
+	g.tripOnce.Do(func() {
+		g.mu.Lock()
+		g.reason = reason
+		g.mu.Unlock()
+
+		log.WithField("reason", reason).Error("A guardrail tripped, aborting the drill")
+		close(g.abort)
+	})
+}
+
+// Watch checks the guardrails every poll until the returned function is
+// called or one of them trips
+func (g *guardrails) Watch(poll time.Duration) func() {
+	if g == nil || !g.opts.enabled() {
+		return func() {}
+	}
+
+	log.WithField("poll", poll).Info("Watching the guardrails")
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			if err := g.check(); err != nil {
+				g.trip(err.Error())
+				return
+			}
+
+			select {
+			case <-g.clock.After(poll):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var stopOnce sync.Once
+	return func() { stopOnce.Do(func() { close(done) }) }
+}
+
+// check returns why the drill should be aborted, if it should
+func (g *guardrails) check() error {
+	if len(g.opts.alarms) > 0 {
+		firing, err := getFiringAlarms(g.cwSvc, cloudWatchChecks{alarms: g.opts.alarms})
+		if err != nil {
+			log.WithError(err).Warn("Could not check the guardrail alarms")
+		} else if len(firing) > 0 {
+			return fmt.Errorf("alarm %s is firing", strings.Join(firing, ", "))
+		}
+	}
+
+	if g.opts.killSwitchFile != "" && isKillSwitchFileStop(g.opts.killSwitchFile) {
+		return fmt.Errorf("the kill switch %s says stop", g.opts.killSwitchFile)
+	}
+
+	if g.opts.killSwitchURL != "" && g.isKillSwitchURLStop() {
+		return fmt.Errorf("the kill switch %s says stop", g.opts.killSwitchURL)
+	}
+
+	if g.opts.maxErrorRate > 0 {
+		rate, full := g.monitor()
+		if full && rate > g.opts.maxErrorRate {
+			return fmt.Errorf(
+				"the error rate at %s is %.0f%%, over the maximum of %.0f%%",
+				g.opts.monitorURL,
+				rate*100,
+				g.opts.maxErrorRate*100)
+		}
+	}
+
+	return nil
+}
+
+// isKillSwitchFileStop is true when the file reads stop, a missing file
+// doesn't stop the drill
+func isKillSwitchFileStop(path string) bool {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Could not read the kill switch file")
+		}
+		return false
+	}
+
+	return isStop(string(contents))
+}
+
+// isKillSwitchURLStop is true when the URL reads stop. A request that fails
+// is logged but doesn't stop the drill, so a flaky kill switch can't abort
+// every drill.
+func (g *guardrails) isKillSwitchURLStop() bool {
+	res, err := g.client.Get(g.opts.killSwitchURL)
+	if err != nil {
+		log.WithError(err).Warn("Could not read the kill switch URL")
+		return false
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.WithError(err).Warn("Could not read the kill switch URL")
+		return false
+	}
+
+	return isStop(string(body))
+}
+
+func isStop(value string) bool {
+	return strings.EqualFold(strings.TrimSpace(value), killSwitchStop)
+}
+
+// monitor requests the monitored URL, returning the error rate over the
+// last window of requests and whether the window is full yet. A request that
+// fails or gets a server error counts as an error.
+func (g *guardrails) monitor() (float64, bool) {
+	failed := false
+	res, _, err := contentcheck.Get(g.opts.monitorURL, g.auth)
+	if err != nil {
+		failed = true
+	} else {
+		res.Body.Close()
+		failed = res.StatusCode >= 500
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.results = append(g.results, failed)
+	if len(g.results) > g.opts.window {
+		g.results = g.results[len(g.results)-g.opts.window:]
+	}
+
+	errors := 0
+	for _, f := range g.results {
+		if f {
+			errors++
+		}
+	}
+
+	return float64(errors) / float64(len(g.results)), len(g.results) == g.opts.window
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// stopFile writes a kill switch file, the returned function removes it
+func stopFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "guardrails")
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "kill-switch")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestGuardrailsKillSwitchFile(t *testing.T) {
+	path, cleanup := stopFile(t, "go\n")
+	defer cleanup()
+
+	g := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{killSwitchFile: path}, contentcheck.Auth{})
+	assert.Nil(t, g.check())
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(" STOP\n"), 0644))
+	assert.EqualError(t, g.check(), "the kill switch "+path+" says stop")
+}
+
+func TestGuardrailsMissingKillSwitchFile(t *testing.T) {
+	g := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{killSwitchFile: "/nonexistent/kill-switch"}, contentcheck.Auth{})
+	assert.Nil(t, g.check())
+}
+
+func TestGuardrailsKillSwitchURL(t *testing.T) {
+	value := "go"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, value)
+	}))
+	defer ts.Close()
+
+	g := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{killSwitchURL: ts.URL}, contentcheck.Auth{})
+	assert.Nil(t, g.check())
+
+	value = "stop"
+	assert.EqualError(t, g.check(), "the kill switch "+ts.URL+" says stop")
+}
+
+func TestGuardrailsAlarm(t *testing.T) {
+	mockCWSvc := &mockCloudWatchClient{FiringAlarms: [][]string{{"secondary-5xx"}}}
+
+	g := newGuardrails(mockCWSvc, guardrailOptions{alarms: []string{"secondary-5xx"}}, contentcheck.Auth{})
+	assert.EqualError(t, g.check(), "alarm secondary-5xx is firing")
+}
+
+func TestGuardrailsAlarmError(t *testing.T) {
+	mockCWSvc := &mockCloudWatchClient{Error: "DescribeAlarms"}
+
+	g := newGuardrails(mockCWSvc, guardrailOptions{alarms: []string{"secondary-5xx"}}, contentcheck.Auth{})
+	assert.Nil(t, g.check())
+}
+
+func TestGuardrailsMonitorErrorRate(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count > 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		count++
+	}))
+	defer ts.Close()
+
+	g := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{
+		monitorURL:   ts.URL,
+		maxErrorRate: 0.5,
+		window:       3,
+	}, contentcheck.Auth{})
+
+	// Nothing trips until the window is full
+	assert.Nil(t, g.check())
+	assert.Nil(t, g.check())
+	assert.EqualError(t, g.check(), "the error rate at "+ts.URL+" is 67%, over the maximum of 50%")
+}
+
+func TestGuardrailsWatchTrips(t *testing.T) {
+	path, cleanup := stopFile(t, "stop")
+	defer cleanup()
+
+	g := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{killSwitchFile: path}, contentcheck.Auth{})
+	stop := g.Watch(time.Millisecond)
+	defer stop()
+
+	select {
+	case <-g.Aborted():
+	case <-time.After(time.Second):
+		t.Fatal("The guardrail did not trip")
+	}
+	assert.Equal(t, "the kill switch "+path+" says stop", g.AbortReason())
+}
+
+func TestGuardrailsNil(t *testing.T) {
+	var g *guardrails
+
+	g.Watch(time.Millisecond)()
+	assert.Nil(t, g.Aborted())
+	assert.Equal(t, "", g.AbortReason())
+}
+
+func TestDoAbortedByGuardrail(t *testing.T) {
+	path, cleanup := stopFile(t, "stop")
+	defer cleanup()
+
+	// The secondary content never appears, only the guardrail ends the wait
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	phases := testPhases(1*time.Millisecond, 3*time.Millisecond)
+	phases.Failover.Timeout = time.Minute
+
+	recorder := &recordingNotifier{}
+	guards := newGuardrails(&mockCloudWatchClient{}, guardrailOptions{killSwitchFile: path}, contentcheck.Auth{})
+	start := time.Now()
+	opts := testDrill(ts.URL)
+	opts.phases = phases
+	opts.notify = notifiers{recorder}
+	opts.guards = guards
+	exitCode := do(testClients(&mockAutoScalingClient{Success: true}), opts)
+
+	assert.True(t, exitCode > 0)
+	assert.True(t, time.Since(start) < time.Minute)
+	assert.Equal(t, []string{eventStart, eventAborted, eventRestoreStarted, eventFailure}, recorder.types())
+	assert.Equal(t, "the kill switch "+path+" says stop", recorder.events[1].Details["reason"])
+}
+
+func TestLoadConfigGuardrails(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("guardrails.monitor.url", "https://www.mywebsite.com/health")
+	viper.Set("guardrails.monitor.maxErrorRate", 0.2)
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://www.mywebsite.com/health", cfg.guardrails.monitorURL)
+	assert.True(t, cfg.guardrails.enabled())
+}
+
+func TestLoadConfigMonitorNeedsURL(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("guardrails.monitor.maxErrorRate", 0.2)
+
+	// The drilled URL would count the failover page's errors
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - guardrails.monitor.url is required with guardrails.monitor.maxErrorRate")
+}
+
+func TestLoadConfigInvalidGuardrails(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("guardrails.killSwitch.url", "switch")
+	viper.Set("guardrails.monitor.url", "ftp://www.mywebsite.com")
+	viper.Set("guardrails.monitor.maxErrorRate", 5)
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - guardrails.killSwitch.url \"switch\" is not a valid URL\n"+
+		"  - guardrails.monitor.maxErrorRate must be between 0 and 1, got 5\n"+
+		"  - guardrails.monitor.url \"ftp://www.mywebsite.com\" is not a valid URL")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+)
+
+// The points in a drill a hook can run at
+const (
+	hookPreStandby       = "pre-standby"
+	hookFailoverDetected = "failover-detected"
+	hookPreRestore       = "pre-restore"
+	hookPostRestore      = "post-restore"
+	hookFailure          = "failure"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// hook runs a shell command or POSTs to a URL at one point in the drill, e.g.
+// to flush a cache once the site has failed over or run a smoke test suite
+// against the secondary. The event is given as JSON, on stdin or as the
+// request body, and to a command as DRILL_ environment variables too.
+type hook struct {
+	on      string
+	command string
+	url     string
+	timeout time.Duration
+
+	// A hook that fails only fails the drill when this is set, otherwise
+	// it is logged and the drill carries on
+	failOnError bool
+}
+
+// hooks run in the order they are configured
+type hooks []hook
+
+// hookPoint is where in the drill the event is, empty if no hook runs on it
+func hookPoint(e drill.Event) string {
+	switch {
+	case e.Type == drill.EventPhaseStarted && e.Phase == drill.PhaseStandby:
+		return hookPreStandby
+	case e.Type == drill.EventFailoverDetected:
+		return hookFailoverDetected
+	case e.Type == drill.EventRestoreStarted:
+		return hookPreRestore
+	case e.Type == drill.EventPhaseFinished && e.Phase == drill.PhaseRestore:
+		return hookPostRestore
+	case e.Type == drill.EventFailure:
+		return hookFailure
+	}
+
+	return ""
+}
+
+// run runs every hook for the point in the drill the event is at, now,
+// returning how many of them failed the drill
+func (hs hooks) run(run drillRun, asgName string, e drill.Event, now time.Time) int {
+	point := hookPoint(e)
+	if point == "" {
+		return 0
+	}
+
+	event := drillEvent{
+		Event:    point,
+		RunID:    run.id,
+		ASG:      asgName,
+		Operator: run.operator,
+		Time:     now.UTC(),
+		Message:  e.Message,
+		Details:  e.Details,
+	}
+
+	failures := 0
+	for _, h := range hs {
+		if h.on != point {
+			continue
+		}
+
+		logger := log.WithFields(log.Fields{
+			"on":      h.on,
+			"command": h.command,
+			"url":     h.url,
+		})
+
+		err := h.run(event)
+		switch {
+		case err == nil:
+			logger.Info("Ran the hook")
+		case h.failOnError:
+			logger.WithError(err).Error("The hook failed")
+			failures++
+		default:
+			logger.WithError(err).Warn("The hook failed, carrying on")
+		}
+	}
+
+	return failures
+}
+
+func (h hook) run(e drillEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.command != "" {
+		err = runHookCommand(ctx, h.command, e, body)
+	} else {
+		err = callHookURL(ctx, h.url, body)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the hook took longer than %s", timeout)
+	}
+
+	return err
+}
+
+// runHookCommand runs the command with the shell, its output going
+// straight to the app's so it ends up in the same logs
+func runHookCommand(ctx context.Context, command string, e drillEvent, body []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), hookEnv(e)...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func callHookURL(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the hook got %s", res.Status)
+	}
+
+	return nil
+}
+
+// hookEnv is the event as environment variables, each detail as
+// DRILL_DETAIL_ and its key, e.g. DRILL_DETAIL_EXIT_CODE for exitCode
+func hookEnv(e drillEvent) []string {
+	env := []string{
+		"DRILL_EVENT=" + e.Event,
+		"DRILL_RUN_ID=" + e.RunID,
+		"DRILL_ASG=" + e.ASG,
+		"DRILL_OPERATOR=" + e.Operator,
+		"DRILL_TIME=" + e.Time.Format(time.RFC3339),
+		"DRILL_MESSAGE=" + e.Message,
+	}
+
+	for _, key := range sortedStringKeys(e.Details) {
+		env = append(env, "DRILL_DETAIL_"+envName(key)+"="+e.Details[key])
+	}
+
+	return env
+}
+
+// envName turns a camel case key into an environment variable name
+func envName(key string) string {
+	name := ""
+	for i, r := range key {
+		if r >= 'A' && r <= 'Z' && i > 0 {
+			name += "_"
+		}
+		name += string(r)
+	}
+
+	return strings.ToUpper(name)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// hookDir gives the test somewhere for its hooks to write, the returned
+// function removes it
+func hookDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(t, err)
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func readLines(t *testing.T, path string) []string {
+	body, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	return strings.Split(strings.TrimSpace(string(body)), "\n")
+}
+
+func TestHookPoint(t *testing.T) {
+	tests := []struct {
+		event drill.Event
+		point string
+	}{
+		{drill.Event{Type: drill.EventStart}, ""},
+		{drill.Event{Type: drill.EventPhaseStarted, Phase: drill.PhaseStandby}, hookPreStandby},
+		{drill.Event{Type: drill.EventPhaseFinished, Phase: drill.PhaseStandby}, ""},
+		{drill.Event{Type: drill.EventFailoverDetected}, hookFailoverDetected},
+		{drill.Event{Type: drill.EventRestoreStarted}, hookPreRestore},
+		{drill.Event{Type: drill.EventPhaseStarted, Phase: drill.PhaseRestore}, ""},
+		{drill.Event{Type: drill.EventPhaseFinished, Phase: drill.PhaseRestore}, hookPostRestore},
+		{drill.Event{Type: drill.EventSuccess}, ""},
+		{drill.Event{Type: drill.EventFailure}, hookFailure},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.point, hookPoint(test.event), test.event.Type+" "+test.event.Phase)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "EXIT_CODE", envName("exitCode"))
+	assert.Equal(t, "TOOK", envName("took"))
+}
+
+func TestHookCommand(t *testing.T) {
+	dir, cleanup := hookDir(t)
+	defer cleanup()
+
+	env := filepath.Join(dir, "env")
+	stdin := filepath.Join(dir, "stdin")
+	hs := hooks{{
+		on:      hookFailure,
+		command: fmt.Sprintf(`echo "$DRILL_EVENT $DRILL_RUN_ID $DRILL_ASG $DRILL_TIME $DRILL_DETAIL_EXIT_CODE" > %s; cat > %s`, env, stdin),
+	}}
+
+	failures := hs.run(testRun, "prod", drill.Event{
+		Type:    drill.EventFailure,
+		Message: "The drill failed",
+		Details: map[string]string{"exitCode": "2"},
+	}, testStart)
+	assert.Equal(t, 0, failures)
+	assert.Equal(t, []string{"failure " + testRun.id + " prod 2017-06-01T09:00:00Z 2"}, readLines(t, env))
+
+	body, err := ioutil.ReadFile(stdin)
+	assert.Nil(t, err)
+
+	var e drillEvent
+	assert.Nil(t, json.Unmarshal(body, &e))
+	assert.Equal(t, hookFailure, e.Event)
+	assert.Equal(t, "The drill failed", e.Message)
+	assert.Equal(t, "2", e.Details["exitCode"])
+}
+
+func TestHookOnlyRunsAtItsPoint(t *testing.T) {
+	dir, cleanup := hookDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ran")
+	hs := hooks{{on: hookPreRestore, command: "touch " + path}}
+
+	hs.run(testRun, "prod", drill.Event{Type: drill.EventFailoverDetected}, testStart)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	hs.run(testRun, "prod", drill.Event{Type: drill.EventRestoreStarted}, testStart)
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestHookFails(t *testing.T) {
+	h := hook{on: hookFailure, command: "exit 3"}
+	assert.EqualError(t, h.run(drillEvent{}), "exit status 3")
+
+	// Only a hook that fails on error counts against the drill
+	e := drill.Event{Type: drill.EventFailure}
+	assert.Equal(t, 0, hooks{h}.run(testRun, "prod", e, testStart))
+
+	h.failOnError = true
+	assert.Equal(t, 2, hooks{h, h}.run(testRun, "prod", e, testStart))
+}
+
+func TestHookTimesOut(t *testing.T) {
+	h := hook{command: "exec sleep 5", timeout: 10 * time.Millisecond}
+
+	start := time.Now()
+	assert.EqualError(t, h.run(drillEvent{}), "the hook took longer than 10ms")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestHookURL(t *testing.T) {
+	var method, contentType string
+	var e drillEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&e)
+	}))
+	defer ts.Close()
+
+	failures := hooks{{on: hookFailoverDetected, url: ts.URL, failOnError: true}}.run(
+		testRun, "prod", drill.Event{Type: drill.EventFailoverDetected, Message: "The secondary content was found"}, testStart)
+
+	assert.Equal(t, 0, failures)
+	assert.Equal(t, "POST", method)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, hookFailoverDetected, e.Event)
+	assert.Equal(t, "prod", e.ASG)
+	assert.Equal(t, "The secondary content was found", e.Message)
+}
+
+func TestHookURLFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	h := hook{url: ts.URL}
+	assert.EqualError(t, h.run(drillEvent{}), "the hook got 500 Internal Server Error")
+}
+
+func TestDoRunsHooks(t *testing.T) {
+	dir, cleanup := hookDir(t)
+	defer cleanup()
+
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(dir, "ran")
+	hs := hooks{}
+	for _, point := range []string{hookPreStandby, hookFailoverDetected, hookPreRestore, hookPostRestore, hookFailure} {
+		hs = append(hs, hook{on: point, command: `echo "$DRILL_EVENT" >> ` + path})
+	}
+	hs = append(hs, hook{on: hookPostRestore, command: "exit 1", failOnError: true})
+
+	mockSvc := &mockAutoScalingClient{Success: true}
+	opts := testDrill(ts.URL)
+	opts.hooks = hs
+	exitCode := do(testClients(mockSvc), opts)
+
+	// The failing post-restore hook fails the drill, so the failure hooks run
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, []string{
+		hookPreStandby,
+		hookFailoverDetected,
+		hookPreRestore,
+		hookPostRestore,
+		hookFailure,
+	}, readLines(t, path))
+}
+
+func TestDoStopsOnPreStandbyHook(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	recorder := &recordingNotifier{}
+	mockSvc := &mockAutoScalingClient{Success: true}
+	opts := testDrill(ts.URL)
+	opts.notify = notifiers{recorder}
+	opts.hooks = hooks{{on: hookPreStandby, command: "exit 1", failOnError: true}}
+	exitCode := do(testClients(mockSvc), opts)
+
+	// The instances are never put into standby
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, 0, mockSvc.enterStandbyCount)
+	assert.Equal(t, []string{eventStart, eventRestoreStarted, eventFailure}, recorder.types())
+}
+
+func TestLoadConfigHooks(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("hooks", []map[string]interface{}{
+		{"on": "failover-detected", "command": "./purge-cache.sh", "timeout": "2m", "failOnError": true},
+		{"on": "failure", "url": "https://hooks.mywebsite.com/drill"},
+	})
+
+	cfg, err := loadConfig(requireASG | requireContent)
+	assert.Nil(t, err)
+	assert.Equal(t, hooks{
+		{on: hookFailoverDetected, command: "./purge-cache.sh", timeout: 2 * time.Minute, failOnError: true},
+		{on: hookFailure, url: "https://hooks.mywebsite.com/drill"},
+	}, cfg.hooks)
+}
+
+func TestLoadConfigInvalidHooks(t *testing.T) {
+	defer viper.Reset()
+	setValidConfig()
+	viper.Set("hooks", []map[string]interface{}{
+		{"on": "sometime", "command": "true"},
+		{"on": "failure"},
+		{"on": "failure", "command": "true", "url": "https://hooks.mywebsite.com/drill"},
+		{"on": "failure", "url": "hooks", "timeout": "soon"},
+	})
+
+	_, err := loadConfig(requireASG | requireContent)
+	assert.EqualError(t, err, "invalid config:\n"+
+		"  - hooks[0].on \"sometime\" is unknown, expected pre-standby, failover-detected, pre-restore, post-restore or failure\n"+
+		"  - hooks[1] needs a command or a url\n"+
+		"  - hooks[2] can have a command or a url, not both\n"+
+		"  - hooks[3].url \"hooks\" is not a valid URL\n"+
+		"  - hooks[3].timeout \"soon\" is not a number of seconds or a duration like 30s")
+}
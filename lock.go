@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// Lock backends
+const (
+	lockBackendASGTag = "asg-tag"
+	lockBackendFile   = "file"
+	lockBackendNone   = "none"
+)
+
+// The autoscaling group tags holding the lock. The owner has a tag of its
+// own as operator names can hold spaces.
+const (
+	lockTag      = "anarchy-kitten:lock"
+	lockOwnerTag = "anarchy-kitten:lock-owner"
+)
+
+// lockSettle is how long the tag lock waits after writing its tag before
+// reading it back, so a run that saw the group unlocked at the same time
+// has written its own tag by then
+const lockSettle = 5 * time.Second
+
+// lockInfo identifies the run holding a lock. A lock past its expiry is
+// stale, e.g. left by a crashed run, and can be taken over.
+type lockInfo struct {
+	RunID   string    `json:"runId"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l lockInfo) expired() bool {
+	return time.Now().After(l.Expires)
+}
+
+// lockHeldError is returned when another run holds the lock
+type lockHeldError struct {
+	held lockInfo
+}
+
+func (e *lockHeldError) Error() string {
+	return fmt.Sprintf(
+		"locked by %s (run %s) until %s",
+		e.held.Owner,
+		e.held.RunID,
+		e.held.Expires.Format(time.RFC3339))
+}
+
+// drillLock stops two runs drilling the same autoscaling group at once, as
+// their standby calls would fight each other
+type drillLock interface {
+	acquire(l lockInfo) error
+	renew(l lockInfo) error
+	release(l lockInfo) error
+	forceUnlock() error
+}
+
+// lockLostError is returned when renewing a lock another run has taken over
+type lockLostError struct {
+	held lockInfo
+}
+
+func (e *lockLostError) Error() string {
+	return fmt.Sprintf("the lock was taken over by %s (run %s)", e.held.Owner, e.held.RunID)
+}
+
+// newDrillLock returns the backend for the group
+func newDrillLock(
+	backend string,
+	svc autoscalingiface.AutoScalingAPI,
+	asgName string,
+	dir string) (drillLock, error) {
+	switch backend {
+	case lockBackendASGTag:
+		return &asgTagLock{svc: svc, asgName: asgName, clock: clock.Real{}}, nil
+	case lockBackendFile:
+		return &fileLock{path: filepath.Join(dir, "anarchy-kitten-"+asgName+".lock")}, nil
+	case lockBackendNone:
+		return noLock{}, nil
+	}
+
+	return nil, fmt.Errorf("lock.backend %q is unknown, expected asg-tag, file or none", backend)
+}
+
+// newRunID returns a random ID for a drill run
+func newRunID() string {
+	id, err := randomHex(8)
+	if err != nil {
+		log.WithError(err).Fatal("Could not generate a run ID")
+	}
+
+	return id
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// withLock runs f while holding the lock for the run, first removing any
+// existing lock if forced to. f is given a renew func pushing the lock's
+// expiry back by another ttl, for the parts of a drill that can run long.
+func withLock(
+	lock drillLock,
+	run drillRun,
+	ttl time.Duration,
+	force bool,
+	f func(renew func()) int) int {
+	if force {
+		log.Warn("Forcing the lock open")
+		err := lock.forceUnlock()
+		if err != nil {
+			log.WithError(err).Error("Could not force the lock open")
+			return 1
+		}
+	}
+
+	l := lockInfo{
+		RunID:   run.id,
+		Owner:   run.operator,
+		Expires: time.Now().Add(ttl),
+	}
+
+	err := lock.acquire(l)
+	if err != nil {
+		log.WithError(err).Error("Could not lock the autoscaling group, use --force-unlock if the lock is left from a crashed run")
+		return 1
+	}
+	log.WithFields(log.Fields{
+		"runId":   l.RunID,
+		"owner":   l.Owner,
+		"expires": l.Expires,
+	}).Info("Locked the autoscaling group")
+
+	exitCode := f(func() {
+		l.Expires = time.Now().Add(ttl)
+		err := lock.renew(l)
+		if err != nil {
+			log.WithError(err).Warn("Could not renew the lock")
+			return
+		}
+		log.WithField("expires", l.Expires).Debug("Renewed the lock")
+	})
+
+	err = lock.release(l)
+	if err != nil {
+		log.WithError(err).Error("Could not release the lock")
+		exitCode++
+	}
+
+	return exitCode
+}
+
+type noLock struct{}
+
+func (noLock) acquire(lockInfo) error { return nil }
+func (noLock) renew(lockInfo) error   { return nil }
+func (noLock) release(lockInfo) error { return nil }
+func (noLock) forceUnlock() error     { return nil }
+
+// asgTagLock keeps the lock in a tag on the autoscaling group so it works
+// across machines. There is no compare and swap for tags so after writing the
+// tag, and waiting lockSettle for any racing run to write its own, it is read
+// back to see which run won. This makes the lock advisory: it keeps people
+// and pipelines from drilling the same group by accident, but two runs whose
+// writes land more than lockSettle apart after both saw the group unlocked
+// could each think they hold it.
+type asgTagLock struct {
+	svc     autoscalingiface.AutoScalingAPI
+	asgName string
+	clock   clock.Clock
+}
+
+func (a *asgTagLock) acquire(l lockInfo) error {
+	held, ok, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	if ok && !held.expired() {
+		return &lockHeldError{held: held}
+	}
+
+	if ok {
+		log.WithField("runId", held.RunID).Warn("Taking over a stale lock")
+	}
+
+	err = a.write(l)
+	if err != nil {
+		return err
+	}
+
+	a.clock.Sleep(lockSettle)
+
+	held, ok, err = a.read()
+	if err != nil {
+		return err
+	}
+
+	if !ok || held.RunID != l.RunID {
+		return &lockHeldError{held: held}
+	}
+
+	return nil
+}
+
+func (a *asgTagLock) renew(l lockInfo) error {
+	held, ok, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	if !ok || held.RunID != l.RunID {
+		return &lockLostError{held: held}
+	}
+
+	return a.write(l)
+}
+
+func (a *asgTagLock) write(l lockInfo) error {
+	_, err := a.svc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{
+			a.tag(lockTag, formatLockTag(l)),
+			a.tag(lockOwnerTag, l.Owner),
+		},
+	})
+
+	return err
+}
+
+func (a *asgTagLock) release(l lockInfo) error {
+	held, ok, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	if !ok || held.RunID != l.RunID {
+		log.WithField("runId", held.RunID).Warn("The lock is no longer ours, leaving it")
+		return nil
+	}
+
+	return a.forceUnlock()
+}
+
+func (a *asgTagLock) forceUnlock() error {
+	_, err := a.svc.DeleteTags(&autoscaling.DeleteTagsInput{
+		Tags: []*autoscaling.Tag{a.tag(lockTag, ""), a.tag(lockOwnerTag, "")},
+	})
+
+	return err
+}
+
+func (a *asgTagLock) tag(key string, value string) *autoscaling.Tag {
+	return &autoscaling.Tag{
+		Key:               aws.String(key),
+		Value:             aws.String(value),
+		ResourceId:        aws.String(a.asgName),
+		ResourceType:      aws.String("auto-scaling-group"),
+		PropagateAtLaunch: aws.Bool(false),
+	}
+}
+
+// read returns the lock in the tag and whether there is one
+func (a *asgTagLock) read() (lockInfo, bool, error) {
+	resp, err := a.svc.DescribeTags(&autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{
+				Name:   aws.String("auto-scaling-group"),
+				Values: []*string{aws.String(a.asgName)},
+			},
+			{
+				Name:   aws.String("key"),
+				Values: []*string{aws.String(lockTag), aws.String(lockOwnerTag)},
+			},
+		},
+	})
+	if err != nil {
+		return lockInfo{}, false, err
+	}
+
+	l, ok, owner := lockInfo{}, false, ""
+	for _, tag := range resp.Tags {
+		switch aws.StringValue(tag.Key) {
+		case lockTag:
+			l, ok = parseLockTag(aws.StringValue(tag.Value)), true
+		case lockOwnerTag:
+			owner = aws.StringValue(tag.Value)
+		}
+	}
+	l.Owner = owner
+
+	return l, ok, nil
+}
+
+// Tag values can't hold JSON so the lock is written as space separated
+// key=value pairs, the owner is kept in lockOwnerTag
+func formatLockTag(l lockInfo) string {
+	return fmt.Sprintf(
+		"run=%s expires=%s",
+		l.RunID,
+		l.Expires.UTC().Format(time.RFC3339))
+}
+
+// parseLockTag reads a lock tag, an unreadable expiry counts as expired
+func parseLockTag(value string) lockInfo {
+	l := lockInfo{}
+
+	for _, field := range strings.Fields(value) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "run":
+			l.RunID = kv[1]
+		case "expires":
+			l.Expires, _ = time.Parse(time.RFC3339, kv[1])
+		}
+	}
+
+	return l
+}
+
+// fileLock keeps the lock in a local file, for when every run happens on
+// the same machine or a shared disk
+type fileLock struct {
+	path string
+}
+
+func (f *fileLock) acquire(l lockInfo) error {
+	contents, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	// Try again once if a stale lock was removed
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.Write(contents)
+			file.Close()
+			return err
+		}
+
+		if !os.IsExist(err) {
+			return err
+		}
+
+		held, err := f.read()
+		if err != nil {
+			return err
+		}
+
+		if !held.expired() {
+			return &lockHeldError{held: held}
+		}
+
+		log.WithField("runId", held.RunID).Warn("Taking over a stale lock")
+		err = f.forceUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("could not create the lock file %s", f.path)
+}
+
+func (f *fileLock) renew(l lockInfo) error {
+	held, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	if held.RunID != l.RunID {
+		return &lockLostError{held: held}
+	}
+
+	contents, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.path, contents, 0644)
+}
+
+func (f *fileLock) release(l lockInfo) error {
+	held, err := f.read()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if held.RunID != l.RunID {
+		log.WithField("runId", held.RunID).Warn("The lock is no longer ours, leaving it")
+		return nil
+	}
+
+	return f.forceUnlock()
+}
+
+func (f *fileLock) forceUnlock() error {
+	err := os.Remove(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// read returns the lock in the file, an unreadable one counts as expired
+func (f *fileLock) read() (lockInfo, error) {
+	l := lockInfo{}
+
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return l, err
+	}
+
+	err = json.Unmarshal(contents, &l)
+	if err != nil {
+		log.WithError(err).WithField("lockFile", f.path).Warn("Could not read the lock file")
+	}
+
+	return l, nil
+}
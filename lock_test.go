@@ -0,0 +1,269 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLockInfo(runID string, expires time.Duration) lockInfo {
+	return lockInfo{
+		RunID:   runID,
+		Owner:   "alice@host",
+		Expires: time.Now().Add(expires).Truncate(time.Second),
+	}
+}
+
+func TestNewDrillLock(t *testing.T) {
+	lock, err := newDrillLock(lockBackendFile, nil, "prod", "/var/lock")
+	assert.Nil(t, err)
+	assert.Equal(t, &fileLock{path: "/var/lock/anarchy-kitten-prod.lock"}, lock)
+
+	_, err = newDrillLock("zookeeper", nil, "prod", "")
+	assert.EqualError(t, err, `lock.backend "zookeeper" is unknown, expected asg-tag, file or none`)
+}
+
+func TestLockTagRoundTrip(t *testing.T) {
+	l := testLockInfo("abc", time.Hour)
+
+	assert.Equal(t, l.RunID, parseLockTag(formatLockTag(l)).RunID)
+	assert.True(t, l.Expires.Equal(parseLockTag(formatLockTag(l)).Expires))
+}
+
+func TestParseLockTagUnreadableExpiry(t *testing.T) {
+	assert.True(t, parseLockTag("run=abc expires=tomorrow").expired())
+}
+
+func TestASGTagLock(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	lock := &asgTagLock{svc: mockSvc, asgName: "prod", clock: testClock()}
+
+	first := testLockInfo("first", time.Hour)
+	assert.Nil(t, lock.acquire(first))
+	assert.Contains(t, mockSvc.Tags[lockTag], "run=first")
+	assert.Equal(t, "alice@host", mockSvc.Tags[lockOwnerTag])
+
+	err := lock.acquire(testLockInfo("second", time.Hour))
+	assert.IsType(t, &lockHeldError{}, err)
+	assert.Contains(t, err.Error(), "locked by alice@host (run first) until")
+
+	// Releasing someone else's lock leaves it
+	assert.Nil(t, lock.release(testLockInfo("second", time.Hour)))
+	assert.Contains(t, mockSvc.Tags[lockTag], "run=first")
+
+	assert.Nil(t, lock.release(first))
+	assert.Empty(t, mockSvc.Tags)
+}
+
+func TestASGTagLockWaitsToSettle(t *testing.T) {
+	c := testClock()
+	lock := &asgTagLock{svc: &mockAutoScalingClient{}, asgName: "prod", clock: c}
+
+	assert.Nil(t, lock.acquire(testLockInfo("first", time.Hour)))
+	assert.Equal(t, lockSettle, c.Elapsed())
+}
+
+func TestASGTagLockOwnerWithSpaces(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	lock := &asgTagLock{svc: mockSvc, asgName: "prod", clock: testClock()}
+
+	first := testLockInfo("first", time.Hour)
+	first.Owner = "Alice Smith"
+	assert.Nil(t, lock.acquire(first))
+
+	held, ok, err := lock.read()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "first", held.RunID)
+	assert.Equal(t, "Alice Smith", held.Owner)
+	assert.True(t, first.Expires.Equal(held.Expires))
+}
+
+func TestASGTagLockRenew(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	lock := &asgTagLock{svc: mockSvc, asgName: "prod", clock: testClock()}
+
+	first := testLockInfo("first", time.Minute)
+	assert.Nil(t, lock.acquire(first))
+
+	first.Expires = first.Expires.Add(time.Hour)
+	assert.Nil(t, lock.renew(first))
+	held, _, err := lock.read()
+	assert.Nil(t, err)
+	assert.True(t, first.Expires.Equal(held.Expires))
+
+	err = lock.renew(testLockInfo("second", time.Hour))
+	assert.EqualError(t, err, "the lock was taken over by alice@host (run first)")
+}
+
+func TestASGTagLockTakesOverStaleLock(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	lock := &asgTagLock{svc: mockSvc, asgName: "prod", clock: testClock()}
+
+	assert.Nil(t, lock.acquire(testLockInfo("crashed", -time.Minute)))
+	assert.Nil(t, lock.acquire(testLockInfo("next", time.Hour)))
+	assert.Contains(t, mockSvc.Tags[lockTag], "run=next")
+}
+
+func TestASGTagLockForceUnlock(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	lock := &asgTagLock{svc: mockSvc, asgName: "prod", clock: testClock()}
+
+	assert.Nil(t, lock.acquire(testLockInfo("first", time.Hour)))
+	assert.Nil(t, lock.forceUnlock())
+	assert.Nil(t, lock.acquire(testLockInfo("second", time.Hour)))
+}
+
+// racingClient lets another run write the lock tag straight after ours
+type racingClient struct {
+	*mockAutoScalingClient
+}
+
+func (r racingClient) CreateOrUpdateTags(
+	input *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	out, err := r.mockAutoScalingClient.CreateOrUpdateTags(input)
+	r.Tags[lockTag] = formatLockTag(testLockInfo("other", time.Hour))
+	return out, err
+}
+
+func TestASGTagLockLosesRace(t *testing.T) {
+	lock := &asgTagLock{svc: racingClient{&mockAutoScalingClient{}}, asgName: "prod", clock: testClock()}
+
+	err := lock.acquire(testLockInfo("ours", time.Hour))
+	assert.IsType(t, &lockHeldError{}, err)
+}
+
+func TestASGTagLockError(t *testing.T) {
+	lock := &asgTagLock{svc: &mockAutoScalingClient{Error: "DescribeTags"}, asgName: "prod", clock: testClock()}
+
+	assert.NotNil(t, lock.acquire(testLockInfo("first", time.Hour)))
+}
+
+func testFileLock(t *testing.T) (*fileLock, func()) {
+	dir, err := ioutil.TempDir("", "lock")
+	assert.Nil(t, err)
+
+	return &fileLock{path: filepath.Join(dir, "drill.lock")}, func() { os.RemoveAll(dir) }
+}
+
+func TestFileLock(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	first := testLockInfo("first", time.Hour)
+	assert.Nil(t, lock.acquire(first))
+
+	err := lock.acquire(testLockInfo("second", time.Hour))
+	assert.IsType(t, &lockHeldError{}, err)
+
+	assert.Nil(t, lock.release(testLockInfo("second", time.Hour)))
+	_, err = os.Stat(lock.path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, lock.release(first))
+	_, err = os.Stat(lock.path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Releasing twice is fine
+	assert.Nil(t, lock.release(first))
+}
+
+func TestFileLockRenew(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	first := testLockInfo("first", time.Minute)
+	assert.Nil(t, lock.acquire(first))
+
+	first.Expires = first.Expires.Add(time.Hour)
+	assert.Nil(t, lock.renew(first))
+	held, err := lock.read()
+	assert.Nil(t, err)
+	assert.True(t, first.Expires.Equal(held.Expires))
+
+	err = lock.renew(testLockInfo("second", time.Hour))
+	assert.IsType(t, &lockLostError{}, err)
+}
+
+func TestFileLockTakesOverStaleLock(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	assert.Nil(t, lock.acquire(testLockInfo("crashed", -time.Minute)))
+	assert.Nil(t, lock.acquire(testLockInfo("next", time.Hour)))
+
+	held, err := lock.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "next", held.RunID)
+}
+
+func TestFileLockUnreadableIsStale(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(lock.path, []byte("garbage"), 0644))
+	assert.Nil(t, lock.acquire(testLockInfo("next", time.Hour)))
+}
+
+func TestWithLock(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	exitCode := withLock(lock, drillRun{id: "run", operator: "alice@host"}, time.Hour, false, func(func()) int {
+		_, err := os.Stat(lock.path)
+		assert.Nil(t, err)
+		return 0
+	})
+
+	assert.Equal(t, 0, exitCode)
+	_, err := os.Stat(lock.path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWithLockHeld(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+	assert.Nil(t, lock.acquire(testLockInfo("other", time.Hour)))
+
+	ran := false
+	exitCode := withLock(lock, drillRun{id: "run", operator: "alice@host"}, time.Hour, false, func(func()) int {
+		ran = true
+		return 0
+	})
+
+	assert.Equal(t, 1, exitCode)
+	assert.False(t, ran)
+}
+
+func TestWithLockForced(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+	assert.Nil(t, lock.acquire(testLockInfo("other", time.Hour)))
+
+	exitCode := withLock(lock, drillRun{id: "run", operator: "alice@host"}, time.Hour, true, func(func()) int { return 0 })
+
+	assert.Equal(t, 0, exitCode)
+}
+
+func TestWithLockRenews(t *testing.T) {
+	lock, cleanup := testFileLock(t)
+	defer cleanup()
+
+	var before, after lockInfo
+	exitCode := withLock(lock, drillRun{id: "run", operator: "alice@host"}, time.Hour, false, func(renew func()) int {
+		before, _ = lock.read()
+		time.Sleep(10 * time.Millisecond)
+		renew()
+		after, _ = lock.read()
+		return 0
+	})
+
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "run", after.RunID)
+	assert.True(t, after.Expires.After(before.Expires))
+}
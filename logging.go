@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// Any log field whose name contains one of these is never written out.
+var sensitiveFields = []string{
+	"password",
+	"secret",
+	"token",
+	"authorization",
+	"credential",
+}
+
+// redactingFormatter replaces the values of sensitive fields before handing
+// the entry to the real formatter.
+type redactingFormatter struct {
+	formatter log.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := log.Fields{}
+	for key, value := range entry.Data {
+		if isSensitiveField(key) {
+			value = redacted
+		}
+		data[key] = value
+	}
+
+	redactedEntry := *entry
+	redactedEntry.Data = data
+
+	return f.formatter.Format(&redactedEntry)
+}
+
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range sensitiveFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func configureLogging(level string, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	var formatter log.Formatter
+	switch format {
+	case "text":
+		formatter = &log.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+
+	log.SetLevel(lvl)
+	log.SetFormatter(&redactingFormatter{formatter: formatter})
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSensitiveField(t *testing.T) {
+	assert.True(t, isSensitiveField("auth.password"))
+	assert.True(t, isSensitiveField("AWS_SECRET_ACCESS_KEY"))
+	assert.True(t, isSensitiveField("bearerToken"))
+	assert.False(t, isSensitiveField("auth.user"))
+	assert.False(t, isSensitiveField("url"))
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = &redactingFormatter{formatter: &log.JSONFormatter{}}
+
+	logger.WithFields(log.Fields{
+		"auth.user":     "USER",
+		"auth.password": "PASSWORD",
+	}).Info("Parameters")
+
+	fields := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "USER", fields["auth.user"])
+	assert.Equal(t, redacted, fields["auth.password"])
+	assert.NotContains(t, buf.String(), "PASSWORD")
+}
+
+func TestRedactingFormatterLeavesEntryAlone(t *testing.T) {
+	entry := log.NewEntry(log.New()).WithField("password", "PASSWORD")
+	formatter := &redactingFormatter{formatter: &log.TextFormatter{}}
+
+	_, err := formatter.Format(entry)
+	assert.Nil(t, err)
+	assert.Equal(t, "PASSWORD", entry.Data["password"])
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+
+	assert.Nil(t, configureLogging("warning", "json"))
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+}
+
+func TestConfigureLoggingInvalidLevel(t *testing.T) {
+	assert.NotNil(t, configureLogging("loud", "text"))
+}
+
+func TestConfigureLoggingInvalidFormat(t *testing.T) {
+	assert.EqualError(
+		t,
+		configureLogging("info", "xml"),
+		"unknown log format \"xml\", expected text or json")
+}
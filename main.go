@@ -1,513 +1,360 @@
 package main
 
 import (
-	"crypto/tls"
-	"errors"
-	"io/ioutil"
-	"net/http"
-	neturl "net/url"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/growkudos/Anarchy-Kitten/asg"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
-type contentAuth struct {
-	user     string
-	password string
-	insecure bool
-}
-
-type pollASGActivities func(
-	*autoscaling.DescribeScalingActivitiesInput,
-	autoscalingiface.AutoScalingAPI,
-	string,
-) (bool, error)
-
 func main() {
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	log.SetFormatter(&redactingFormatter{
+		formatter: &log.TextFormatter{FullTimestamp: true},
+	})
 	log.SetOutput(os.Stdout)
-	log.SetLevel(log.DebugLevel)
-
-	viper.AutomaticEnv()
-	viper.SetDefault("poll", 10)
-	viper.SetDefault("timeout", 600)
-	viper.SetDefault("auth.insecure", false)
-	viper.SetConfigName("config") // name of config file (without extension)
-	viper.AddConfigPath(".")      // look for config in the working directory
-	err := viper.ReadInConfig()   // Find and read the config file
-	if err != nil {               // Handle errors reading the config file
-		log.WithError(err).Panic("Fatal error trying to read the config file")
-	}
-
-	sess := session.Must(session.NewSession())
-	svc := autoscaling.New(sess)
-
-	os.Exit(do(
-		svc,
-		viper.GetString("primary"),
-		viper.GetString("secondary"),
-		viper.GetString("url"),
-		contentAuth{
-			user:     viper.GetString("auth.user"),
-			password: viper.GetString("auth.password"),
-			insecure: viper.GetBool("auth.insecure"),
-		},
-		(time.Duration(viper.GetInt("poll")))*time.Second,
-		(time.Duration(viper.GetInt("timeout")))*time.Second))
-}
-
-func do(
-	svc autoscalingiface.AutoScalingAPI,
-	primary string,
-	secondary string,
-	u string,
-	auth contentAuth,
-	poll time.Duration,
-	timeout time.Duration,
-) int {
-	log.WithFields(log.Fields{
-		"primary":       primary,
-		"secondary":     secondary,
-		"poll":          poll,
-		"timeout":       timeout,
-		"auth.user":     auth.user,
-		"auth.password": auth.password,
-		"auth.insecure": auth.insecure,
-	}).Info("Parameters")
-
-	exitCode := 0
-
-	asgName := os.Getenv("ASG_NAME")
-	err := validateAwsCredentials()
-	if err != nil {
-		log.WithError(err).Fatal("AWS environment variables needed")
-	}
-
-	instanceIDs := getInstanceIDs(getInstancesInAutoScalingGroup(&asgName, svc))
-	result := enterStandby(asgName, svc, instanceIDs, poll, timeout)
-	exitCode += result
-
-	if result == 0 {
-		exitCode += pollForContent(secondary, u, auth, poll, timeout, checkForContentAtURL)
-	}
-
-	// This tries forever to get all the instances back into service
-	for !areAllInstancesInService(
-		getInstancesInAutoScalingGroup(&asgName, svc)) {
-
-		exitCode += exitStandby(
-			asgName,
-			svc,
-			instanceIDs,
-			poll,
-			timeout,
-			func(in bool) bool { return in },
-		)
-	}
-
-	// Now check that the content of the url is the original primary content
-	exitCode += pollForContent(primary, u, auth, poll, timeout, checkForContentAtURL)
 
-	log.WithFields(log.Fields{
-		"extCode": exitCode,
-	}).Info("Finished")
-
-	return exitCode
+	os.Exit(runCLI(os.Args[1:]))
 }
 
-func areAllInstancesInService(instances []*autoscaling.Instance) bool {
-	log.WithField("instances", instances).Debug("areAllInstancesInService")
-	for _, i := range instances {
-		if *(i.LifecycleState) != "InService" {
-			log.WithField("instances", instances).Info("Some instances not in service")
-			return false
-		}
-	}
-
-	log.Info("All instances now in service")
-	return true
+// awsClients are the AWS services a drill talks to
+type awsClients struct {
+	asg        autoscalingiface.AutoScalingAPI
+	elb        elbv2iface.ELBV2API
+	ec2        ec2iface.EC2API
+	cloudWatch cloudwatchiface.CloudWatchAPI
+	sts        stsiface.STSAPI
 }
 
-func pollForContent(
-	content string,
-	u string,
-	auth contentAuth,
-	poll time.Duration,
-	timeout time.Duration,
-	check func(string, string, contentAuth) int,
-) int {
-
-	done := make(chan bool)
-	ticker := time.NewTicker(poll)
-	go func() {
-		for t := range ticker.C {
-			log.WithField("t", t).Debug("Poll for content check")
-			if check(content, u, auth) == 0 {
-				done <- true
-			}
-		}
-	}()
-
-	select {
-	case _ = <-done:
-		ticker.Stop()
-		log.Info("Content check polling finished")
-		return 0
-	case <-time.After(timeout):
-		ticker.Stop()
-		log.Warn("Content check polling timed out")
-		return 1
-	}
+// drillOptions are what a drill needs beyond the AWS clients, mostly
+// straight from the config
+type drillOptions struct {
+	run       drillRun
+	asg       string
+	url       string
+	primary   string
+	secondary string
+	scripts   contentScripts
+	auth      contentcheck.Auth
+	phases    drill.Phases
+	drift     string
+	notify    notifiers
+	hooks     hooks
+
+	// The CloudWatch checks made on each poll of the hold
+	holdCloudWatch cloudWatchChecks
+
+	// The guardrails that can abort the drill, nil for none
+	guards *guardrails
+
+	// The clock the drill is timed by, the wall clock when nil
+	clock clock.Clock
+
+	// The spans the drill's calls are traced in, a new set when nil
+	spans *drillSpans
+
+	// Pushes back the lock's expiry as the hold and recovery start, as a
+	// long drill can outlast the lock's TTL. Nil when there's no lock.
+	renewLock func()
+
+	// Start even when the group is still tagged by an earlier drill
+	ignoreDrillTags bool
 }
 
-func checkForContentAtURL(content string, u string, auth contentAuth) int {
+func do(clients awsClients, o drillOptions) int {
+	phases := o.phases
 	log.WithFields(log.Fields{
-		"url":     u,
-		"content": content,
-	}).Debug("checkForContentAtURL")
+		"runId":            o.run.id,
+		"operator":         o.run.operator,
+		"asg":              o.asg,
+		"primary":          o.primary,
+		"secondary":        o.secondary,
+		"standby.poll":     phases.Standby.Poll,
+		"standby.timeout":  phases.Standby.Timeout,
+		"failover.poll":    phases.Failover.Poll,
+		"failover.timeout": phases.Failover.Timeout,
+		"hold.duration":    phases.Hold.Duration,
+		"hold.poll":        phases.Hold.Poll,
+		"hold.budget":      phases.Hold.Budget,
+		"restore.poll":     phases.Restore.Poll,
+		"restore.timeout":  phases.Restore.Timeout,
+		"recovery.poll":    phases.Recovery.Poll,
+		"recovery.timeout": phases.Recovery.Timeout,
+		"deadline":         phases.Deadline,
+		"drift":            o.drift,
+		"auth.user":        o.auth.User,
+		"auth.insecure":    o.auth.Insecure,
+	}).Info("Parameters")
 
-	_, err := neturl.ParseRequestURI(u)
-	if err != nil {
-		log.
-			WithError(err).
-			WithField("url", u).
-			Error("Could not parse the URL")
+	if o.asg == "" {
+		log.Error("The autoscaling group name (asg) is needed")
 		return 1
 	}
 
-	res, err := getURL(u, auth.user, auth.password, auth.insecure)
-	if err != nil {
-		log.
-			WithError(err).
-			WithField("url", u).
-			Error("Could not get the URL")
-		return 1
+	if o.clock == nil {
+		o.clock = clock.Real{}
+	}
+	if o.spans == nil {
+		o.spans = newDrillSpans()
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	err := checkCallerIdentity(clients.sts)
 	if err != nil {
-		log.
-			WithError(err).
-			WithField("res", res).
-			Error("Could not read the response body")
+		log.WithError(err).Error("Could not verify the AWS credentials")
 		return 1
 	}
 
-	exists := strings.Contains(string(body), content)
-	if !exists {
-		log.WithFields(log.Fields{
-			"res":  res,
-			"body": string(body),
-		}).Debug("Did not find the expected content at the failover url")
-		log.WithFields(log.Fields{
-			"content": content,
-		}).Warn("Did not find the expected content at the failover url")
-		return 1
+	// A hold that watches an alarm it can't see would always pass
+	if len(o.holdCloudWatch.alarms) > 0 {
+		err = checkAlarmsExist(clients.cloudWatch, o.holdCloudWatch.alarms)
+		if err != nil {
+			log.WithError(err).Error("Could not watch the hold's alarms")
+			return 1
+		}
 	}
 
-	log.WithFields(log.Fields{
-		"content": content,
-		"url":     u,
-	}).Info("Found the expected content")
-	return 0
-}
-
-func getURL(
-	url string,
-	user string,
-	password string,
-	insecure bool) (*http.Response, error) {
-
-	req, err := http.NewRequest("GET", url, nil)
+	// A group still tagged by a drill, e.g. one that crashed, may still
+	// have instances in standby from it
+	tags, err := getDrillTags(clients.asg, o.asg)
 	if err != nil {
-		log.WithError(err).Error("Creating request")
-		return nil, err
-	}
-
-	if user != "" {
-		req.SetBasicAuth(user, password)
+		log.WithError(err).Error("Could not read the autoscaling group's tags")
+		return 1
 	}
-
-	client := &http.Client{}
-
-	if insecure {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if tags[tagRunID] != "" {
+		logger := log.WithFields(log.Fields{
+			"asg":      o.asg,
+			"runId":    tags[tagRunID],
+			"operator": tags[tagOperator],
+			"started":  tags[tagStarted],
+		})
+		if !o.ignoreDrillTags {
+			logger.Error("The group is still tagged by an earlier drill, run recover before starting another or use --ignore-drill-tags")
+			return 1
 		}
-		client.Transport = tr
+		logger.Warn("Starting the drill although the group is still tagged by an earlier drill")
 	}
 
-	response, err := client.Do(req)
-	if err != nil {
-		log.WithError(err).Error("Request")
+	drillSpan := drillTracer.startPhase(nil, "drill",
+		"drill.run_id", o.run.id,
+		"drill.operator", o.run.operator,
+		"aws.autoscaling.group", o.asg,
+		"url.full", o.url)
+	defer drillSpan.finish()
+	o.spans.drill = drillSpan
+
+	opts := drill.Options{
+		Group:        o.asg,
+		Primary:      o.primary,
+		Secondary:    o.secondary,
+		URL:          o.url,
+		Auth:         o.auth,
+		Phases:       phases,
+		Drift:        o.drift,
+		OwnTagPrefix: appTagPrefix,
+		Check: func(content string, u string, auth contentcheck.Auth) int {
+			return checkForContentAtURL(o.spans.parent(), content, u, auth)
+		},
+		Tag: func(instanceIDs []*string, start time.Time, expectedEnd time.Time) int {
+			return tagDrill(clients.asg, clients.ec2, o.asg, instanceIDs, drillTags(o.run, start, expectedEnd))
+		},
+		Untag: func(instanceIDs []*string) int {
+			return untagDrill(clients.asg, clients.ec2, o.asg, instanceIDs)
+		},
+		OnEvent:         drillEvents(o.run, o.asg, o.notify, o.spans, o.clock),
+		Clock:           o.clock,
+		PrimaryScript:   o.scripts.primary,
+		SecondaryScript: o.scripts.secondary,
+		RunScript: func(script *contentcheck.Script, u string, auth contentcheck.Auth) int {
+			return runScriptAtURL(o.spans.parent(), script, u, auth)
+		},
 	}
-
-	return response, err
-}
-
-func enterStandby(
-	asgName string,
-	svc autoscalingiface.AutoScalingAPI,
-	instanceIDs []*string,
-	poll time.Duration,
-	timeout time.Duration,
-) int {
-	log.Info("Attempting to enter standby")
-
-	ret := 0
-	enterStandbyInput := getEnterStandbyInput(instanceIDs, &asgName)
-	enterStandbyOutput, err := svc.EnterStandby(enterStandbyInput)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err":                err,
-			"enterStandbyOutput": enterStandbyOutput,
-		}).Error("Error entering instances into standby")
-		// We'll let the logic carry on, which may mean that the wait for
-		// standby will timeout but will continue to attempt to put everything
-		// back into service.
-		ret++
+	if o.holdCloudWatch.enabled() {
+		opts.Phases.Hold.Assert = func() error {
+			return checkCloudWatch(clients.cloudWatch, o.holdCloudWatch, o.clock.Now())
+		}
 	}
-
-	activityIDs := []*string{enterStandbyOutput.Activities[0].ActivityId}
-	result := waitForInstancesToReachSuccessfulStatus(
-		&asgName,
-		activityIDs,
-		svc,
-		poll,
-		timeout)
-
-	if result == false {
-		log.
-			Error("Some (or all) of the instances in the autoscaling group did not enter standby")
-		ret++
-	} else {
-		log.
-			Info("Instances now in standby")
+	if len(o.hooks) > 0 {
+		opts.Hook = func(e drill.Event) int {
+			return o.hooks.run(o.run, o.asg, e, o.clock.Now())
+		}
 	}
-
-	return ret
-}
-
-func exitStandby(
-	asgName string,
-	svc autoscalingiface.AutoScalingAPI,
-	instanceIDs []*string,
-	poll time.Duration,
-	timeout time.Duration,
-	isSuccess func(bool) bool,
-) int {
-	log.Info("Attempting to exit standby")
-	exitStandbyArgs := autoscaling.ExitStandbyInput{
-		AutoScalingGroupName: &asgName,
-		InstanceIds:          instanceIDs,
+	if o.guards != nil {
+		opts.Guard = o.guards
+	}
+	if o.renewLock != nil {
+		onEvent := opts.OnEvent
+		opts.OnEvent = func(e drill.Event) {
+			if e.Type == drill.EventPhaseStarted && (e.Phase == drill.PhaseHold || e.Phase == drill.PhaseRecovery) {
+				o.renewLock()
+			}
+			onEvent(e)
+		}
 	}
 
-	exitStandbyOutput, err := svc.ExitStandby(&exitStandbyArgs)
+	result, err := drill.New(clients.asg, clients.elb, opts).Run()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"exitStandbyOutput": exitStandbyOutput,
-			"err":               err,
-		}).Error("Error calling ExitStandby")
+		log.WithError(err).WithField("asg", o.asg).Error("Could not describe the autoscaling group before the drill")
+		drillSpan.fail("Could not describe the autoscaling group")
 		return 1
 	}
 
-	activityIDs := []*string{exitStandbyOutput.Activities[0].ActivityId}
-
-	ret := 0
-	retryAttempts := 3
-	for i := 0; i < retryAttempts; i++ {
-		result := waitForInstancesToReachSuccessfulStatus(
-			&asgName,
-			activityIDs,
-			svc,
-			poll,
-			timeout)
-
-		if isSuccess(result) {
-			log.Info("Instances exited standby")
-			ret = 0
-			break
-		}
-
-		log.Error("Instances failed to reach successful status")
-		ret++
-	}
-
-	return ret
-}
+	drillMetrics.observeRun(result.Failures, o.clock.Now())
+	drillSpan.set("drill.exit_code", result.Failures)
+	drillSpan.failIf(result.Failures, "The drill failed")
 
-func waitForInstancesToReachSuccessfulStatus(
-	asgName *string,
-	activityIDs []*string,
-	svc autoscalingiface.AutoScalingAPI,
-	poll time.Duration,
-	timeout time.Duration,
-) bool {
-
-	describeScalingActivitiesQueryParams := &autoscaling.DescribeScalingActivitiesInput{
-		ActivityIds:          activityIDs,
-		AutoScalingGroupName: asgName,
-		MaxRecords:           aws.Int64(1),
-	}
+	log.WithFields(log.Fields{
+		"extCode": result.Failures,
+	}).Info("Finished")
 
-	return handleASGActivityPolling(
-		describeScalingActivitiesQueryParams,
-		checkActivitiesForStatus,
-		svc,
-		poll,
-		timeout,
-		"Successful")
+	return result.Failures
 }
 
-func getInstancesInAutoScalingGroup(
-	asgName *string,
-	svc autoscalingiface.AutoScalingAPI) []*autoscaling.Instance {
-	instanceIDQueryParams := &autoscaling.DescribeAutoScalingGroupsInput{
-		AutoScalingGroupNames: []*string{
-			asgName,
-		},
-		MaxRecords: aws.Int64(1),
+// drillEvents traces and measures each phase of the drill as it happens and
+// passes everything people need to know about on to the notifiers
+func drillEvents(
+	run drillRun,
+	asgName string,
+	notify notifiers,
+	spans *drillSpans,
+	c clock.Clock) func(drill.Event) {
+	failed := map[string]string{
+		drill.PhaseStandby:  "The instances did not enter standby",
+		drill.PhaseFailover: "The secondary content was not found",
+		drill.PhaseHold:     "The failover did not hold",
+		drill.PhaseRecovery: "The primary content was not found",
 	}
 
-	resp, err := svc.DescribeAutoScalingGroups(instanceIDQueryParams)
-	if err != nil {
-		log.WithError(err).Fatal("Coud not get instances in asg, DescribeAutoScalingGroups failed")
+	return func(e drill.Event) {
+		switch e.Type {
+		case drill.EventPhaseStarted:
+			if content, ok := e.Details["content"]; ok {
+				spans.startPhase(e.Phase, drillTracer.startPhase(spans.drill, e.Phase, "content.expected", content))
+			} else {
+				spans.startPhase(e.Phase, drillTracer.startPhase(spans.drill, e.Phase))
+			}
+		case drill.EventPhaseFinished:
+			drillMetrics.observePhase(e.Phase, c.Now().Sub(e.Started))
+			if s := spans.finishPhase(e.Phase); s != nil {
+				if e.Failed && failed[e.Phase] != "" {
+					s.fail(failed[e.Phase])
+				}
+				s.finish()
+			}
+		case drill.EventRestoreRetried:
+			drillMetrics.inc(metricRecoveryRetries)
+		case drill.EventAborted:
+			spans.drill.set("drill.aborted", true)
+			spans.drill.set("drill.abort_reason", e.Details["reason"])
+			notify.send(run, asgName, e.Type, e.Message, e.Details)
+		default:
+			notify.send(run, asgName, e.Type, e.Message, e.Details)
+		}
 	}
-
-	return resp.AutoScalingGroups[0].Instances
 }
 
-func handleASGActivityPolling(
-	describeActivityConfig *autoscaling.DescribeScalingActivitiesInput,
-	pollFunc pollASGActivities,
-	svc autoscalingiface.AutoScalingAPI,
-	poll time.Duration,
-	timeout time.Duration,
-	statusCode string,
-) bool {
-
-	log.WithFields(log.Fields{
-		"describeActivityConfig": describeActivityConfig,
-	}).Debug("handleASGActivityPolling: ASG describe input")
-
-	var pollIteration int64
-
-	for {
-		if pollIteration >= (int64(timeout) / int64(poll)) {
-			break
-		}
-
-		success, err := pollFunc(describeActivityConfig, svc, statusCode)
-		if err != nil {
-			log.WithError(err).Error("Error waiting for ASG update")
-			break
+// checkForContentAtURL is a traced content check, the span is a child of
+// parent
+func checkForContentAtURL(parent *span, content string, u string, auth contentcheck.Auth) (result int) {
+	drillMetrics.inc(metricContentChecks)
+	defer func() {
+		if result != 0 {
+			drillMetrics.inc(metricContentCheckFailures)
 		}
+	}()
 
-		if success {
-			return true
-		}
+	s := drillTracer.startCall(parent, "GET",
+		"http.request.method", "GET",
+		"url.full", u,
+		"content.expected", content)
+	defer s.finish()
 
-		time.Sleep(poll)
-		pollIteration++
-		log.WithField("poll", pollIteration).Info("Polling ASG status")
+	res := contentcheck.Check(content, u, auth)
+	if res.StatusCode != 0 {
+		s.set("http.response.status_code", res.StatusCode)
+		s.set("server.address", res.RemoteAddr)
 	}
-
-	return false
-}
-
-func checkActivitiesForStatus(
-	describeActivityConfig *autoscaling.DescribeScalingActivitiesInput,
-	svc autoscalingiface.AutoScalingAPI,
-	statusCode string,
-) (bool, error) {
-
-	resp, err := svc.DescribeScalingActivities(describeActivityConfig)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"response": resp,
-			"err":      err,
-		}).Error("DescribeScalingActivities failed")
-		return false, err
+	if res.Err != nil {
+		s.fail(res.Err.Error())
+		return 1
 	}
 
-	finished := true
-
-	for _, activity := range resp.Activities {
-		if *activity.StatusCode != statusCode {
-			finished = false
-		}
+	s.set("content.matched", res.Matched)
+	if !res.Matched {
+		return 1
 	}
 
-	return finished, err
+	return 0
 }
 
-func getDescribeScalingActivitiesInput(
-	activityIDs []*string,
-	resourceName *string) *autoscaling.DescribeScalingActivitiesInput {
-	return &autoscaling.DescribeScalingActivitiesInput{
-		ActivityIds:          activityIDs,
-		AutoScalingGroupName: resourceName,
-		MaxRecords:           aws.Int64(1),
-	}
+// contentScripts are run instead of looking for the primary and secondary
+// content, when set
+type contentScripts struct {
+	primary   *contentcheck.Script
+	secondary *contentcheck.Script
 }
 
-func getEnterStandbyInput(
-	instanceIDs []*string,
-	resourceName *string) *autoscaling.EnterStandbyInput {
-	ret := &autoscaling.EnterStandbyInput{
-		AutoScalingGroupName:           resourceName,
-		ShouldDecrementDesiredCapacity: aws.Bool(true),
-		InstanceIds:                    instanceIDs,
-	}
+func runScriptAtURL(parent *span, script *contentcheck.Script, u string, auth contentcheck.Auth) (result int) {
+	drillMetrics.inc(metricContentChecks)
+	defer func() {
+		if result != 0 {
+			drillMetrics.inc(metricContentCheckFailures)
+		}
+	}()
 
-	log.WithFields(log.Fields{
-		"EnterStandbyInput": ret,
-	}).Debug("Query parameters for stand by")
+	s := drillTracer.startCall(parent, "script",
+		"url.full", u,
+		"script.name", script.Name,
+		"script.steps", len(script.Steps))
+	defer s.finish()
+
+	res := script.Run(u, auth)
+	s.set("script.passed", res.Passed)
+	if res.StatusCode != 0 {
+		s.set("http.response.status_code", res.StatusCode)
+		s.set("server.address", res.RemoteAddr)
+	}
+	if res.Err != nil {
+		s.set("script.step", res.Step)
+		s.fail(res.Err.Error())
+		return 1
+	}
 
-	return ret
+	return 0
 }
 
-func getInstanceIDs(
-	instances []*autoscaling.Instance) []*string {
-	instanceIDs := []*string{}
-
-	for _, instance := range instances {
-		instanceIDs = append(instanceIDs, instance.InstanceId)
+// checkExpectation runs the script if there is one, otherwise it looks for
+// the content. It is only used outside a drill, so each check is a trace of
+// its own.
+func checkExpectation(content string, script *contentcheck.Script, u string, auth contentcheck.Auth) int {
+	if script != nil {
+		return runScriptAtURL(nil, script, u, auth)
 	}
 
-	log.WithFields(log.Fields{
-		"instanceIDs": *instanceIDs[0],
-	}).Debug("Instances in auto scaling group")
-
-	return instanceIDs
+	return checkForContentAtURL(nil, content, u, auth)
 }
 
-func validateAwsCredentials() error {
-	log.Info("Checking Credentials...")
-	if isEnvVarSetWithValue("AWS_ACCESS_KEY_ID") &&
-		isEnvVarSetWithValue("AWS_SECRET_ACCESS_KEY") &&
-		isEnvVarSetWithValue("AWS_REGION") &&
-		isEnvVarSetWithValue("ASG_NAME") {
-		log.Info("Credentials OK")
-		return nil
+func getInstancesInAutoScalingGroup(
+	asgName *string,
+	svc autoscalingiface.AutoScalingAPI) ([]*autoscaling.Instance, error) {
+	group, err := getAutoScalingGroup(asgName, svc)
+	if err != nil {
+		return nil, err
 	}
 
-	return errors.New("AWS credentials not set")
+	return group.Instances, nil
 }
 
-func isEnvVarSetWithValue(key string) bool {
-	val, ok := os.LookupEnv(key)
-	log.WithFields(log.Fields{
-		"key": key,
-		"val": val,
-		"ok":  ok,
-	}).Debug("isEnvVarSetWithValue")
-	return ok && val != ""
+func getAutoScalingGroup(
+	asgName *string,
+	svc autoscalingiface.AutoScalingAPI) (*autoscaling.Group, error) {
+	return asg.Group(svc, *asgName)
 }
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -15,9 +14,21 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
 	"github.com/stretchr/testify/assert"
 )
 
+// testStart is when every fake clock in the tests starts
+var testStart = time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC)
+
+func testClock() *clock.Fake {
+	return clock.NewFake(testStart)
+}
+
 func TestMain(m *testing.M) {
 	log.SetLevel(log.PanicLevel)
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
@@ -30,11 +41,25 @@ type mockAutoScalingClient struct {
 	Success       bool
 	ServiceStatus []string
 	describeCount int
+
+	// The first describe scaling activities calls fail
+	ActivityErrors int
+	activityCount  int
+
+	enterStandbyCount int
+
+	TargetGroupARNs []*string
+
+	// The group's tags by key
+	Tags map[string]string
 }
 
 func (m *mockAutoScalingClient) DescribeAutoScalingGroups(
 	*autoscaling.DescribeAutoScalingGroupsInput) (
 	*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if m.Error == "DescribeAutoScalingGroups" {
+		return nil, errors.New("Error")
+	}
 
 	status := "InService"
 
@@ -62,6 +87,7 @@ func (m *mockAutoScalingClient) DescribeAutoScalingGroups(
 			}},
 		},
 	}
+	output.AutoScalingGroups[0].TargetGroupARNs = m.TargetGroupARNs
 
 	m.describeCount++
 	return &output, nil
@@ -80,7 +106,8 @@ func (m *mockAutoScalingClient) DescribeScalingActivities(
 	resp := &autoscaling.DescribeScalingActivitiesOutput{Activities: activities}
 
 	var err error
-	if m.Error == "DescribeScalingActivities" {
+	m.activityCount++
+	if m.Error == "DescribeScalingActivities" || m.activityCount <= m.ActivityErrors {
 		err = errors.New("Error")
 	}
 
@@ -89,6 +116,7 @@ func (m *mockAutoScalingClient) DescribeScalingActivities(
 
 func (m *mockAutoScalingClient) EnterStandby(
 	input *autoscaling.EnterStandbyInput) (*autoscaling.EnterStandbyOutput, error) {
+	m.enterStandbyCount++
 	ret := autoscaling.EnterStandbyOutput{
 		Activities: []*autoscaling.Activity{
 			&autoscaling.Activity{ActivityId: aws.String("activity1")},
@@ -119,227 +147,116 @@ func (m *mockAutoScalingClient) ExitStandby(
 	return &ret, err
 }
 
-func TestGetInstanceIDs(t *testing.T) {
-	mockASGInstanceIds := []string{
-		"instanceIdOne",
-		"instanceIdTwo",
-		"instanceIdThree",
-		"instanceIdFour",
-		"instanceIdFive",
+func (m *mockAutoScalingClient) DescribeTags(
+	input *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
+	if m.Error == "DescribeTags" {
+		return nil, errors.New("Error")
 	}
 
-	resp := getMockDescribeAutoScalingGroupsOutput(mockASGInstanceIds)
-	log.Debug(resp)
-
-	instanceIDs := getInstanceIDs(resp.AutoScalingGroups[0].Instances)
-
-	for index, instanceID := range instanceIDs {
-		assert.Equal(t, *instanceID, mockASGInstanceIds[index], nil)
+	keys := map[string]bool{}
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) == "key" {
+			for _, key := range filter.Values {
+				keys[aws.StringValue(key)] = true
+			}
+		}
 	}
-}
 
-func TestGetInstancesInAutoScalingGroup(t *testing.T) {
-	mockASGInstanceIds := []string{
-		"instance1",
-		"instance2",
-		"instance3",
+	resp := &autoscaling.DescribeTagsOutput{}
+	for key, value := range m.Tags {
+		if len(keys) == 0 || keys[key] {
+			resp.Tags = append(resp.Tags, &autoscaling.TagDescription{
+				Key:   aws.String(key),
+				Value: aws.String(value),
+			})
+		}
 	}
 
-	mockSvc := &mockAutoScalingClient{Success: true}
-	instances := getInstancesInAutoScalingGroup(aws.String("test"), mockSvc)
-
-	for index, instance := range instances {
-		assert.Equal(t, mockASGInstanceIds[index], *(*instance).InstanceId, nil)
-	}
+	return resp, nil
 }
 
-func TestGetEnterStandbyInput(t *testing.T) {
-	mockASGInstanceIds := []*string{
-		aws.String("instanceIdOne"),
-		aws.String("instanceIdTwo"),
-		aws.String("instanceIdThree"),
-		aws.String("instanceIdFour"),
-		aws.String("instanceIdFive"),
+func (m *mockAutoScalingClient) CreateOrUpdateTags(
+	input *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	if m.Error == "CreateOrUpdateTags" {
+		return nil, errors.New("Error")
 	}
 
-	resourceName := "ResourceName"
-
-	enterStandbyInput := getEnterStandbyInput(mockASGInstanceIds, &resourceName)
-
-	assert.Equal(t, *enterStandbyInput.AutoScalingGroupName, "ResourceName", nil)
-	assert.Equal(t, *enterStandbyInput.ShouldDecrementDesiredCapacity, true, nil)
-
-	for index := range mockASGInstanceIds {
-		assert.Equal(
-			t,
-			*enterStandbyInput.InstanceIds[index],
-			*mockASGInstanceIds[index],
-			nil)
-	}
-}
-
-func TestGetDescribeScalingActivitiesInput(t *testing.T) {
-	mockActivityIds := []*string{
-		aws.String("ActivityIdOne"),
-		aws.String("ActivityIdTwo"),
-		aws.String("ActivityIdThree"),
-		aws.String("ActivityIdFour"),
-		aws.String("ActivityIdFive"),
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
 	}
-
-	resourceName := "ResourceName"
-
-	describeScalingActivitiesInput := getDescribeScalingActivitiesInput(
-		mockActivityIds,
-		&resourceName)
-
-	assert.Equal(
-		t,
-		*describeScalingActivitiesInput.AutoScalingGroupName,
-		"ResourceName",
-		nil)
-
-	for index := range mockActivityIds {
-		assert.Equal(
-			t,
-			*describeScalingActivitiesInput.ActivityIds[index],
-			*mockActivityIds[index],
-			nil)
+	for _, tag := range input.Tags {
+		m.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
 	}
-}
-
-func TestHandleASGActivityPolling(t *testing.T) {
-	pollIteration := 0
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
-	mockSvc := &mockAutoScalingClient{Success: true}
-	pollFunc :=
-		func(
-			*autoscaling.DescribeScalingActivitiesInput,
-			autoscalingiface.AutoScalingAPI,
-			string) (bool, error) {
-			assert.Equal(t, pollIteration < 5, true)
-			pollIteration++
-			return (pollIteration == 4), nil
-		}
 
-	success := handleASGActivityPolling(mockConfig, pollFunc, mockSvc, 1*time.Millisecond, 5*time.Millisecond, "Successful")
-
-	assert.Equal(t, success, true)
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
 }
 
-func TestHandleASGActivityPollingWhenTimesOut(t *testing.T) {
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
-	mockSvc := &mockAutoScalingClient{Success: true}
-	pollFunc := func(
-		*autoscaling.DescribeScalingActivitiesInput,
-		autoscalingiface.AutoScalingAPI,
-		string) (bool, error) {
-		return false, nil
+func (m *mockAutoScalingClient) DeleteTags(
+	input *autoscaling.DeleteTagsInput) (*autoscaling.DeleteTagsOutput, error) {
+	if m.Error == "DeleteTags" {
+		return nil, errors.New("Error")
 	}
 
-	success := handleASGActivityPolling(mockConfig, pollFunc, mockSvc, 1*time.Millisecond, 5*time.Millisecond, "Successful")
-
-	assert.Equal(t, success, false)
-}
-
-func TestHandleASGActivityPollingErrorHandling(t *testing.T) {
-	pollIteration := 0
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
-	mockSvc := &mockAutoScalingClient{Success: true}
-	pollFunc := func(
-		*autoscaling.DescribeScalingActivitiesInput,
-		autoscalingiface.AutoScalingAPI,
-		string) (bool, error) {
-		pollIteration++
-
-		return false, errors.New("Test Error")
+	for _, tag := range input.Tags {
+		delete(m.Tags, aws.StringValue(tag.Key))
 	}
 
-	success := handleASGActivityPolling(mockConfig, pollFunc, mockSvc, 1*time.Millisecond, 5*time.Millisecond, "Successful")
-
-	assert.Equal(t, success, false)
-	assert.Equal(t, pollIteration, 1)
+	return &autoscaling.DeleteTagsOutput{}, nil
 }
 
-func TestPollASGActivitiesForSuccessError(t *testing.T) {
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
-	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
-	success, err := checkActivitiesForStatus(mockConfig, mockSvc, "Successful")
-
-	assert.Equal(t, success, false)
-	assert.EqualError(t, err, "Error")
+type mockELBV2Client struct {
+	elbv2iface.ELBV2API
+	Error         string
+	TargetStates  []string
+	describeCount int
 }
 
-func TestPollASGActivitiesForSuccessNotFinished(t *testing.T) {
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
-	mockSvc := &mockAutoScalingClient{}
-	success, err := checkActivitiesForStatus(mockConfig, mockSvc, "Successful")
+func (m *mockELBV2Client) DescribeTargetHealth(
+	input *elbv2.DescribeTargetHealthInput) (
+	*elbv2.DescribeTargetHealthOutput, error) {
 
-	assert.Equal(t, false, success)
-	assert.Equal(t, nil, err)
-}
+	state := elbv2.TargetHealthStateEnumHealthy
+	if len(m.TargetStates) > m.describeCount {
+		state = m.TargetStates[m.describeCount]
+	}
+	m.describeCount++
 
-func TestPollASGActivitiesForSuccess(t *testing.T) {
-	mockConfig := &autoscaling.DescribeScalingActivitiesInput{}
+	descriptions := []*elbv2.TargetHealthDescription{}
+	for _, target := range input.Targets {
+		descriptions = append(descriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: target.Id},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
 
-	mockSvc := &mockAutoScalingClient{Success: true}
-	success, err := checkActivitiesForStatus(mockConfig, mockSvc, "Successful")
+	var err error
+	if m.Error == "DescribeTargetHealth" {
+		err = errors.New("Error")
+	}
 
-	assert.Equal(t, success, true)
-	assert.Equal(t, err, nil)
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: descriptions,
+	}, err
 }
 
-func TestWaitForInstancesToReachSuccessfulState(t *testing.T) {
+func TestGetInstancesInAutoScalingGroup(t *testing.T) {
+	mockASGInstanceIds := []string{
+		"instance1",
+		"instance2",
+		"instance3",
+	}
 
 	mockSvc := &mockAutoScalingClient{Success: true}
-	success := waitForInstancesToReachSuccessfulStatus(
-		aws.String("test"),
-		[]*string{aws.String("test")},
-		mockSvc,
-		1*time.Millisecond,
-		10*time.Millisecond)
-
-	assert.Equal(t, success, true)
-}
-
-func TestValidateAwsCredentialsValid(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	err = os.Setenv("AWS_REGION", "AWS_REGION_VALUE")
-	err = os.Setenv("ASG_NAME", "ASG_NAME_VALUE")
-	assert.Nil(t, err)
-
-	err = validateAwsCredentials()
-	assert.Nil(t, err)
-
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
-	err = os.Unsetenv("AWS_REGION")
-	err = os.Unsetenv("ASG_NAME")
-	assert.Nil(t, err)
-}
-
-func TestValidateAwsCredentialsSomeAreMissing(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	assert.Nil(t, err)
-
-	err = validateAwsCredentials()
-	assert.EqualError(t, err, "AWS credentials not set")
-
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	instances, err := getInstancesInAutoScalingGroup(aws.String("test"), mockSvc)
 	assert.Nil(t, err)
-}
 
-func TestValidateAwsCredentialsAreMissing(t *testing.T) {
-	err := validateAwsCredentials()
-
-	assert.EqualError(t, err, "AWS credentials not set")
+	for index, instance := range instances {
+		assert.Equal(t, mockASGInstanceIds[index], *(*instance).InstanceId, nil)
+	}
 }
 
 func TestCheckForContentAtURLInvalidUrl(t *testing.T) {
-	assert.Equal(t, 1, checkForContentAtURL("test", "Invalid", contentAuth{}))
+	assert.Equal(t, 1, checkForContentAtURL(nil, "test", "Invalid", contentcheck.Auth{}))
 }
 
 func TestCheckForContentAtURLIncorrectContent(t *testing.T) {
@@ -348,7 +265,7 @@ func TestCheckForContentAtURLIncorrectContent(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	assert.Equal(t, 1, checkForContentAtURL("test", ts.URL, contentAuth{}))
+	assert.Equal(t, 1, checkForContentAtURL(nil, "test", ts.URL, contentcheck.Auth{}))
 }
 
 func TestCheckForContentAtURLCorrectContent(t *testing.T) {
@@ -357,136 +274,82 @@ func TestCheckForContentAtURLCorrectContent(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	assert.Equal(t, 0, checkForContentAtURL("matching", ts.URL, contentAuth{}))
+	assert.Equal(t, 0, checkForContentAtURL(nil, "matching", ts.URL, contentcheck.Auth{}))
 }
 
-func TestGetURLSecureNoAuth(t *testing.T) {
+func TestDoSuccess(t *testing.T) {
+	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "matching")
+		if count == 0 {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
 	}))
 	defer ts.Close()
 
-	resp, err := getURL(ts.URL, "", "", false)
-	assert.Nil(t, err)
-	assert.NotNil(t, resp)
-	assert.Equal(t, 200, resp.StatusCode)
-	body, err := ioutil.ReadAll(resp.Body)
-	assert.Nil(t, err)
-	assert.Equal(t, "matching\n", string(body))
+	mockSvc := &mockAutoScalingClient{Success: true}
+	exitCode := do(testClients(mockSvc), testDrill(ts.URL))
+	assert.Equal(t, 0, exitCode)
 }
 
-func TestGetURLSecureAuth(t *testing.T) {
+func TestDoEnterStandbyFail(t *testing.T) {
+	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, password, ok := r.BasicAuth()
-		assert.True(t, ok)
-		assert.Equal(t, "USER", user)
-		assert.Equal(t, "PASSWORD", password)
+		if count == 0 {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
 	}))
 	defer ts.Close()
 
-	resp, err := getURL(ts.URL, "USER", "PASSWORD", false)
-	assert.Nil(t, err)
-	assert.NotNil(t, resp)
-	assert.Equal(t, 200, resp.StatusCode)
+	mockSvc := &mockAutoScalingClient{Error: "EnterStandby", Success: true}
+	exitCode := do(testClients(mockSvc), testDrill(ts.URL))
+	assert.Equal(t, 1, exitCode)
 }
 
-func TestGetURLInsecureAuth(t *testing.T) {
-	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, password, ok := r.BasicAuth()
-		assert.True(t, ok)
-		assert.Equal(t, "USER", user)
-		assert.Equal(t, "PASSWORD", password)
+func TestDoContentCheckFail(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 {
+			fmt.Fprintln(w, "notmatching")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
 	}))
 	defer ts.Close()
 
-	resp, err := getURL(ts.URL, "USER", "PASSWORD", true)
-	assert.Nil(t, err)
-	assert.NotNil(t, resp)
-	assert.Equal(t, 200, resp.StatusCode)
+	mockSvc := &mockAutoScalingClient{Success: true}
+	exitCode := do(testClients(mockSvc), testDrill(ts.URL))
+	assert.Equal(t, 1, exitCode)
 }
 
-func TestGetURLTLSInsecureNoAuth(t *testing.T) {
-	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "matching")
+func TestDoExitStandbyFail(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
 	}))
 	defer ts.Close()
 
-	resp, err := getURL(ts.URL, "", "", true)
-	assert.Nil(t, err)
-	assert.NotNil(t, resp)
-	assert.Equal(t, 200, resp.StatusCode)
-	body, err := ioutil.ReadAll(resp.Body)
-	assert.Nil(t, err)
-	assert.Equal(t, "matching\n", string(body))
-}
-
-func TestExitStandbySuccess(t *testing.T) {
-	isSuccess := func(in bool) bool { return in }
-	mockSvc := &mockAutoScalingClient{Success: true}
-	instances := []*string{aws.String("instance1")}
-	assert.Equal(t, 0, exitStandby(
-		"test",
-		mockSvc,
-		instances,
-		1*time.Millisecond,
-		9*time.Millisecond,
-		isSuccess))
-}
-
-func TestExitStandbyExitCallFail(t *testing.T) {
-	isSuccess := func(in bool) bool { return in }
-	mockSvc := &mockAutoScalingClient{Error: "ExitStandby"}
-	instances := []*string{aws.String("instance1")}
-	assert.Equal(t, 1, exitStandby(
-		"test",
-		mockSvc,
-		instances,
-		1*time.Millisecond,
-		9*time.Millisecond,
-		isSuccess))
-}
-
-func TestExitStandbyWaitFail(t *testing.T) {
-	isSuccess := func(in bool) bool { return in }
-	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
-	instances := []*string{aws.String("instance1")}
-	assert.Equal(t, 3, exitStandby(
-		"test",
-		mockSvc,
-		instances,
-		1*time.Millisecond,
-		9*time.Millisecond,
-		isSuccess))
-}
-
-func TestExitStandbySecondAttempt(t *testing.T) {
-	loop := 0
-	isSuccess := func(in bool) bool {
-		loop++
-		if loop == 2 {
-			return true
-		}
-		return false
+	mockSvc := &mockAutoScalingClient{
+		Error:         "ExitStandby",
+		Success:       true,
+		ServiceStatus: []string{"Pending", "Pending", "InService"},
 	}
-
-	mockSvc := &mockAutoScalingClient{Error: "DescribeScalingActivities"}
-	instances := []*string{aws.String("instance1")}
-	assert.Equal(t, 0, exitStandby(
-		"test",
-		mockSvc,
-		instances,
-		1*time.Millisecond,
-		9*time.Millisecond,
-		isSuccess))
+	exitCode := do(testClients(mockSvc), testDrill(ts.URL))
+	assert.Equal(t, 1, exitCode)
 }
 
-func TestDoSuccess(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	err = os.Setenv("AWS_REGION", "AWS_REGION_VALUE")
-	err = os.Setenv("ASG_NAME", "ASG_NAME_VALUE")
-	assert.Nil(t, err)
-
+func TestDoTargetHealthFail(t *testing.T) {
 	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if count == 0 {
@@ -498,24 +361,50 @@ func TestDoSuccess(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	mockSvc := &mockAutoScalingClient{Success: true}
-	exitCode := do(mockSvc, "primary", "secondary", ts.URL, contentAuth{}, 1*time.Millisecond, 3*time.Millisecond)
-	assert.Equal(t, 0, exitCode)
+	mockSvc := &mockAutoScalingClient{
+		Success:         true,
+		TargetGroupARNs: []*string{aws.String("arn1")},
+	}
+	// The targets stay healthy so they never drain during the failover, which
+	// also uses up the failover phase before the secondary content is seen
+	mockELBSvc := &mockELBV2Client{}
+	clients := testClients(mockSvc)
+	clients.elb = mockELBSvc
+	exitCode := do(clients, testDrill(ts.URL))
+	assert.Equal(t, 2, exitCode)
+}
+
+func TestDoDeadlineOverrun(t *testing.T) {
+	// The secondary is still up for the first recovery check, so the
+	// recovery waits a poll and that takes the drill past its deadline
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count < 2 {
+			fmt.Fprintln(w, "secondary")
+		} else {
+			fmt.Fprintln(w, "primary")
+		}
+		count++
+	}))
+	defer ts.Close()
 
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
-	err = os.Unsetenv("AWS_REGION")
-	err = os.Unsetenv("ASG_NAME")
-	assert.Nil(t, err)
+	// Restoring the group always runs to completion, even past the deadline
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"InService", "Standby", "Standby", "InService"},
+	}
+	phases := testPhases(1*time.Millisecond, 3*time.Millisecond)
+	phases.Restore.Timeout = 20 * time.Millisecond
+	phases.Deadline = 1 * time.Nanosecond
+	opts := testDrill(ts.URL)
+	opts.phases = phases
+	opts.drift = drill.DriftOff
+	exitCode := do(testClients(mockSvc), opts)
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, 4, mockSvc.describeCount)
 }
 
-func TestDoEnterStandbyFail(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	err = os.Setenv("AWS_REGION", "AWS_REGION_VALUE")
-	err = os.Setenv("ASG_NAME", "ASG_NAME_VALUE")
-	assert.Nil(t, err)
-
+func TestDoNotifies(t *testing.T) {
 	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if count == 0 {
@@ -527,28 +416,47 @@ func TestDoEnterStandbyFail(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	mockSvc := &mockAutoScalingClient{Error: "EnterStandby", Success: true}
-	exitCode := do(mockSvc, "primary", "secondary", ts.URL, contentAuth{}, 1*time.Millisecond, 3*time.Millisecond)
-	assert.Equal(t, 1, exitCode)
+	recorder := &recordingNotifier{}
+	mockSvc := &mockAutoScalingClient{Success: true}
+	opts := testDrill(ts.URL)
+	opts.notify = notifiers{recorder}
+	exitCode := do(testClients(mockSvc), opts)
 
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
-	err = os.Unsetenv("AWS_REGION")
-	err = os.Unsetenv("ASG_NAME")
-	assert.Nil(t, err)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, []string{
+		eventStart,
+		eventFailoverDetected,
+		eventRestoreStarted,
+		eventSuccess,
+	}, recorder.types())
 }
 
-func TestDoContentCheckFail(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	err = os.Setenv("AWS_REGION", "AWS_REGION_VALUE")
-	err = os.Setenv("ASG_NAME", "ASG_NAME_VALUE")
-	assert.Nil(t, err)
+func TestDoNotifiesFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	recorder := &recordingNotifier{}
+	mockSvc := &mockAutoScalingClient{Success: true}
+	opts := testDrill(ts.URL)
+	opts.notify = notifiers{recorder}
+	exitCode := do(testClients(mockSvc), opts)
 
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, []string{eventStart, eventRestoreStarted, eventFailure}, recorder.types())
+	assert.Equal(t, "1", recorder.events[2].Details["exitCode"])
+	assert.Equal(t, "failover", recorder.events[2].Details["failedPhases"])
+	// The failover gives up after its three checks, a poll apart
+	assert.Equal(t, "2ms", recorder.events[2].Details["took"])
+}
+
+func TestDoHoldFails(t *testing.T) {
 	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The primary content comes back during the hold
 		if count == 0 {
-			fmt.Fprintln(w, "notmatching")
+			fmt.Fprintln(w, "secondary")
 		} else {
 			fmt.Fprintln(w, "primary")
 		}
@@ -556,24 +464,46 @@ func TestDoContentCheckFail(t *testing.T) {
 	}))
 	defer ts.Close()
 
+	phases := testPhases(1*time.Millisecond, 3*time.Millisecond)
+	phases.Hold = drill.Hold{Duration: 5 * time.Millisecond, Poll: 1 * time.Millisecond}
+
 	mockSvc := &mockAutoScalingClient{Success: true}
-	exitCode := do(mockSvc, "primary", "secondary", ts.URL, contentAuth{}, 1*time.Millisecond, 3*time.Millisecond)
+	opts := testDrill(ts.URL)
+	opts.phases = phases
+	exitCode := do(testClients(mockSvc), opts)
 	assert.Equal(t, 1, exitCode)
+}
 
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
-	err = os.Unsetenv("AWS_REGION")
-	err = os.Unsetenv("ASG_NAME")
-	assert.Nil(t, err)
+func TestDoRenewsLock(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "secondary")
+	}))
+	defer ts.Close()
+
+	opts := testDrill(ts.URL)
+	opts.phases.Hold = drill.Hold{Duration: 2 * time.Millisecond, Poll: 1 * time.Millisecond}
+	renewals := 0
+	opts.renewLock = func() { renewals++ }
+
+	do(testClients(&mockAutoScalingClient{Success: true}), opts)
+
+	// Once as the hold starts and once as the recovery starts
+	assert.Equal(t, 2, renewals)
 }
 
-func TestDoExitStandbyFail(t *testing.T) {
-	err := os.Setenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID_VALUE")
-	err = os.Setenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY_VALUE")
-	err = os.Setenv("AWS_REGION", "AWS_REGION_VALUE")
-	err = os.Setenv("ASG_NAME", "ASG_NAME_VALUE")
-	assert.Nil(t, err)
+func TestDoRefusesLeftoverDrillTags(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Success: true,
+		Tags:    drillTags(drillRun{id: "crashed", operator: "bob@host"}, testStart, testStart.Add(time.Hour)),
+	}
+
+	exitCode := do(testClients(mockSvc), testDrill("http://localhost:1"))
 
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, 0, mockSvc.enterStandbyCount)
+}
+
+func TestDoIgnoresLeftoverDrillTags(t *testing.T) {
 	count := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if count == 0 {
@@ -586,111 +516,136 @@ func TestDoExitStandbyFail(t *testing.T) {
 	defer ts.Close()
 
 	mockSvc := &mockAutoScalingClient{
-		Error:         "ExitStandby",
-		Success:       true,
-		ServiceStatus: []string{"Pending", "Pending", "InService"},
+		Success: true,
+		Tags:    drillTags(drillRun{id: "crashed", operator: "bob@host"}, testStart, testStart.Add(time.Hour)),
 	}
-	exitCode := do(mockSvc, "primary", "secondary", ts.URL, contentAuth{}, 1*time.Millisecond, 3*time.Millisecond)
-	assert.Equal(t, 1, exitCode)
+	opts := testDrill(ts.URL)
+	opts.ignoreDrillTags = true
 
-	err = os.Unsetenv("AWS_ACCESS_KEY_ID")
-	err = os.Unsetenv("AWS_SECRET_ACCESS_KEY")
-	err = os.Unsetenv("AWS_REGION")
-	err = os.Unsetenv("ASG_NAME")
-	assert.Nil(t, err)
+	assert.Equal(t, 0, do(testClients(mockSvc), opts))
 }
 
-func TestAreAllInstancesInServiceAllInService(t *testing.T) {
-	instances := []*autoscaling.Instance{
-		&autoscaling.Instance{
-			LifecycleState: aws.String("InService")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("InService")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("InService")},
-	}
-
-	assert.True(t, areAllInstancesInService(instances))
-}
+// A daemon runs do() in process, so a drill that can't start fails rather
+// than exiting
+func TestDoCannotStart(t *testing.T) {
+	noASG := testDrill("http://localhost:1")
+	noASG.asg = ""
+	assert.Equal(t, 1, do(testClients(&mockAutoScalingClient{Success: true}), noASG))
 
-func TestAreAllInstancesInServiceNoneInService(t *testing.T) {
-	instances := []*autoscaling.Instance{
-		&autoscaling.Instance{
-			LifecycleState: aws.String("Pending")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("Pending")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("Pending")},
-	}
+	clients := testClients(&mockAutoScalingClient{Success: true})
+	clients.sts = &mockSTSClient{Error: "GetCallerIdentity"}
+	assert.Equal(t, 1, do(clients, testDrill("http://localhost:1")))
 
-	assert.False(t, areAllInstancesInService(instances))
+	mockSvc := &mockAutoScalingClient{Error: "DescribeAutoScalingGroups"}
+	assert.Equal(t, 1, do(testClients(mockSvc), testDrill("http://localhost:1")))
+	assert.Equal(t, 0, mockSvc.enterStandbyCount)
 }
 
-func TestAreAllInstancesInServiceSomeInService(t *testing.T) {
-	instances := []*autoscaling.Instance{
-		&autoscaling.Instance{
-			LifecycleState: aws.String("InService")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("Pending")},
-		&autoscaling.Instance{
-			LifecycleState: aws.String("Pending")},
-	}
-
-	assert.False(t, areAllInstancesInService(instances))
+// testPhases uses the same poll and timeout for every phase, without a
+// deadline
+func testPhases(poll time.Duration, timeout time.Duration) drill.Phases {
+	p := drill.Phase{Poll: poll, Timeout: timeout}
+	return drill.Phases{Standby: p, Failover: p, Restore: p, Recovery: p}
 }
 
-func TestPollForContentSuccessNoPoll(t *testing.T) {
-	check := func(content string, url string, auth contentAuth) int {
-		return 0
-	}
+var testRun = drillRun{id: "run1", operator: "alice@host"}
 
-	res := pollForContent("test", "url", contentAuth{}, 1*time.Millisecond, 3*time.Millisecond, check)
-	assert.Equal(t, 0, res)
+// testClients are mock AWS clients that all work, around the autoscaling
+// client given
+func testClients(svc autoscalingiface.AutoScalingAPI) awsClients {
+	return awsClients{
+		asg:        svc,
+		elb:        &mockELBV2Client{},
+		ec2:        &mockEC2Client{},
+		cloudWatch: &mockCloudWatchClient{},
+		sts:        &mockSTSClient{},
+	}
 }
 
-func TestPollForContentSuccessPoll(t *testing.T) {
-	poll := 0
-	check := func(content string, url string, auth contentAuth) int {
-		poll++
-		if poll == 2 {
-			return 0
-		}
-		return 1
+// testDrill drills the "test" group, expecting "primary" and "secondary" at
+// the URL and reporting any drift
+func testDrill(u string) drillOptions {
+	return drillOptions{
+		run:       testRun,
+		asg:       "test",
+		url:       u,
+		primary:   "primary",
+		secondary: "secondary",
+		phases:    testPhases(1*time.Millisecond, 3*time.Millisecond),
+		drift:     drill.DriftReport,
+		clock:     testClock(),
 	}
+}
 
-	res := pollForContent("test", "url", contentAuth{}, 1*time.Millisecond, 5*time.Millisecond, check)
-	assert.Equal(t, 0, res)
+// driftingAutoScalingClient replaces an instance once the drill is over
+type driftingAutoScalingClient struct {
+	*mockAutoScalingClient
 }
 
-func TestPollForContentTimeout(t *testing.T) {
-	check := func(content string, url string, auth contentAuth) int {
-		return 1
+func (m *driftingAutoScalingClient) DescribeAutoScalingGroups(
+	input *autoscaling.DescribeAutoScalingGroupsInput) (
+	*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	output, err := m.mockAutoScalingClient.DescribeAutoScalingGroups(input)
+	if m.describeCount > 2 {
+		output.AutoScalingGroups[0].Instances[0].InstanceId = aws.String("instance4")
 	}
 
-	res := pollForContent("test", "url", contentAuth{}, 1*time.Millisecond, 5*time.Millisecond, check)
-	assert.Equal(t, 1, res)
+	return output, err
 }
 
-func getInstanceList(instanceIDs []string) []*autoscaling.Instance {
-	instances := []*autoscaling.Instance{}
-
-	for index := range instanceIDs {
-		instance := autoscaling.Instance{
-			InstanceId: &instanceIDs[index],
+func TestDoFailsOnDrift(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 {
+			w.Write([]byte("secondary"))
+		} else {
+			w.Write([]byte("primary"))
 		}
+		count++
+	}))
+	defer ts.Close()
 
-		instances = append(instances, &instance)
-	}
+	recorder := &recordingNotifier{}
+	mockSvc := &driftingAutoScalingClient{&mockAutoScalingClient{Success: true}}
+	opts := testDrill(ts.URL)
+	opts.drift = drill.DriftFail
+	opts.notify = notifiers{recorder}
+	exitCode := do(testClients(mockSvc), opts)
 
-	return instances
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, "instance instance1 has gone; instance instance4 is new", recorder.events[3].Details["drift"])
 }
 
-func getMockDescribeAutoScalingGroupsOutput(instanceIds []string) autoscaling.DescribeAutoScalingGroupsOutput {
-	return autoscaling.DescribeAutoScalingGroupsOutput{
-		AutoScalingGroups: []*autoscaling.Group{
-			{
-				Instances: getInstanceList(instanceIds),
-			},
+func TestDoRunsScripts(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count == 0 {
+			fmt.Fprintln(w, "Down for maintenance")
+		} else {
+			fmt.Fprintln(w, "Welcome")
+		}
+		count++
+	}))
+	defer ts.Close()
+
+	scripts := contentScripts{
+		primary: &contentcheck.Script{
+			Name:  "home",
+			Steps: []contentcheck.Step{{URL: "/", Contains: []string{"Welcome"}}},
+		},
+		secondary: &contentcheck.Script{
+			Name:  "maintenance",
+			Steps: []contentcheck.Step{{URL: "/", Contains: []string{"maintenance"}}},
 		},
 	}
+
+	mockSvc := &mockAutoScalingClient{Success: true}
+	opts := testDrill(ts.URL)
+	opts.primary = ""
+	opts.secondary = ""
+	opts.scripts = scripts
+	exitCode := do(testClients(mockSvc), opts)
+
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, 2, count)
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+)
+
+// The metrics are written in the Prometheus text format by hand, the app
+// only needs counters and gauges and this keeps the client library and its
+// dependencies out of the build.
+const (
+	metricLastSuccess          = "anarchy_kitten_last_success_timestamp_seconds"
+	metricLastRun              = "anarchy_kitten_last_run_timestamp_seconds"
+	metricLastRunSuccess       = "anarchy_kitten_last_run_success"
+	metricPhaseDuration        = "anarchy_kitten_phase_duration_seconds"
+	metricContentChecks        = "anarchy_kitten_content_checks_total"
+	metricContentCheckFailures = "anarchy_kitten_content_check_failures_total"
+	metricASGCalls             = "anarchy_kitten_asg_api_calls_total"
+	metricASGErrors            = "anarchy_kitten_asg_api_errors_total"
+	metricRecoveryRetries      = "anarchy_kitten_recovery_retries_total"
+)
+
+// pushTimeout bounds a push to the Pushgateway, so a slow gateway can't hold
+// up the exit after a drill
+const pushTimeout = 10 * time.Second
+
+type metricFamily struct {
+	name string
+	help string
+	kind string
+
+	// The values by their formatted labels
+	values map[string]float64
+}
+
+// metricsRegistry holds the app's metrics
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{families: map[string]*metricFamily{}}
+
+	for _, f := range []metricFamily{
+		{name: metricLastSuccess, kind: "gauge", help: "When the last successful drill finished"},
+		{name: metricLastRun, kind: "gauge", help: "When the last drill finished"},
+		{name: metricLastRunSuccess, kind: "gauge", help: "Whether the last drill succeeded"},
+		{name: metricPhaseDuration, kind: "gauge", help: "How long each phase of the last drill took"},
+		{name: metricContentChecks, kind: "counter", help: "The content checks made"},
+		{name: metricContentCheckFailures, kind: "counter", help: "The content checks that didn't find the content or failed"},
+		{name: metricASGCalls, kind: "counter", help: "The autoscaling API calls made"},
+		{name: metricASGErrors, kind: "counter", help: "The autoscaling API calls that failed"},
+		{name: metricRecoveryRetries, kind: "counter", help: "The times taking the instances out of standby had to be retried"},
+	} {
+		family := f
+		family.values = map[string]float64{}
+		m.families[f.name] = &family
+	}
+
+	return m
+}
+
+// drillMetrics is the registry everything records to, like the Prometheus
+// client's default registry
+var drillMetrics = newMetricsRegistry()
+
+// add adds to a counter, the labels are given as name, value pairs
+func (m *metricsRegistry) add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.families[name].values[formatLabels(labels)] += delta
+}
+
+func (m *metricsRegistry) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// set sets a gauge, the labels are given as name, value pairs
+func (m *metricsRegistry) set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.families[name].values[formatLabels(labels)] = value
+}
+
+// observePhase records how long a phase of the drill took
+func (m *metricsRegistry) observePhase(phase string, took time.Duration) {
+	m.set(metricPhaseDuration, took.Seconds(), "phase", phase)
+}
+
+// observeRun records how a drill that finished at the time went
+func (m *metricsRegistry) observeRun(exitCode int, finished time.Time) {
+	now := float64(finished.Unix())
+
+	m.set(metricLastRun, now)
+	if exitCode == 0 {
+		m.set(metricLastSuccess, now)
+		m.set(metricLastRunSuccess, 1)
+	} else {
+		m.set(metricLastRunSuccess, 0)
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes the metrics in the Prometheus text format. A metric is only
+// written once it has a value.
+func (m *metricsRegistry) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := m.families[name]
+		if len(f.values) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.kind)
+
+		labels := []string{}
+		for l := range f.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		for _, l := range labels {
+			fmt.Fprintf(&buf, "%s%s %v\n", f.name, l, f.values[l])
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	err := m.write(w)
+	if err != nil {
+		log.WithError(err).Warn("Could not write the metrics")
+	}
+}
+
+// push sends the metrics to a Prometheus Pushgateway, replacing any pushed
+// before for the same group
+func (m *metricsRegistry) push(gateway string, job string, asgName string) error {
+	var buf bytes.Buffer
+	err := m.write(&buf)
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimRight(gateway, "/") +
+		"/metrics/job/" + url.PathEscape(job) +
+		"/asg/" + url.PathEscape(asgName)
+
+	req, err := http.NewRequest("PUT", u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	res, err := (&http.Client{Timeout: pushTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the Pushgateway returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// countASGCalls counts the calls the autoscaling client makes, and the
+// errors, by operation
+func countASGCalls(c *client.Client) {
+	c.Handlers.Complete.PushBack(func(r *request.Request) {
+		drillMetrics.inc(metricASGCalls, "operation", r.Operation.Name)
+		if r.Error != nil {
+			drillMetrics.inc(metricASGErrors, "operation", r.Operation.Name)
+		}
+	})
+}
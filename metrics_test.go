@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTestMetrics gives the test a fresh registry, the returned function puts
+// the old one back
+func useTestMetrics() func() {
+	old := drillMetrics
+	drillMetrics = newMetricsRegistry()
+	return func() { drillMetrics = old }
+}
+
+func metricsText(m *metricsRegistry) string {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.String()
+}
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetricsRegistry()
+	m.inc(metricContentChecks)
+	m.inc(metricContentChecks)
+	m.set(metricPhaseDuration, 1.5, "phase", "standby")
+	m.set(metricPhaseDuration, 30, "phase", "failover")
+
+	assert.Equal(t, `# HELP anarchy_kitten_content_checks_total The content checks made
+# TYPE anarchy_kitten_content_checks_total counter
+anarchy_kitten_content_checks_total 2
+# HELP anarchy_kitten_phase_duration_seconds How long each phase of the last drill took
+# TYPE anarchy_kitten_phase_duration_seconds gauge
+anarchy_kitten_phase_duration_seconds{phase="failover"} 30
+anarchy_kitten_phase_duration_seconds{phase="standby"} 1.5
+`, metricsText(m))
+}
+
+func TestMetricsObserveRun(t *testing.T) {
+	m := newMetricsRegistry()
+
+	m.observeRun(0, testStart)
+	assert.Contains(t, metricsText(m), "anarchy_kitten_last_run_success 1")
+	assert.Contains(t, metricsText(m), "anarchy_kitten_last_success_timestamp_seconds 1.4963076e+09")
+
+	m.observeRun(2, testStart)
+	assert.Contains(t, metricsText(m), "anarchy_kitten_last_run_success 0")
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := newMetricsRegistry()
+	m.inc(metricRecoveryRetries)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "anarchy_kitten_recovery_retries_total 1")
+}
+
+func TestMetricsPush(t *testing.T) {
+	var method, path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	m := newMetricsRegistry()
+	m.observeRun(0, testStart)
+
+	assert.Nil(t, m.push(ts.URL+"/", "anarchy-kitten", "prod"))
+	assert.Equal(t, "PUT", method)
+	assert.Equal(t, "/metrics/job/anarchy-kitten/asg/prod", path)
+	assert.Contains(t, body, "anarchy_kitten_last_run_success 1")
+}
+
+func TestMetricsPushFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	err := newMetricsRegistry().push(ts.URL, "anarchy-kitten", "prod")
+	assert.EqualError(t, err, "the Pushgateway returned 400 Bad Request")
+}
+
+func TestCountASGCalls(t *testing.T) {
+	defer useTestMetrics()()
+
+	c := &client.Client{}
+	countASGCalls(c)
+
+	c.Handlers.Complete.Run(&request.Request{Operation: &request.Operation{Name: "EnterStandby"}})
+	c.Handlers.Complete.Run(&request.Request{
+		Operation: &request.Operation{Name: "EnterStandby"},
+		Error:     errors.New("throttled"),
+	})
+
+	text := metricsText(drillMetrics)
+	assert.Contains(t, text, `anarchy_kitten_asg_api_calls_total{operation="EnterStandby"} 2`)
+	assert.Contains(t, text, `anarchy_kitten_asg_api_errors_total{operation="EnterStandby"} 1`)
+}
+
+func TestContentCheckMetrics(t *testing.T) {
+	defer useTestMetrics()()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer ts.Close()
+
+	checkForContentAtURL(nil, "primary", ts.URL, contentcheck.Auth{})
+	checkForContentAtURL(nil, "secondary", ts.URL, contentcheck.Auth{})
+
+	text := metricsText(drillMetrics)
+	assert.Contains(t, text, "anarchy_kitten_content_checks_total 2")
+	assert.Contains(t, text, "anarchy_kitten_content_check_failures_total 1")
+}
+
+func TestDoRecordsMetrics(t *testing.T) {
+	defer useTestMetrics()()
+
+	// The failover and the recovery each wait a poll for the content
+	served := []string{"primary", "secondary", "secondary", "primary"}
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(served[count]))
+		count++
+	}))
+	defer ts.Close()
+
+	exitCode := do(testClients(&mockAutoScalingClient{Success: true}), testDrill(ts.URL))
+	assert.Equal(t, 0, exitCode)
+
+	text := metricsText(drillMetrics)
+	assert.Contains(t, text, `anarchy_kitten_phase_duration_seconds{phase="standby"} 0`+"\n")
+	assert.Contains(t, text, `anarchy_kitten_phase_duration_seconds{phase="failover"} 0.001`+"\n")
+	assert.Contains(t, text, `anarchy_kitten_phase_duration_seconds{phase="restore"} 0`+"\n")
+	assert.Contains(t, text, `anarchy_kitten_phase_duration_seconds{phase="recovery"} 0.001`+"\n")
+	assert.Contains(t, text, "anarchy_kitten_last_run_success 1")
+	assert.Contains(t, text, "anarchy_kitten_content_checks_total 4")
+	assert.Contains(t, text, "anarchy_kitten_content_check_failures_total 2")
+	assert.Contains(t, text, "anarchy_kitten_last_success_timestamp_seconds 1.4963076e+09")
+}
+
+func TestMetricsObservePhase(t *testing.T) {
+	m := newMetricsRegistry()
+	m.observePhase("failover", 90*time.Second)
+
+	assert.Contains(t, metricsText(m), `anarchy_kitten_phase_duration_seconds{phase="failover"} 90`)
+}
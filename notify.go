@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"time"
+
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+)
+
+// Drill lifecycle events, as the drill sends them
+const (
+	eventStart            = drill.EventStart
+	eventFailoverDetected = drill.EventFailoverDetected
+	eventAborted          = drill.EventAborted
+	eventRestoreStarted   = drill.EventRestoreStarted
+	eventSuccess          = drill.EventSuccess
+	eventFailure          = drill.EventFailure
+)
+
+const notifyTimeout = 10 * time.Second
+
+// drillEvent is sent to the notifiers as a drill progresses
+type drillEvent struct {
+	Event    string            `json:"event"`
+	RunID    string            `json:"runId"`
+	ASG      string            `json:"asg"`
+	Operator string            `json:"operator"`
+	Time     time.Time         `json:"time"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// notifier tells people about a drill, e.g. so on-call know the maintenance
+// page is expected
+type notifier interface {
+	notify(e drillEvent) error
+
+	// kind names the notifier in the logs, as its URL may be a secret
+	kind() string
+}
+
+// notifiers sends each event to all of them, a failure to notify is logged
+// but never stops the drill
+type notifiers []notifier
+
+func (ns notifiers) send(run drillRun, asgName string, event string, message string, details map[string]string) {
+	e := drillEvent{
+		Event:    event,
+		RunID:    run.id,
+		ASG:      asgName,
+		Operator: run.operator,
+		Time:     time.Now().UTC(),
+		Message:  message,
+		Details:  details,
+	}
+
+	for _, n := range ns {
+		err := n.notify(e)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"event":    event,
+				"notifier": n.kind(),
+			}).Warn("Could not send the notification")
+		}
+	}
+}
+
+// webhookNotifier POSTs the event as JSON
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: notifyTimeout}}
+}
+
+func (w *webhookNotifier) notify(e drillEvent) error {
+	return postJSON(w.client, w.url, e)
+}
+
+func (w *webhookNotifier) kind() string { return "webhook" }
+
+// slackNotifier POSTs the event to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newSlackNotifier(url string) *slackNotifier {
+	return &slackNotifier{url: url, client: &http.Client{Timeout: notifyTimeout}}
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (s *slackNotifier) notify(e drillEvent) error {
+	return postJSON(s.client, s.url, slackPayload(e))
+}
+
+func (s *slackNotifier) kind() string { return "slack" }
+
+func slackPayload(e drillEvent) slackMessage {
+	color := "warning"
+	switch e.Event {
+	case eventSuccess:
+		color = "good"
+	case eventFailure, eventAborted:
+		color = "danger"
+	}
+
+	fields := []slackField{
+		{Title: "Autoscaling group", Value: e.ASG, Short: true},
+		{Title: "Operator", Value: e.Operator, Short: true},
+		{Title: "Run", Value: e.RunID, Short: true},
+	}
+
+	for _, key := range sortedStringKeys(e.Details) {
+		fields = append(fields, slackField{Title: key, Value: e.Details[key], Short: true})
+	}
+
+	return slackMessage{
+		Text:        fmt.Sprintf("Anarchy-Kitten drill on %s: %s", e.ASG, e.Message),
+		Attachments: []slackAttachment{{Color: color, Fields: fields}},
+	}
+}
+
+// postJSON sends the payload to the URL. An error never includes the URL,
+// as a Slack incoming webhook URL is a secret.
+func postJSON(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*neturl.Error); ok {
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the notification got %s", res.Status)
+	}
+
+	return nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingNotifier keeps the events it is sent
+type recordingNotifier struct {
+	events []drillEvent
+}
+
+func (r *recordingNotifier) notify(e drillEvent) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recordingNotifier) kind() string { return "recording" }
+
+func (r *recordingNotifier) types() []string {
+	types := []string{}
+	for _, e := range r.events {
+		types = append(types, e.Event)
+	}
+
+	return types
+}
+
+type failingNotifier struct{}
+
+func (failingNotifier) notify(drillEvent) error {
+	return errors.New("Error")
+}
+
+func (failingNotifier) kind() string { return "failing" }
+
+func TestNotifiersSend(t *testing.T) {
+	recorder := &recordingNotifier{}
+	ns := notifiers{failingNotifier{}, recorder}
+
+	ns.send(testRun, "prod", eventFailure, "The drill failed", map[string]string{"exitCode": "1"})
+
+	assert.Len(t, recorder.events, 1)
+	e := recorder.events[0]
+	assert.Equal(t, eventFailure, e.Event)
+	assert.Equal(t, "run1", e.RunID)
+	assert.Equal(t, "prod", e.ASG)
+	assert.Equal(t, "alice@host", e.Operator)
+	assert.Equal(t, "1", e.Details["exitCode"])
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received drillEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer ts.Close()
+
+	e := drillEvent{
+		Event:   eventStart,
+		RunID:   "run1",
+		ASG:     "prod",
+		Time:    time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC),
+		Message: "Starting",
+	}
+
+	assert.Nil(t, newWebhookNotifier(ts.URL).notify(e))
+	assert.Equal(t, e, received)
+}
+
+func TestWebhookNotifierErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	err := newWebhookNotifier(ts.URL).notify(drillEvent{})
+	assert.EqualError(t, err, "the notification got 500 Internal Server Error")
+}
+
+func TestNotifierErrorsHideTheURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u := ts.URL + "/services/T000/B000/SECRET"
+	ts.Close()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.InfoLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.PanicLevel)
+	}()
+
+	notifiers{newSlackNotifier(u)}.send(testRun, "prod", eventStart, "Starting", nil)
+
+	assert.Contains(t, out.String(), "notifier=slack")
+	assert.NotContains(t, out.String(), "SECRET")
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var received slackMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer ts.Close()
+
+	err := newSlackNotifier(ts.URL).notify(drillEvent{
+		Event:    eventSuccess,
+		RunID:    "run1",
+		ASG:      "prod",
+		Operator: "alice@host",
+		Message:  "The drill succeeded",
+		Details:  map[string]string{"took": "5m0s"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Anarchy-Kitten drill on prod: The drill succeeded", received.Text)
+	assert.Equal(t, "good", received.Attachments[0].Color)
+	assert.Contains(t, received.Attachments[0].Fields, slackField{Title: "took", Value: "5m0s", Short: true})
+}
+
+func TestSlackPayloadColors(t *testing.T) {
+	assert.Equal(t, "danger", slackPayload(drillEvent{Event: eventFailure}).Attachments[0].Color)
+	assert.Equal(t, "warning", slackPayload(drillEvent{Event: eventStart}).Attachments[0].Color)
+}
+
+func TestGetNotifiers(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("notify.webhook", "https://hooks.mywebsite.com/drills")
+	viper.Set("notify.slack", "https://hooks.slack.com/services/T0/B0/X")
+
+	problems := []string{}
+	ns := getNotifiers(&problems)
+
+	assert.Empty(t, problems)
+	assert.Len(t, ns, 2)
+	assert.IsType(t, &webhookNotifier{}, ns[0])
+	assert.IsType(t, &slackNotifier{}, ns[1])
+}
+
+func TestGetNotifiersInvalid(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("notify.webhook", "hooks")
+	viper.Set("notify.slack", "secret")
+
+	problems := []string{}
+	ns := getNotifiers(&problems)
+
+	assert.Empty(t, ns)
+
+	// The Slack URL is a secret so it isn't repeated
+	assert.Equal(t, []string{
+		`notify.webhook "hooks" is not a valid URL`,
+		"notify.slack is not a valid URL",
+	}, problems)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/growkudos/Anarchy-Kitten/asg"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Scenario step actions
+const (
+	actionInject        = "inject"
+	actionWaitContent   = "wait-content"
+	actionHold          = "hold"
+	actionAssertRoute53 = "assert-route53"
+	actionRestore       = "restore"
+)
+
+// What to do when a step fails. Aborting skips the remaining steps but still
+// restores every group a fault was injected into.
+const (
+	onFailureAbort    = "abort"
+	onFailureContinue = "continue"
+)
+
+// Route53 treats an endpoint as healthy when more than this fraction of its
+// health checkers do.
+const route53HealthyThreshold = 0.18
+
+// scenario is a declarative drill, read from YAML, e.g.
+//
+//	name: Maintenance page
+//	steps:
+//	  - action: inject
+//	    group: prod
+//	  - action: wait-content
+//	    url: https://www.mywebsite.com
+//	    content: Back soon!
+//	    timeout: 20m
+//	  - action: hold
+//	    duration: 10m
+//	  - action: assert-route53
+//	    healthCheck: 0a1b2c3d-...
+//	    status: unhealthy
+//	  - action: restore
+//	    group: prod
+type scenario struct {
+	Name  string         `yaml:"name"`
+	Steps []scenarioStep `yaml:"steps"`
+}
+
+type scenarioStep struct {
+	Name        string `yaml:"name"`
+	Action      string `yaml:"action"`
+	Group       string `yaml:"group"`
+	URL         string `yaml:"url"`
+	Content     string `yaml:"content"`
+	HealthCheck string `yaml:"healthCheck"`
+	Status      string `yaml:"status"`
+	Duration    string `yaml:"duration"`
+	Poll        string `yaml:"poll"`
+	Timeout     string `yaml:"timeout"`
+	OnFailure   string `yaml:"onFailure"`
+}
+
+func (s scenarioStep) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	return s.Action
+}
+
+func readScenario(path string) (scenario, error) {
+	var s scenario
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = yaml.Unmarshal(contents, &s)
+	if err != nil {
+		return s, err
+	}
+
+	problems := s.validate()
+	if len(problems) > 0 {
+		return s, &configError{problems: problems}
+	}
+
+	return s, nil
+}
+
+func (s scenario) validate() []string {
+	problems := []string{}
+
+	if len(s.Steps) == 0 {
+		problems = append(problems, "the scenario has no steps")
+	}
+
+	for i, step := range s.Steps {
+		prefix := fmt.Sprintf("step %d (%s): ", i+1, step)
+		required := func(name string, value string) {
+			if value == "" {
+				problems = append(problems, prefix+name+" is required")
+			}
+		}
+
+		switch step.Action {
+		case actionInject, actionRestore:
+			required("group", step.Group)
+		case actionWaitContent:
+			required("url", step.URL)
+			required("content", step.Content)
+		case actionHold:
+			required("duration", step.Duration)
+		case actionAssertRoute53:
+			required("healthCheck", step.HealthCheck)
+			if step.Status != "healthy" && step.Status != "unhealthy" {
+				problems = append(problems, prefix+"status must be healthy or unhealthy")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%saction %q is unknown", prefix, step.Action))
+		}
+
+		for _, d := range []struct {
+			name  string
+			value string
+		}{
+			{"duration", step.Duration},
+			{"poll", step.Poll},
+			{"timeout", step.Timeout},
+		} {
+			if d.value == "" {
+				continue
+			}
+			parsed, err := parseDuration(d.value)
+			if err != nil || parsed <= 0 {
+				problems = append(problems, fmt.Sprintf("%s%s %q is not a positive duration", prefix, d.name, d.value))
+			}
+		}
+
+		if step.OnFailure != "" &&
+			step.OnFailure != onFailureAbort &&
+			step.OnFailure != onFailureContinue {
+			problems = append(problems, fmt.Sprintf("%sonFailure %q is unknown, expected abort or continue", prefix, step.OnFailure))
+		}
+	}
+
+	return problems
+}
+
+// scenarioRunner runs a scenario's steps using the same building blocks as a
+// standard drill.
+type scenarioRunner struct {
+	svc        autoscalingiface.AutoScalingAPI
+	elbSvc     elbv2iface.ELBV2API
+	ec2Svc     ec2iface.EC2API
+	route53Svc route53iface.Route53API
+	drillRun   drillRun
+	auth       contentcheck.Auth
+	defaults   drill.Phase
+	clock      clock.Clock
+
+	// Each group is locked while a fault is injected into it, unless lock
+	// is nil
+	lock        func(group string) drillLock
+	lockTTL     time.Duration
+	forceUnlock bool
+
+	// The instances put into standby, by group, so they can be restored
+	injected map[string]*injectedFault
+}
+
+type injectedFault struct {
+	instanceIDs     []*string
+	targetGroupARNs []*string
+	lock            lockInfo
+}
+
+func (r *scenarioRunner) run(s scenario) int {
+	log.WithFields(log.Fields{
+		"scenario": s.Name,
+		"steps":    len(s.Steps),
+	}).Info("Running scenario")
+
+	r.injected = map[string]*injectedFault{}
+	exitCode := 0
+
+	for i, step := range s.Steps {
+		logger := log.WithFields(log.Fields{
+			"step":   i + 1,
+			"name":   step.String(),
+			"action": step.Action,
+		})
+		logger.Info("Starting step")
+
+		// The faults already injected stay locked however long the
+		// scenario runs
+		r.renewLocks()
+
+		result := r.runStep(step)
+		exitCode += result
+
+		if result == 0 {
+			logger.Info("Step succeeded")
+			continue
+		}
+
+		if step.OnFailure == onFailureContinue {
+			logger.Warn("Step failed, continuing")
+			continue
+		}
+
+		logger.Error("Step failed, aborting the scenario")
+		break
+	}
+
+	// Whatever happened, nothing is left in standby
+	for group := range r.injected {
+		log.WithField("group", group).Warn("Restoring a group the scenario left in standby")
+		exitCode += r.restore(scenarioStep{Group: group})
+	}
+
+	log.WithFields(log.Fields{
+		"scenario": s.Name,
+		"exitCode": exitCode,
+	}).Info("Scenario finished")
+
+	return exitCode
+}
+
+func (r *scenarioRunner) runStep(step scenarioStep) int {
+	switch step.Action {
+	case actionInject:
+		return r.inject(step)
+	case actionWaitContent:
+		p := r.phase(step)
+		return contentcheck.Poll(
+			r.clock,
+			step.Content,
+			step.URL,
+			r.auth,
+			p.Poll,
+			p.Timeout,
+			func(content string, u string, auth contentcheck.Auth) int {
+				return checkForContentAtURL(nil, content, u, auth)
+			},
+			nil)
+	case actionHold:
+		d, _ := parseDuration(step.Duration)
+		log.WithField("duration", d).Info("Holding")
+		r.clock.Sleep(d)
+		return 0
+	case actionAssertRoute53:
+		return r.assertRoute53(step)
+	case actionRestore:
+		return r.restore(step)
+	}
+
+	log.WithField("action", step.Action).Error("Unknown scenario action")
+	return 1
+}
+
+// phase returns the step's poll and timeout, falling back to the defaults
+func (r *scenarioRunner) phase(step scenarioStep) drill.Phase {
+	p := r.defaults
+
+	if step.Poll != "" {
+		p.Poll, _ = parseDuration(step.Poll)
+	}
+
+	if step.Timeout != "" {
+		p.Timeout, _ = parseDuration(step.Timeout)
+	}
+
+	return p
+}
+
+func (r *scenarioRunner) inject(step scenarioStep) int {
+	p := r.phase(step)
+
+	start := time.Now()
+	fault := &injectedFault{
+		lock: lockInfo{
+			RunID:   r.drillRun.id,
+			Owner:   r.drillRun.operator,
+			Expires: start.Add(r.lockTTL),
+		},
+	}
+
+	if r.lock != nil {
+		lock := r.lock(step.Group)
+		if r.forceUnlock {
+			err := lock.forceUnlock()
+			if err != nil {
+				log.WithError(err).WithField("group", step.Group).Error("Could not force the lock open")
+				return 1
+			}
+		}
+
+		err := lock.acquire(fault.lock)
+		if err != nil {
+			log.WithError(err).WithField("group", step.Group).Error("Could not lock the autoscaling group")
+			return 1
+		}
+	}
+
+	group, err := getAutoScalingGroup(&step.Group, r.svc)
+	if err != nil {
+		log.WithError(err).WithField("group", step.Group).Error("Could not describe the autoscaling group")
+		if r.lock != nil {
+			err = r.lock(step.Group).release(fault.lock)
+			if err != nil {
+				log.WithError(err).WithField("group", step.Group).Error("Could not release the lock")
+			}
+		}
+		return 1
+	}
+	instanceIDs := asg.InstanceIDs(group.Instances)
+	fault.instanceIDs = instanceIDs
+	fault.targetGroupARNs = group.TargetGroupARNs
+	r.injected[step.Group] = fault
+
+	// A scenario has no deadline, so the lock's expiry is the latest it
+	// should end
+	result := tagDrill(
+		r.svc,
+		r.ec2Svc,
+		step.Group,
+		instanceIDs,
+		drillTags(r.drillRun, start, fault.lock.Expires))
+
+	result += asg.EnterStandby(r.clock, r.svc, step.Group, instanceIDs, p.Poll, p.Timeout, nil)
+	if result != 0 {
+		return result
+	}
+
+	return asg.WaitForTargetHealth(
+		r.clock,
+		r.elbSvc,
+		group.TargetGroupARNs,
+		instanceIDs,
+		asg.TargetStatesOutOfService,
+		p.Poll,
+		p.Timeout,
+		nil)
+}
+
+func (r *scenarioRunner) restore(step scenarioStep) int {
+	fault, ok := r.injected[step.Group]
+	if !ok {
+		log.WithField("group", step.Group).Warn("No fault was injected into the group, nothing to restore")
+		return 0
+	}
+
+	p := r.phase(step)
+	exitCode := 0
+
+	// As with a standard drill this tries forever to get all the instances
+	// back into service
+	for {
+		instances, err := getInstancesInAutoScalingGroup(&step.Group, r.svc)
+		if err != nil {
+			log.WithError(err).WithField("group", step.Group).Error("Could not check the instances are back in service")
+			r.clock.Sleep(p.Poll)
+			continue
+		}
+		if asg.AllInService(instances) {
+			break
+		}
+
+		r.renewLocks()
+		result, _ := asg.ExitStandby(
+			r.clock,
+			r.svc,
+			step.Group,
+			fault.instanceIDs,
+			p.Poll,
+			p.Timeout,
+		)
+		exitCode += result
+	}
+	delete(r.injected, step.Group)
+	exitCode += untagDrill(r.svc, r.ec2Svc, step.Group, fault.instanceIDs)
+
+	if r.lock != nil {
+		err := r.lock(step.Group).release(fault.lock)
+		if err != nil {
+			log.WithError(err).WithField("group", step.Group).Error("Could not release the lock")
+			exitCode++
+		}
+	}
+
+	exitCode += asg.WaitForTargetHealth(
+		r.clock,
+		r.elbSvc,
+		fault.targetGroupARNs,
+		fault.instanceIDs,
+		asg.TargetStatesInService,
+		p.Poll,
+		p.Timeout,
+		nil)
+
+	return exitCode
+}
+
+// renewLocks pushes the expiry of every injected fault's lock back by
+// another lockTTL, as a standard drill does for its hold and recovery
+func (r *scenarioRunner) renewLocks() {
+	if r.lock == nil {
+		return
+	}
+
+	for group, fault := range r.injected {
+		fault.lock.Expires = time.Now().Add(r.lockTTL)
+		err := r.lock(group).renew(fault.lock)
+		if err != nil {
+			log.WithError(err).WithField("group", group).Warn("Could not renew the lock")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"group":   group,
+			"expires": fault.lock.Expires,
+		}).Debug("Renewed the lock")
+	}
+}
+
+func (r *scenarioRunner) assertRoute53(step scenarioStep) int {
+	p := r.phase(step)
+	wantHealthy := step.Status == "healthy"
+
+	var pollIteration int64
+
+	for {
+		if pollIteration >= clock.Attempts(p.Timeout, p.Poll) {
+			break
+		}
+
+		healthy, err := isRoute53HealthCheckHealthy(r.route53Svc, step.HealthCheck)
+		if err != nil {
+			return 1
+		}
+
+		if healthy == wantHealthy {
+			log.WithFields(log.Fields{
+				"healthCheck": step.HealthCheck,
+				"status":      step.Status,
+			}).Info("Route53 health check has the expected status")
+			return 0
+		}
+
+		r.clock.Sleep(p.Poll)
+		pollIteration++
+		log.WithField("poll", pollIteration).Info("Polling Route53 health check")
+	}
+
+	log.WithFields(log.Fields{
+		"healthCheck": step.HealthCheck,
+		"status":      step.Status,
+	}).Error("Route53 health check did not reach the expected status")
+	return 1
+}
+
+func isRoute53HealthCheckHealthy(
+	route53Svc route53iface.Route53API,
+	healthCheckID string) (bool, error) {
+
+	resp, err := route53Svc.GetHealthCheckStatus(&route53.GetHealthCheckStatusInput{
+		HealthCheckId: aws.String(healthCheckID),
+	})
+	if err != nil {
+		log.WithError(err).Error("GetHealthCheckStatus failed")
+		return false, err
+	}
+
+	if len(resp.HealthCheckObservations) == 0 {
+		return false, nil
+	}
+
+	healthy := 0
+	for _, observation := range resp.HealthCheckObservations {
+		if observation.StatusReport != nil &&
+			strings.HasPrefix(aws.StringValue(observation.StatusReport.Status), "Success") {
+			healthy++
+		}
+	}
+
+	return float64(healthy)/float64(len(resp.HealthCheckObservations)) > route53HealthyThreshold, nil
+}
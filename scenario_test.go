@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/growkudos/Anarchy-Kitten/drill"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRoute53Client struct {
+	route53iface.Route53API
+	Error bool
+
+	// The statuses reported by the health checkers on each call, the last
+	// one is repeated
+	Statuses    [][]string
+	statusCount int
+}
+
+func (m *mockRoute53Client) GetHealthCheckStatus(
+	*route53.GetHealthCheckStatusInput) (
+	*route53.GetHealthCheckStatusOutput, error) {
+	if m.Error {
+		return nil, errors.New("Error")
+	}
+
+	statuses := m.Statuses[len(m.Statuses)-1]
+	if m.statusCount < len(m.Statuses) {
+		statuses = m.Statuses[m.statusCount]
+	}
+	m.statusCount++
+
+	resp := &route53.GetHealthCheckStatusOutput{}
+	for _, status := range statuses {
+		resp.HealthCheckObservations = append(
+			resp.HealthCheckObservations,
+			&route53.HealthCheckObservation{
+				StatusReport: &route53.StatusReport{Status: aws.String(status)},
+			})
+	}
+
+	return resp, nil
+}
+
+func testScenarioRunner(svc *mockAutoScalingClient, route53Svc *mockRoute53Client) *scenarioRunner {
+	return &scenarioRunner{
+		svc:        svc,
+		elbSvc:     &mockELBV2Client{},
+		ec2Svc:     &mockEC2Client{},
+		route53Svc: route53Svc,
+		drillRun:   testRun,
+		defaults:   drill.Phase{Poll: 1 * time.Millisecond, Timeout: 3 * time.Millisecond},
+		clock:      testClock(),
+		injected:   map[string]*injectedFault{},
+	}
+}
+
+func TestReadScenario(t *testing.T) {
+	path := writeConfigFile(t, "scenario.yaml", `
+name: Maintenance page
+steps:
+  - action: inject
+    group: prod
+  - action: wait-content
+    url: https://www.mywebsite.com
+    content: Back soon!
+    timeout: 20m
+    onFailure: continue
+  - action: hold
+    duration: 10m
+  - action: restore
+    group: prod
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := readScenario(path)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Maintenance page", s.Name)
+	assert.Len(t, s.Steps, 4)
+	assert.Equal(t, "Back soon!", s.Steps[1].Content)
+	assert.Equal(t, onFailureContinue, s.Steps[1].OnFailure)
+}
+
+func TestReadScenarioInvalid(t *testing.T) {
+	path := writeConfigFile(t, "scenario.yaml", `
+steps:
+  - action: inject
+  - action: hold
+    duration: soon
+  - action: assert-route53
+    healthCheck: abc
+    status: fine
+  - action: reboot
+    onFailure: ignore
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	_, err := readScenario(path)
+
+	assert.Equal(t, &configError{problems: []string{
+		"step 1 (inject): group is required",
+		`step 2 (hold): duration "soon" is not a positive duration`,
+		"step 3 (assert-route53): status must be healthy or unhealthy",
+		`step 4 (reboot): action "reboot" is unknown`,
+		`step 4 (reboot): onFailure "ignore" is unknown, expected abort or continue`,
+	}}, err)
+}
+
+func TestReadScenarioNoSteps(t *testing.T) {
+	path := writeConfigFile(t, "scenario.yaml", "name: Empty\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	_, err := readScenario(path)
+
+	assert.Equal(t, &configError{problems: []string{"the scenario has no steps"}}, err)
+}
+
+func TestScenarioStepPhase(t *testing.T) {
+	r := testScenarioRunner(&mockAutoScalingClient{}, nil)
+
+	assert.Equal(t, r.defaults, r.phase(scenarioStep{}))
+	assert.Equal(
+		t,
+		drill.Phase{Poll: 5 * time.Second, Timeout: 3 * time.Millisecond},
+		r.phase(scenarioStep{Poll: "5"}))
+	assert.Equal(
+		t,
+		drill.Phase{Poll: 1 * time.Millisecond, Timeout: 2 * time.Minute},
+		r.phase(scenarioStep{Timeout: "2m"}))
+}
+
+func TestRunScenarioSuccess(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "secondary")
+	}))
+	defer ts.Close()
+
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"InService", "Standby"},
+	}
+	r := testScenarioRunner(mockSvc, &mockRoute53Client{
+		Statuses: [][]string{{"Success: HTTP Status Code 200"}, {"Failure: Connection timed out"}},
+	})
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionInject, Group: "test"},
+		{Action: actionWaitContent, URL: ts.URL, Content: "secondary"},
+		{Action: actionHold, Duration: "1ms"},
+		{Action: actionAssertRoute53, HealthCheck: "check", Status: "unhealthy"},
+		{Action: actionRestore, Group: "test"},
+	}})
+
+	assert.Equal(t, 0, exitCode)
+	assert.Empty(t, r.injected)
+}
+
+func TestRunScenarioAbortRestores(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "primary")
+	}))
+	defer ts.Close()
+
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"InService", "Standby"},
+	}
+	route53Svc := &mockRoute53Client{Statuses: [][]string{{"Failure"}}}
+	r := testScenarioRunner(mockSvc, route53Svc)
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionInject, Group: "test"},
+		{Action: actionWaitContent, URL: ts.URL, Content: "secondary"},
+		{Action: actionAssertRoute53, HealthCheck: "check", Status: "unhealthy"},
+	}})
+
+	// The content check failed, the Route53 assertion was skipped and the
+	// group was still restored
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, 0, route53Svc.statusCount)
+	assert.Empty(t, r.injected)
+}
+
+func TestRunScenarioContinue(t *testing.T) {
+	route53Svc := &mockRoute53Client{Statuses: [][]string{{"Success"}}}
+	r := testScenarioRunner(&mockAutoScalingClient{Success: true}, route53Svc)
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionAssertRoute53, HealthCheck: "check", Status: "unhealthy", OnFailure: onFailureContinue},
+		{Action: actionAssertRoute53, HealthCheck: "check", Status: "healthy"},
+	}})
+
+	assert.Equal(t, 1, exitCode)
+}
+
+func TestRunScenarioRestoreWithoutInject(t *testing.T) {
+	r := testScenarioRunner(&mockAutoScalingClient{}, nil)
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionRestore, Group: "test"},
+	}})
+
+	assert.Equal(t, 0, exitCode)
+}
+
+func TestRunScenarioLocksInjectedGroups(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"InService", "Standby"},
+	}
+	r := testScenarioRunner(mockSvc, nil)
+	r.lockTTL = time.Hour
+	r.lock = func(group string) drillLock {
+		return &asgTagLock{svc: mockSvc, asgName: group, clock: r.clock}
+	}
+
+	assert.Equal(t, 0, r.inject(scenarioStep{Group: "test"}))
+	assert.Contains(t, mockSvc.Tags[lockTag], "run=run1")
+	assert.Equal(t, "run1", mockSvc.Tags[tagRunID])
+
+	assert.Equal(t, 0, r.restore(scenarioStep{Group: "test"}))
+	assert.Empty(t, mockSvc.Tags)
+}
+
+type renewCountingLock struct {
+	drillLock
+	renewals *int
+}
+
+func (l renewCountingLock) renew(info lockInfo) error {
+	*l.renewals++
+	return l.drillLock.renew(info)
+}
+
+func TestRunScenarioRenewsLocks(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{
+		Success:       true,
+		ServiceStatus: []string{"InService", "Standby"},
+	}
+	r := testScenarioRunner(mockSvc, nil)
+	r.lockTTL = time.Hour
+	renewals := 0
+	r.lock = func(group string) drillLock {
+		return renewCountingLock{
+			drillLock: &asgTagLock{svc: mockSvc, asgName: group, clock: r.clock},
+			renewals:  &renewals,
+		}
+	}
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionInject, Group: "test"},
+		{Action: actionHold, Duration: "2h"},
+		{Action: actionRestore, Group: "test"},
+	}})
+
+	// Before the hold and the restore, and before taking the instances out
+	// of standby
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, 3, renewals)
+	assert.Empty(t, mockSvc.Tags)
+}
+
+func TestRunScenarioInjectLocked(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{Success: true}
+	r := testScenarioRunner(mockSvc, nil)
+	r.lock = func(group string) drillLock {
+		return &asgTagLock{svc: mockSvc, asgName: group, clock: r.clock}
+	}
+	assert.Nil(t, r.lock("test").acquire(testLockInfo("other", time.Hour)))
+
+	exitCode := r.run(scenario{Steps: []scenarioStep{
+		{Action: actionInject, Group: "test"},
+	}})
+
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, 0, mockSvc.describeCount)
+}
+
+func TestIsRoute53HealthCheckHealthy(t *testing.T) {
+	for _, test := range []struct {
+		statuses []string
+		healthy  bool
+	}{
+		{[]string{}, false},
+		{[]string{"Success: HTTP Status Code 200"}, true},
+		{[]string{"Failure: Connection timed out"}, false},
+		// 1 in 5 is over the 18% threshold
+		{[]string{"Success", "Failure", "Failure", "Failure", "Failure"}, true},
+		{[]string{"Success", "Failure", "Failure", "Failure", "Failure", "Failure"}, false},
+	} {
+		healthy, err := isRoute53HealthCheckHealthy(
+			&mockRoute53Client{Statuses: [][]string{test.statuses}},
+			"check")
+
+		assert.Nil(t, err)
+		assert.Equal(t, test.healthy, healthy, "%v", test.statuses)
+	}
+}
+
+func TestIsRoute53HealthCheckHealthyError(t *testing.T) {
+	_, err := isRoute53HealthCheckHealthy(&mockRoute53Client{Error: true}, "check")
+
+	assert.NotNil(t, err)
+}
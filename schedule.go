@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five field cron expression: minute, hour, day
+// of month, month and day of week. Each field can be *, a number, a range
+// such as 1-5, a list such as 1,3,5 and can have a step such as */15.
+type cronSchedule struct {
+	minute     map[int]bool
+	hour       map[int]bool
+	dayOfMonth map[int]bool
+	month      map[int]bool
+	dayOfWeek  map[int]bool
+
+	// As in cron, when both days are restricted a time matches either
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// The longest a schedule can go without matching is a leap day on a given
+// day of the week, so stop looking after that.
+const maxScheduleSearch = 28 * 366 * 24 * time.Hour
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("the schedule %q should have 5 fields, it has %d", expression, len(fields))
+	}
+
+	s := &cronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+
+	var err error
+	for i, f := range []struct {
+		set  *map[int]bool
+		name string
+		min  int
+		max  int
+	}{
+		{&s.minute, "minute", 0, 59},
+		{&s.hour, "hour", 0, 23},
+		{&s.dayOfMonth, "day of month", 1, 31},
+		{&s.month, "month", 1, 12},
+		{&s.dayOfWeek, "day of week", 0, 7},
+	} {
+		*f.set, err = parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("the schedule's %s is invalid: %s", f.name, err)
+		}
+	}
+
+	// Sunday can be either 0 or 7
+	if s.dayOfWeek[7] {
+		s.dayOfWeek[0] = true
+	}
+
+	return s, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("%q is not a valid step", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", bounds[0])
+			}
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", bounds[1])
+			}
+		default:
+			var err error
+			from, err = strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", part)
+			}
+			to = from
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// next returns the first time the schedule matches after the given time, or
+// the zero time if it never does
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	end := after.Add(maxScheduleSearch)
+
+	for t.Before(end) {
+		if !s.month[int(t.Month())] || !s.matchesDay(t) {
+			// Skip to the start of the next day
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.minute[t.Minute()] {
+			return t
+		}
+
+		t = t.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth[t.Day()]
+	dayOfWeek := s.dayOfWeek[int(t.Weekday())]
+
+	switch {
+	case s.anyDayOfMonth && s.anyDayOfWeek:
+		return true
+	case s.anyDayOfMonth:
+		return dayOfWeek
+	case s.anyDayOfWeek:
+		return dayOfMonth
+	}
+
+	return dayOfMonth || dayOfWeek
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a range of days and a time of day a drill is allowed to start
+// in, written as e.g. "Mon-Fri 10:00-16:00" or "Sat,Sun 09:00-12:00".
+type timeWindow struct {
+	days map[time.Weekday]bool
+	from time.Duration
+	to   time.Duration
+}
+
+func parseTimeWindow(window string) (timeWindow, error) {
+	w := timeWindow{days: map[time.Weekday]bool{}}
+
+	fields := strings.Fields(window)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("the window %q should be days and times, e.g. Mon-Fri 10:00-16:00", window)
+	}
+
+	for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return w, fmt.Errorf("the window %q has an unknown day %q", window, bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, ok = weekdays[bounds[1]]
+			if !ok {
+				return w, fmt.Errorf("the window %q has an unknown day %q", window, bounds[1])
+			}
+		}
+
+		// Ranges can wrap around the weekend, e.g. Fri-Mon
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("the window %q should have a time range, e.g. 10:00-16:00", window)
+	}
+
+	var err error
+	w.from, err = parseTimeOfDay(times[0])
+	if err != nil {
+		return w, fmt.Errorf("the window %q has an invalid start: %s", window, err)
+	}
+	w.to, err = parseTimeOfDay(times[1])
+	if err != nil {
+		return w, fmt.Errorf("the window %q has an invalid end: %s", window, err)
+	}
+
+	if w.from >= w.to {
+		return w, fmt.Errorf("the window %q ends before it starts", window)
+	}
+
+	return w, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time like 10:00", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.days[t.Weekday()] {
+		return false
+	}
+
+	sinceMidnight := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	return sinceMidnight >= w.from && sinceMidnight < w.to
+}
+
+// drillCalendar decides when the daemon may start a drill
+type drillCalendar struct {
+	schedule  *cronSchedule
+	windows   []timeWindow
+	blackouts map[string]bool
+	location  *time.Location
+}
+
+const blackoutDateFormat = "2006-01-02"
+
+// allowed says whether a drill can start at the given time, and if not why
+func (c drillCalendar) allowed(t time.Time) (bool, string) {
+	t = t.In(c.location)
+
+	if c.blackouts[t.Format(blackoutDateFormat)] {
+		return false, "the date is blacked out"
+	}
+
+	if len(c.windows) == 0 {
+		return true, ""
+	}
+
+	for _, w := range c.windows {
+		if w.contains(t) {
+			return true, ""
+		}
+	}
+
+	return false, "the time is outside the allowed windows"
+}
+
+// next returns the next scheduled time after the given one
+func (c drillCalendar) next(after time.Time) time.Time {
+	return c.schedule.next(after.In(c.location))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronField(t *testing.T) {
+	for _, test := range []struct {
+		field  string
+		values []int
+	}{
+		{"5", []int{5}},
+		{"1-3", []int{1, 2, 3}},
+		{"1,4,6", []int{1, 4, 6}},
+		{"*/20", []int{0, 20, 40}},
+		{"10-30/10", []int{10, 20, 30}},
+	} {
+		values, err := parseCronField(test.field, 0, 59)
+		assert.Nil(t, err)
+
+		expected := map[int]bool{}
+		for _, v := range test.values {
+			expected[v] = true
+		}
+		assert.Equal(t, expected, values, test.field)
+	}
+}
+
+func TestParseCronFieldInvalid(t *testing.T) {
+	for _, field := range []string{"60", "a", "5-1", "*/0", "1-b", "*/x"} {
+		_, err := parseCronField(field, 0, 59)
+		assert.NotNil(t, err, field)
+	}
+}
+
+func TestParseCronScheduleWrongFieldCount(t *testing.T) {
+	_, err := parseCronSchedule("0 11 * *")
+	assert.EqualError(t, err, `the schedule "0 11 * *" should have 5 fields, it has 4`)
+}
+
+func TestParseCronScheduleInvalidField(t *testing.T) {
+	_, err := parseCronSchedule("0 25 * * *")
+	assert.EqualError(t, err, `the schedule's hour is invalid: "25" is outside 0-23`)
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// A Sunday
+	from := time.Date(2026, 10, 18, 12, 30, 15, 0, time.UTC)
+
+	for _, test := range []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 18, 12, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 18, 12, 45, 0, 0, time.UTC)},
+		{"0 11 * * *", time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)},
+		{"0 11 * * 2", time.Date(2026, 10, 20, 11, 0, 0, 0, time.UTC)},
+		{"0 9 1 * *", time.Date(2026, 11, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2026, 10, 25, 12, 0, 0, 0, time.UTC)},
+		// Either day matches when both are restricted
+		{"0 0 20 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseCronSchedule(test.expression)
+		assert.Nil(t, err)
+		assert.Equal(t, test.next, s.next(from), test.expression)
+	}
+}
+
+func TestCronScheduleNeverMatches(t *testing.T) {
+	s, err := parseCronSchedule("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, s.next(time.Now()).IsZero())
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	w, err := parseTimeWindow("Mon-Fri 10:00-16:00")
+	assert.Nil(t, err)
+
+	// 2026-10-19 is a Monday
+	assert.True(t, w.contains(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)))
+	assert.True(t, w.contains(time.Date(2026, 10, 23, 15, 59, 59, 0, time.UTC)))
+	assert.False(t, w.contains(time.Date(2026, 10, 19, 16, 0, 0, 0, time.UTC)))
+	assert.False(t, w.contains(time.Date(2026, 10, 19, 9, 59, 0, 0, time.UTC)))
+	assert.False(t, w.contains(time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)))
+}
+
+func TestParseTimeWindowDayLists(t *testing.T) {
+	w, err := parseTimeWindow("sat,Fri-Mon 09:00-12:00")
+	assert.Nil(t, err)
+	assert.Equal(t, map[time.Weekday]bool{
+		time.Friday:   true,
+		time.Saturday: true,
+		time.Sunday:   true,
+		time.Monday:   true,
+	}, w.days)
+}
+
+func TestParseTimeWindowInvalid(t *testing.T) {
+	for _, window := range []string{
+		"Mon-Fri",
+		"Someday 10:00-16:00",
+		"Mon-Fri 10:00",
+		"Mon-Fri 10am-4pm",
+		"Mon-Fri 16:00-10:00",
+	} {
+		_, err := parseTimeWindow(window)
+		assert.NotNil(t, err, window)
+	}
+}
+
+func TestDrillCalendarAllowed(t *testing.T) {
+	w, err := parseTimeWindow("Mon-Fri 10:00-16:00")
+	assert.Nil(t, err)
+
+	c := drillCalendar{
+		windows:   []timeWindow{w},
+		blackouts: map[string]bool{"2026-12-24": true},
+		location:  time.UTC,
+	}
+
+	ok, _ := c.allowed(time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+
+	ok, reason := c.allowed(time.Date(2026, 10, 19, 17, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+	assert.Equal(t, "the time is outside the allowed windows", reason)
+
+	ok, reason = c.allowed(time.Date(2026, 12, 24, 11, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+	assert.Equal(t, "the date is blacked out", reason)
+}
+
+func TestDrillCalendarUsesItsLocation(t *testing.T) {
+	w, err := parseTimeWindow("Mon-Fri 10:00-16:00")
+	assert.Nil(t, err)
+
+	c := drillCalendar{windows: []timeWindow{w}, location: time.FixedZone("UTC+5", 5*60*60)}
+
+	// 07:00 UTC is 12:00 in the calendar's zone
+	ok, _ := c.allowed(time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Tags put on the autoscaling group and its instances while a drill has them
+// in standby, so anyone looking in the console can tell why, and so a crashed
+// drill's groups can be found again.
+const (
+	tagRunID       = "anarchy-kitten:run-id"
+	tagStarted     = "anarchy-kitten:started"
+	tagOperator    = "anarchy-kitten:operator"
+	tagExpectedEnd = "anarchy-kitten:expected-end"
+)
+
+// The app's own tags come and go during a drill so aren't compared with the
+// group as it was before it
+const appTagPrefix = "anarchy-kitten:"
+
+var drillTagKeys = []string{tagRunID, tagStarted, tagOperator, tagExpectedEnd}
+
+// drillRun identifies a run of the app in the lock and the drill tags
+type drillRun struct {
+	id       string
+	operator string
+}
+
+func newDrillRun() drillRun {
+	return drillRun{id: newRunID(), operator: operatorName()}
+}
+
+// operatorName is the operator from the config, or user@host
+func operatorName() string {
+	if operator := viper.GetString("operator"); operator != "" {
+		return operator
+	}
+
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return name + "@" + host
+}
+
+func drillTags(run drillRun, start time.Time, expectedEnd time.Time) map[string]string {
+	return map[string]string{
+		tagRunID:       run.id,
+		tagStarted:     start.UTC().Format(time.RFC3339),
+		tagOperator:    run.operator,
+		tagExpectedEnd: expectedEnd.UTC().Format(time.RFC3339),
+	}
+}
+
+// tagDrill tags the group and the instances with the drill's details
+func tagDrill(
+	svc autoscalingiface.AutoScalingAPI,
+	ec2Svc ec2iface.EC2API,
+	asgName string,
+	instanceIDs []*string,
+	tags map[string]string) int {
+	asgTags := []*autoscaling.Tag{}
+	ec2Tags := []*ec2.Tag{}
+
+	for _, key := range drillTagKeys {
+		asgTags = append(asgTags, &autoscaling.Tag{
+			Key:               aws.String(key),
+			Value:             aws.String(tags[key]),
+			ResourceId:        aws.String(asgName),
+			ResourceType:      aws.String("auto-scaling-group"),
+			PropagateAtLaunch: aws.Bool(false),
+		})
+		ec2Tags = append(ec2Tags, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+
+	exitCode := 0
+
+	_, err := svc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{Tags: asgTags})
+	if err != nil {
+		log.WithError(err).WithField("asg", asgName).Error("Could not tag the autoscaling group")
+		exitCode++
+	}
+
+	if len(instanceIDs) > 0 {
+		_, err = ec2Svc.CreateTags(&ec2.CreateTagsInput{
+			Resources: instanceIDs,
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			log.WithError(err).WithField("asg", asgName).Error("Could not tag the instances")
+			exitCode++
+		}
+	}
+
+	logger := log.WithFields(log.Fields{
+		"asg":   asgName,
+		"runId": tags[tagRunID],
+	})
+	if exitCode != 0 {
+		logger.Warn("The drill is not fully tagged, recover may not find what it left")
+		return exitCode
+	}
+	logger.Info("Tagged the autoscaling group and instances")
+
+	return exitCode
+}
+
+// untagDrill removes the drill's tags from the group and the instances
+func untagDrill(
+	svc autoscalingiface.AutoScalingAPI,
+	ec2Svc ec2iface.EC2API,
+	asgName string,
+	instanceIDs []*string) int {
+	asgTags := []*autoscaling.Tag{}
+	ec2Tags := []*ec2.Tag{}
+
+	for _, key := range drillTagKeys {
+		asgTags = append(asgTags, &autoscaling.Tag{
+			Key:          aws.String(key),
+			ResourceId:   aws.String(asgName),
+			ResourceType: aws.String("auto-scaling-group"),
+		})
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key)})
+	}
+
+	exitCode := 0
+
+	_, err := svc.DeleteTags(&autoscaling.DeleteTagsInput{Tags: asgTags})
+	if err != nil {
+		log.WithError(err).WithField("asg", asgName).Error("Could not remove the drill tags from the autoscaling group")
+		exitCode++
+	}
+
+	if len(instanceIDs) > 0 {
+		_, err = ec2Svc.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: instanceIDs,
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			log.WithError(err).WithField("asg", asgName).Error("Could not remove the drill tags from the instances")
+			exitCode++
+		}
+	}
+
+	return exitCode
+}
+
+// getDrillTags returns the drill tags on the group, empty if there are none
+func getDrillTags(
+	svc autoscalingiface.AutoScalingAPI,
+	asgName string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	resp, err := svc.DescribeTags(&autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{
+				Name:   aws.String("auto-scaling-group"),
+				Values: []*string{aws.String(asgName)},
+			},
+			{
+				Name:   aws.String("key"),
+				Values: aws.StringSlice(drillTagKeys),
+			},
+		},
+	})
+	if err != nil {
+		return tags, err
+	}
+
+	for _, tag := range resp.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// findDrilledGroups returns the names of the groups still tagged by a drill,
+// e.g. one that crashed
+func findDrilledGroups(svc autoscalingiface.AutoScalingAPI) ([]string, error) {
+	groups := map[string]bool{}
+
+	input := &autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{
+				Name:   aws.String("key"),
+				Values: []*string{aws.String(tagRunID)},
+			},
+		},
+	}
+
+	for {
+		resp, err := svc.DescribeTags(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range resp.Tags {
+			groups[aws.StringValue(tag.ResourceId)] = true
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
+	}
+
+	names := []string{}
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
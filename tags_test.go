@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEC2Client struct {
+	ec2iface.EC2API
+	Error string
+
+	// The tags by instance ID and key
+	Tags map[string]map[string]string
+}
+
+func (m *mockEC2Client) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if m.Error == "CreateTags" {
+		return nil, errors.New("Error")
+	}
+
+	if m.Tags == nil {
+		m.Tags = map[string]map[string]string{}
+	}
+	for _, id := range input.Resources {
+		if m.Tags[*id] == nil {
+			m.Tags[*id] = map[string]string{}
+		}
+		for _, tag := range input.Tags {
+			m.Tags[*id][*tag.Key] = *tag.Value
+		}
+	}
+
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (m *mockEC2Client) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	if m.Error == "DeleteTags" {
+		return nil, errors.New("Error")
+	}
+
+	for _, id := range input.Resources {
+		for _, tag := range input.Tags {
+			delete(m.Tags[*id], *tag.Key)
+		}
+		if len(m.Tags[*id]) == 0 {
+			delete(m.Tags, *id)
+		}
+	}
+
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func TestDrillTags(t *testing.T) {
+	start := time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, map[string]string{
+		tagRunID:       "run1",
+		tagStarted:     "2026-10-19T11:00:00Z",
+		tagOperator:    "alice@host",
+		tagExpectedEnd: "2026-10-19T11:40:00Z",
+	}, drillTags(testRun, start, start.Add(40*time.Minute)))
+}
+
+func TestTagAndUntagDrill(t *testing.T) {
+	mockSvc := &mockAutoScalingClient{}
+	mockEC2 := &mockEC2Client{}
+	instanceIDs := aws.StringSlice([]string{"instance1", "instance2"})
+	tags := drillTags(testRun, time.Now(), time.Now().Add(time.Hour))
+
+	assert.Equal(t, 0, tagDrill(mockSvc, mockEC2, "test", instanceIDs, tags))
+	assert.Equal(t, tags, mockSvc.Tags)
+	assert.Equal(t, tags, mockEC2.Tags["instance2"])
+
+	found, err := getDrillTags(mockSvc, "test")
+	assert.Nil(t, err)
+	assert.Equal(t, tags, found)
+
+	assert.Equal(t, 0, untagDrill(mockSvc, mockEC2, "test", instanceIDs))
+	assert.Empty(t, mockSvc.Tags)
+	assert.Empty(t, mockEC2.Tags)
+}
+
+func TestTagDrillErrors(t *testing.T) {
+	instanceIDs := aws.StringSlice([]string{"instance1"})
+	tags := drillTags(testRun, time.Now(), time.Now().Add(time.Hour))
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.InfoLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.PanicLevel)
+	}()
+
+	assert.Equal(t, 2, tagDrill(
+		&mockAutoScalingClient{Error: "CreateOrUpdateTags"},
+		&mockEC2Client{Error: "CreateTags"},
+		"test",
+		instanceIDs,
+		tags))
+	assert.NotContains(t, out.String(), "Tagged the autoscaling group")
+	assert.Contains(t, out.String(), "level=warning msg=\"The drill is not fully tagged")
+	assert.Equal(t, 2, untagDrill(
+		&mockAutoScalingClient{Error: "DeleteTags"},
+		&mockEC2Client{Error: "DeleteTags"},
+		"test",
+		instanceIDs))
+}
+
+// taggedGroupsClient returns the run ID tag on several groups over two pages
+type taggedGroupsClient struct {
+	*mockAutoScalingClient
+}
+
+func (taggedGroupsClient) DescribeTags(
+	input *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
+	tag := func(group string) *autoscaling.TagDescription {
+		return &autoscaling.TagDescription{
+			Key:        aws.String(tagRunID),
+			Value:      aws.String("run1"),
+			ResourceId: aws.String(group),
+		}
+	}
+
+	if input.NextToken == nil {
+		return &autoscaling.DescribeTagsOutput{
+			Tags:      []*autoscaling.TagDescription{tag("prod"), tag("api")},
+			NextToken: aws.String("page2"),
+		}, nil
+	}
+
+	return &autoscaling.DescribeTagsOutput{
+		Tags: []*autoscaling.TagDescription{tag("admin")},
+	}, nil
+}
+
+func TestFindDrilledGroups(t *testing.T) {
+	groups, err := findDrilledGroups(taggedGroupsClient{&mockAutoScalingClient{}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admin", "api", "prod"}, groups)
+}
+
+func TestFindDrilledGroupsError(t *testing.T) {
+	_, err := findDrilledGroups(&mockAutoScalingClient{Error: "DescribeTags"})
+
+	assert.NotNil(t, err)
+}
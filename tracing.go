@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// Like the metrics, the spans are written in the OpenTelemetry (OTLP) JSON
+// encoding by hand. The app only ever records one drill's spans and sends
+// them once it finishes, which doesn't need the SDK.
+const (
+	tracingExporterNone = "none"
+	tracingExporterOTLP = "otlp"
+	tracingExporterFile = "file"
+
+	tracingServiceName = "anarchy-kitten"
+)
+
+// traceExportTimeout bounds sending the spans to the collector, so a slow
+// collector can't hold up the exit after a drill
+const traceExportTimeout = 10 * time.Second
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+
+	failed  bool
+	message string
+
+	tracer *tracer
+}
+
+// spanExporter sends the finished spans somewhere they can be looked at
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+// tracer keeps the spans of a drill until they are flushed, timing them by
+// its clock
+type tracer struct {
+	mu       sync.Mutex
+	exporter spanExporter
+	clock    clock.Clock
+	finished []*span
+}
+
+func newTracer(exporter spanExporter, c clock.Clock) *tracer {
+	return &tracer{exporter: exporter, clock: c}
+}
+
+// drillTracer is the tracer everything records to, in the same way as
+// drillMetrics
+var drillTracer = newTracer(nil, clock.Real{})
+
+// startPhase starts a span for a part of the drill, a nil parent starts a
+// new trace
+func (t *tracer) startPhase(parent *span, name string, attributes ...interface{}) *span {
+	return t.newSpan(parent, name, spanKindInternal, attributes)
+}
+
+// startCall starts a span for a single call to another service
+func (t *tracer) startCall(parent *span, name string, attributes ...interface{}) *span {
+	return t.newSpan(parent, name, spanKindClient, attributes)
+}
+
+func (t *tracer) newSpan(parent *span, name string, kind int, attributes []interface{}) *span {
+	s := &span{
+		spanID:     newSpanID(),
+		name:       name,
+		kind:       kind,
+		start:      t.clock.Now(),
+		attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = newTraceID()
+	}
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.attributes[fmt.Sprint(attributes[i])] = attributes[i+1]
+	}
+
+	return s
+}
+
+// set sets an attribute, the value is a string, bool or int
+func (s *span) set(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+
+	s.attributes[key] = value
+}
+
+// fail marks the span as failed, with the reason
+func (s *span) fail(message string) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+
+	s.failed = true
+	s.message = message
+}
+
+// failIf marks the span as failed when the exit code isn't zero
+func (s *span) failIf(exitCode int, message string) {
+	if exitCode != 0 {
+		s.fail(message)
+	}
+}
+
+// finish ends the span
+func (s *span) finish() {
+	t := s.tracer
+	end := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.end = end
+	t.finished = append(t.finished, s)
+}
+
+// drillSpans are the spans of the drill being run. The drill runs one phase
+// at a time, the calls it makes are traced as children of that phase, or of
+// the drill between phases.
+type drillSpans struct {
+	// The drill's own span, set before the drill starts
+	drill *span
+
+	mu     sync.Mutex
+	phases map[string]*span
+	phase  *span
+}
+
+func newDrillSpans() *drillSpans {
+	return &drillSpans{phases: map[string]*span{}}
+}
+
+// parent is the span the drill's calls are made in, nil before the drill
+// starts
+func (d *drillSpans) parent() *span {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.phase != nil {
+		return d.phase
+	}
+	return d.drill
+}
+
+func (d *drillSpans) startPhase(name string, s *span) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.phases[name] = s
+	d.phase = s
+}
+
+// finishPhase takes the phase's span out of the running, it is nil if the
+// phase wasn't started
+func (d *drillSpans) finishPhase(name string) *span {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.phases[name]
+	delete(d.phases, name)
+	if d.phase == s {
+		d.phase = nil
+	}
+	return s
+}
+
+// flush exports the finished spans, they are dropped when there is no
+// exporter
+func (t *tracer) flush() error {
+	t.mu.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+
+	if t.exporter == nil || len(spans) == 0 {
+		return nil
+	}
+
+	return t.exporter.export(spans)
+}
+
+func newTraceID() string {
+	id, _ := randomHex(16)
+	return id
+}
+
+func newSpanID() string {
+	id, _ := randomHex(8)
+	return id
+}
+
+// The OTLP JSON encoding of the spans, only the fields the app sets
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpPayload(spans []*span) otlpTraces {
+	out := []otlpSpan{}
+	for _, s := range spans {
+		status := otlpStatus{Code: 1}
+		if s.failed {
+			status = otlpStatus{Code: 2, Message: s.message}
+		}
+
+		out = append(out, otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            status,
+		})
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{
+			"service.name": tracingServiceName,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: tracingServiceName},
+			Spans: out,
+		}},
+	}}}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	out := []otlpAttribute{}
+	for _, key := range sortedKeys(attributes) {
+		var v otlpValue
+		switch value := attributes[key].(type) {
+		case bool:
+			v.BoolValue = aws.Bool(value)
+		case int:
+			v.IntValue = aws.String(strconv.Itoa(value))
+		case int64:
+			v.IntValue = aws.String(strconv.FormatInt(value, 10))
+		default:
+			v.StringValue = aws.String(fmt.Sprint(value))
+		}
+
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+
+	return out
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// otlpExporter sends the spans to an OpenTelemetry collector over OTLP/HTTP
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: traceExportTimeout},
+	}
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	body, err := json.Marshal(otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the collector returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// fileExporter appends the spans of each drill to a file as a line of OTLP
+// JSON, the same as the collector's file exporter writes
+type fileExporter struct {
+	path string
+}
+
+func (e *fileExporter) export(spans []*span) error {
+	body, err := json.Marshal(otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(e.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(body, '\n'))
+	return err
+}
+
+// traceASGCalls makes a span for each call the autoscaling client makes,
+// with the group and any scaling activities it started or looked at. Each
+// call is a child of the span parent returns when it is made.
+func traceASGCalls(c *client.Client, parent func() *span) {
+	var mu sync.Mutex
+	calls := map[*request.Request]*span{}
+
+	c.Handlers.Validate.PushFront(func(r *request.Request) {
+		s := drillTracer.startCall(parent(), "autoscaling."+r.Operation.Name,
+			"rpc.system", "aws-api",
+			"rpc.service", "AutoScaling",
+			"rpc.method", r.Operation.Name)
+
+		if asgName := stringField(r.Params, "AutoScalingGroupName"); asgName != "" {
+			s.set("aws.autoscaling.group", asgName)
+		}
+
+		mu.Lock()
+		calls[r] = s
+		mu.Unlock()
+	})
+
+	c.Handlers.Complete.PushBack(func(r *request.Request) {
+		mu.Lock()
+		s, ok := calls[r]
+		delete(calls, r)
+		mu.Unlock()
+		if !ok {
+			return
+		}
+
+		if ids := activityIDs(r.Params, r.Data); len(ids) > 0 {
+			s.set("aws.autoscaling.activity_ids", strings.Join(ids, ","))
+		}
+		if r.HTTPResponse != nil {
+			s.set("http.status_code", r.HTTPResponse.StatusCode)
+		}
+		if r.RetryCount > 0 {
+			s.set("aws.retries", r.RetryCount)
+		}
+		if r.Error != nil {
+			s.fail(r.Error.Error())
+		}
+
+		s.finish()
+	})
+}
+
+// stringField reads a string field of an SDK input or output, empty if it
+// doesn't have one
+func stringField(v interface{}, name string) string {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return ""
+	}
+
+	f := rv.FieldByName(name)
+	if !f.IsValid() {
+		return ""
+	}
+
+	s, _ := f.Interface().(*string)
+	return aws.StringValue(s)
+}
+
+// activityIDs lists the scaling activities a call asked about or started
+func activityIDs(params interface{}, data interface{}) []string {
+	ids := []string{}
+
+	if in, ok := params.(*autoscaling.DescribeScalingActivitiesInput); ok {
+		ids = append(ids, aws.StringValueSlice(in.ActivityIds)...)
+	}
+
+	var activities []*autoscaling.Activity
+	switch out := data.(type) {
+	case *autoscaling.EnterStandbyOutput:
+		activities = out.Activities
+	case *autoscaling.ExitStandbyOutput:
+		activities = out.Activities
+	case *autoscaling.DescribeScalingActivitiesOutput:
+		if len(ids) == 0 {
+			activities = out.Activities
+		}
+	}
+
+	for _, a := range activities {
+		ids = append(ids, aws.StringValue(a.ActivityId))
+	}
+
+	return ids
+}
+
+func flushTraces() {
+	err := drillTracer.flush()
+	if err != nil {
+		log.WithError(err).Warn("Could not export the traces")
+	}
+}
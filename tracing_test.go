@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/growkudos/Anarchy-Kitten/clock"
+	"github.com/growkudos/Anarchy-Kitten/contentcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingExporter keeps the spans it is given
+type recordingExporter struct {
+	spans []*span
+}
+
+func (e *recordingExporter) export(spans []*span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) named(name string) []*span {
+	found := []*span{}
+	for _, s := range e.spans {
+		if s.name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// useTestTracer gives the test a fresh tracer timed by the clock, the
+// returned function puts the old one back
+func useTestTracer(exporter spanExporter, c clock.Clock) func() {
+	old := drillTracer
+	drillTracer = newTracer(exporter, c)
+	return func() { drillTracer = old }
+}
+
+func TestTracerParentsSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	c := testClock()
+	tr := newTracer(exporter, c)
+
+	drill := tr.startPhase(nil, "drill")
+	standby := tr.startPhase(drill, "standby")
+	c.Sleep(time.Second)
+	call := tr.startCall(standby, "autoscaling.EnterStandby")
+	c.Sleep(time.Second)
+	call.finish()
+	standby.fail("timed out")
+	standby.finish()
+	after := tr.startCall(drill, "GET")
+	after.finish()
+	drill.finish()
+
+	assert.Nil(t, tr.flush())
+	assert.Len(t, exporter.spans, 4)
+	assert.Equal(t, "", drill.parentID)
+	assert.Equal(t, drill.spanID, standby.parentID)
+	assert.Equal(t, standby.spanID, call.parentID)
+	assert.Equal(t, drill.spanID, after.parentID)
+	for _, s := range exporter.spans {
+		assert.Equal(t, drill.traceID, s.traceID)
+	}
+	assert.Equal(t, testStart.Add(time.Second), call.start)
+	assert.Equal(t, testStart.Add(2*time.Second), call.end)
+	assert.Equal(t, testStart, drill.start)
+	assert.Equal(t, testStart.Add(2*time.Second), drill.end)
+
+	// The spans are only exported once
+	assert.Nil(t, tr.flush())
+	assert.Len(t, exporter.spans, 4)
+}
+
+func TestDrillSpansParent(t *testing.T) {
+	tr := newTracer(nil, testClock())
+	spans := newDrillSpans()
+	assert.Nil(t, spans.parent())
+
+	spans.drill = tr.startPhase(nil, "drill")
+	assert.Equal(t, spans.drill, spans.parent())
+
+	standby := tr.startPhase(spans.drill, "standby")
+	spans.startPhase("standby", standby)
+	assert.Equal(t, standby, spans.parent())
+
+	assert.Equal(t, standby, spans.finishPhase("standby"))
+	assert.Equal(t, spans.drill, spans.parent())
+	assert.Nil(t, spans.finishPhase("standby"))
+}
+
+func TestOTLPPayload(t *testing.T) {
+	tr := newTracer(nil, testClock())
+	s := tr.startCall(nil, "GET", "url.full", "https://www.mywebsite.com")
+	s.set("http.response.status_code", 200)
+	s.set("content.matched", false)
+	s.fail("not found")
+	s.finish()
+
+	body, err := json.Marshal(otlpPayload([]*span{s}))
+	assert.Nil(t, err)
+
+	text := string(body)
+	assert.Contains(t, text, `"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"anarchy-kitten"}}]}`)
+	assert.Contains(t, text, `"traceId":"`+s.traceID+`"`)
+	assert.Contains(t, text, `"kind":3`)
+	assert.Contains(t, text, `{"key":"content.matched","value":{"boolValue":false}}`)
+	assert.Contains(t, text, `{"key":"http.response.status_code","value":{"intValue":"200"}}`)
+	assert.Contains(t, text, `{"key":"url.full","value":{"stringValue":"https://www.mywebsite.com"}}`)
+	assert.Contains(t, text, `"status":{"code":2,"message":"not found"}`)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var path, contentType string
+	var payload otlpTraces
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer ts.Close()
+
+	tr := newTracer(newOTLPExporter(ts.URL+"/"), testClock())
+	tr.startPhase(nil, "drill").finish()
+
+	assert.Nil(t, tr.flush())
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, "drill", payload.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+}
+
+func TestOTLPExporterFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	tr := newTracer(newOTLPExporter(ts.URL), testClock())
+	tr.startPhase(nil, "drill").finish()
+
+	assert.EqualError(t, tr.flush(), "the collector returned 503 Service Unavailable")
+}
+
+func TestFileExporterAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "traces.jsonl")
+	tr := newTracer(&fileExporter{path: path}, testClock())
+
+	tr.startPhase(nil, "first").finish()
+	assert.Nil(t, tr.flush())
+	tr.startPhase(nil, "second").finish()
+	assert.Nil(t, tr.flush())
+
+	body, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"name":"first"`)
+	assert.Contains(t, lines[1], `"name":"second"`)
+}
+
+func TestTraceASGCalls(t *testing.T) {
+	exporter := &recordingExporter{}
+	defer useTestTracer(exporter, testClock())()
+
+	standby := drillTracer.startPhase(nil, "standby")
+	c := &client.Client{}
+	traceASGCalls(c, func() *span { return standby })
+
+	r := &request.Request{
+		Operation: &request.Operation{Name: "EnterStandby"},
+		Params:    &autoscaling.EnterStandbyInput{AutoScalingGroupName: aws.String("prod")},
+		Data: &autoscaling.EnterStandbyOutput{Activities: []*autoscaling.Activity{
+			{ActivityId: aws.String("activity1")},
+		}},
+		HTTPResponse: &http.Response{StatusCode: 200},
+	}
+	c.Handlers.Validate.Run(r)
+	c.Handlers.Complete.Run(r)
+
+	failed := &request.Request{
+		Operation: &request.Operation{Name: "DescribeScalingActivities"},
+		Params: &autoscaling.DescribeScalingActivitiesInput{
+			AutoScalingGroupName: aws.String("prod"),
+			ActivityIds:          []*string{aws.String("activity1")},
+		},
+		Error: errors.New("throttled"),
+	}
+	c.Handlers.Validate.Run(failed)
+	c.Handlers.Complete.Run(failed)
+
+	assert.Nil(t, drillTracer.flush())
+	assert.Len(t, exporter.spans, 2)
+
+	enter := exporter.named("autoscaling.EnterStandby")[0]
+	assert.Equal(t, "prod", enter.attributes["aws.autoscaling.group"])
+	assert.Equal(t, "activity1", enter.attributes["aws.autoscaling.activity_ids"])
+	assert.Equal(t, 200, enter.attributes["http.status_code"])
+	assert.Equal(t, standby.spanID, enter.parentID)
+	assert.False(t, enter.failed)
+
+	describe := exporter.named("autoscaling.DescribeScalingActivities")[0]
+	assert.Equal(t, "activity1", describe.attributes["aws.autoscaling.activity_ids"])
+	assert.True(t, describe.failed)
+	assert.Equal(t, "throttled", describe.message)
+}
+
+func TestContentCheckSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	defer useTestTracer(exporter, testClock())()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer ts.Close()
+
+	failover := drillTracer.startPhase(nil, "failover")
+	checkForContentAtURL(failover, "primary", ts.URL, contentcheck.Auth{})
+	checkForContentAtURL(nil, "secondary", ts.URL, contentcheck.Auth{})
+
+	assert.Nil(t, drillTracer.flush())
+	spans := exporter.named("GET")
+	assert.Len(t, spans, 2)
+	assert.Equal(t, true, spans[0].attributes["content.matched"])
+	assert.Equal(t, 200, spans[0].attributes["http.response.status_code"])
+	assert.NotEmpty(t, spans[0].attributes["server.address"])
+	assert.Equal(t, failover.spanID, spans[0].parentID)
+	assert.Equal(t, false, spans[1].attributes["content.matched"])
+	assert.Equal(t, "", spans[1].parentID)
+}
+
+func TestScriptSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	defer useTestTracer(exporter, testClock())()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer ts.Close()
+
+	script := &contentcheck.Script{
+		Name: "home",
+		Steps: []contentcheck.Step{
+			{URL: "/", Contains: []string{"primary"}},
+			{Name: "search", URL: "/search", Contains: []string{"results"}},
+		},
+	}
+	assert.Equal(t, 1, runScriptAtURL(nil, script, ts.URL, contentcheck.Auth{}))
+
+	assert.Nil(t, drillTracer.flush())
+	s := exporter.named("script")[0]
+	assert.Equal(t, "home", s.attributes["script.name"])
+	assert.Equal(t, 1, s.attributes["script.passed"])
+	assert.Equal(t, "search", s.attributes["script.step"])
+	assert.Equal(t, 200, s.attributes["http.response.status_code"])
+	assert.True(t, s.failed)
+	assert.Equal(t, `search: did not find "results"`, s.message)
+}
+
+func TestDoTracesPhases(t *testing.T) {
+	exporter := &recordingExporter{}
+	c := testClock()
+	defer useTestTracer(exporter, c)()
+
+	// The failover waits a poll for the secondary content
+	served := []string{"primary", "secondary", "primary"}
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(served[count]))
+		count++
+	}))
+	defer ts.Close()
+
+	opts := testDrill(ts.URL)
+	opts.clock = c
+	exitCode := do(testClients(&mockAutoScalingClient{Success: true}), opts)
+	assert.Equal(t, 0, exitCode)
+	assert.Nil(t, drillTracer.flush())
+
+	drillSpan := exporter.named("drill")[0]
+	assert.Equal(t, "test", drillSpan.attributes["aws.autoscaling.group"])
+	assert.Equal(t, 0, drillSpan.attributes["drill.exit_code"])
+	assert.Equal(t, testStart, drillSpan.start)
+	assert.Equal(t, testStart.Add(time.Millisecond), drillSpan.end)
+
+	for _, phase := range []string{"standby", "failover", "restore", "recovery"} {
+		spans := exporter.named(phase)
+		if assert.Len(t, spans, 1, phase) {
+			assert.Equal(t, drillSpan.spanID, spans[0].parentID, phase)
+		}
+	}
+
+	failover := exporter.named("failover")[0]
+	assert.Equal(t, time.Millisecond, failover.end.Sub(failover.start))
+
+	// The content checks are made in the phases
+	checks := exporter.named("GET")
+	if assert.Len(t, checks, 3) {
+		assert.Equal(t, failover.spanID, checks[0].parentID)
+		assert.Equal(t, failover.spanID, checks[1].parentID)
+		assert.Equal(t, exporter.named("recovery")[0].spanID, checks[2].parentID)
+	}
+}